@@ -1,78 +1,409 @@
 package main
 
 import (
+	"context"
 	"crypto/cipher"
-	"encoding/binary"
 	"fmt"
 	"log/slog"
+	"machine"
 	"machine/usb/cdc"
-	"math"
 	"os"
 	"time"
 
+	"github.com/toalaah/smart-bottle/pkg/alert"
 	"github.com/toalaah/smart-bottle/pkg/ble"
 	"github.com/toalaah/smart-bottle/pkg/ble/service"
 	"github.com/toalaah/smart-bottle/pkg/build"
+	"github.com/toalaah/smart-bottle/pkg/build/secrets"
+	"github.com/toalaah/smart-bottle/pkg/clock"
 	"github.com/toalaah/smart-bottle/pkg/crypto"
+	"github.com/toalaah/smart-bottle/pkg/diag"
+	"github.com/toalaah/smart-bottle/pkg/history"
+	"github.com/toalaah/smart-bottle/pkg/ota"
+	"github.com/toalaah/smart-bottle/pkg/power"
+	"github.com/toalaah/smart-bottle/pkg/remotelog"
 	"github.com/toalaah/smart-bottle/pkg/sensor"
+	"github.com/toalaah/smart-bottle/pkg/storage"
 	"github.com/toalaah/smart-bottle/pkg/transport"
 )
 
+const (
+	// Roughly 11 hours worth of readings at the default sample interval.
+	historyCapacity = 4096
+	// 16 bytes per persisted reading plus one spare erase block which is discarded whenever the log wraps around.
+	historyStoreSize = (historyCapacity*16/4096 + 1) * 4096
+	// Firmware images are staged in the last megabyte of flash, preceded by the history. Both are anchored at the end of flash, as machine.Flash starts right after the running image and thus moves with every build. Nothing boots staged images yet, which requires a bootloader or partition table selecting the slot.
+	firmwareSlotSize = 1024 * 1024
+	logCapacity      = 64
+)
+
 var (
-	l               *slog.Logger = nil
-	fillLevel       float32
-	err             error
-	fillBuf         = [4]byte{}
-	out             = [32]byte{}
-	publishInterval = time.Second * 3
-	msg             = &transport.Message{Type: transport.WaterLevel}
-	gcm             cipher.AEAD
+	l            *slog.Logger = nil
+	fillLevel    float32
+	err          error
+	out          = [40]byte{} // Nonce + reading + tag
+	cmdBuf       = [32]byte{}
+	cmd          = transport.Command{}
+	diagInterval = time.Second * 10
+	diagOut      = [64]byte{} // Nonce + report + tag
+	logInterval  = time.Millisecond * 500
+	logOut       = [12 + 4 + remotelog.MaxLineLen + 16]byte{} // Nonce + sequence number + line + tag
+	logs         *remotelog.Buffer
+	// Diagnostics and logs are only published while a client is connected and streaming respectively, both tickers are stopped otherwise so as not to wake the chip in between samples.
+	diagTicker   *time.Ticker
+	logTicker    *time.Ticker
+	logStreaming bool
+	logSeq       uint32
+	// Connection mode requested by the client, which is restored once a transfer completes.
+	connMode transport.ConnectionMode
+	// Replayed readings are merely queued by the stack, fast mode is thus kept for a while after the last one before restoring connMode. Restoring it right away would replace the request for fast mode before it is even issued, see service.SetConnectionMode.
+	modeTimer    *time.Timer
+	replayLinger = time.Second * 5
+	batteryLevel uint8
+	msg          = &transport.Message{Type: transport.WaterLevel}
+	gcm          cipher.AEAD
+	svc          *service.GattService
+	readings     *history.Buffer
 )
 
 func main() {
-	if build.Debug {
+	// Recent logs are always buffered so that they can be streamed to a client, additionally write them to USB CDC in debug builds. Builds serving the link over USB CDC keep it to frames, as log lines could be mistaken for them and would slow the link down, logs can be streamed over the link instead.
+	var cdcHandler slog.Handler
+	if build.Debug || build.SerialLink {
 		cdc.EnableUSBCDC()
-		l = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
 	}
+	if build.Debug && !build.SerialLink {
+		cdcHandler = slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})
+	}
+	logs = remotelog.NewBuffer(logCapacity)
+	l = slog.New(remotelog.NewHandler(logs, cdcHandler))
 	time.Sleep(time.Second * 5)
+	diag.SetResetReason(resetReason())
 
-	svc := ble.NewService(
-		service.WithLogger(l),
-		service.WithAdvertisementInterval(1250*time.Millisecond),
-		service.WithTXBufferSize(34), // Type + length + 32 bytes payload
-		service.WithAuth(true),
-	)
-	must("initialize BLE service", svc.Init())
+	slot, err := storage.NewPartition(machine.Flash, machine.Flash.Size()-firmwareSlotSize, firmwareSlotSize)
+	must("partition flash", err)
+	firmware := ota.NewReceiver(slot, secrets.FirmwarePublicKey, ota.WithLogger(l))
 
 	depthSensor := sensor.NewDepthSensorService(
 		sensor.WithLogger(l),
 		sensor.WithMaxReadAttempts(200), // Total read timeout of 20 seconds.
 		sensor.WithRetryDelay(time.Millisecond*100),
+		sensor.WithPowerPin(machine.GPIO22), // Drives the sensor's supply switch.
+		sensor.WithPowerActiveLow(build.SensorPowerActiveLow),
 	)
 	must("initialize depth sensor", depthSensor.Init())
 
-	// Perform a budget "TLS" connection (basically just a DH handshake).
-	// Wait until client has paired and authenticated.
-	key := svc.GetPairingKeyBlocking()
-	// Derive symmetric encryption channel.
-	gcm, err = crypto.NewGCM(key)
-	must("init gcm", err)
+	pm := power.NewManager(
+		power.DefaultConfig,
+		power.WithLogger(l),
+		power.WithPeripheral(depthSensor),
+	)
+	advInterval, advRefresh := pm.AdvertisementInterval(time.Now())
+
+	opts := []service.ServiceOption{
+		service.WithLogger(l),
+		service.WithAdvertisementInterval(advInterval),
+		service.WithTXBufferSize(42), // Type + length + 40 bytes payload
+		service.WithAuth(true),
+		service.WithBattery(true),
+		service.WithPublicMode(build.PublicMode),
+		service.WithFirmwareUpdate(firmware),
+		service.WithBroadcast(build.BroadcastMode),
+		service.WithImmediateAlert(true),
+		service.WithFeatures(transport.FeatureCommands | transport.FeatureBatching | transport.FeatureLogs | transport.FeatureDiagnostics),
+	}
+	if build.SerialLink {
+		// Clients on a desk may pair over USB instead, where Bluetooth tends to be flaky.
+		opts = append(opts, service.WithLink(serialPort{}))
+	}
+	svc = ble.NewService(opts...)
+	must("initialize BLE service", svc.Init())
+
+	alerter := alert.New(
+		alert.WithLogger(l),
+		alert.WithPin(machine.GPIO15), // Drives a buzzer or LED.
+	)
+	must("initialize alerter", alerter.Init())
+
+	battery := sensor.NewBatteryService(
+		sensor.WithBatteryLogger(l),
+	)
+	must("initialize battery monitor", battery.Init())
+	batteryLevel = battery.Read()
+	if err := svc.SetBatteryLevel(batteryLevel); err != nil {
+		l.Error("error publishing battery level", "error", err)
+	}
 
+	store, err := storage.NewPartition(machine.Flash, machine.Flash.Size()-firmwareSlotSize-historyStoreSize, historyStoreSize)
+	must("partition flash", err)
+	readings = history.New(
+		history.WithLogger(l),
+		history.WithCapacity(historyCapacity),
+		history.WithStore(store),
+	)
+	must("load reading history", readings.Load())
+
+	ticker := time.NewTicker(pm.Config().SampleInterval)
+	batteryTicker := time.NewTicker(pm.Config().BatteryInterval)
+	advTimer := time.NewTimer(advRefresh)
+	diagTicker = time.NewTicker(diagInterval)
+	diagTicker.Stop()
+	logTicker = time.NewTicker(logInterval)
+	logTicker.Stop()
+	modeTimer = time.NewTimer(replayLinger)
+	modeTimer.Stop()
+	// The sensor is read once warmed up, without holding up other events meanwhile.
+	warmupTimer := time.NewTimer(pm.Config().SensorWarmup)
+	warmupTimer.Stop()
 	for {
-		time.Sleep(publishInterval)
+		select {
+		case <-svc.Paired():
+			// Perform a budget "TLS" connection (basically just a DH handshake).
+			// Derive symmetric encryption channel once the client has paired and authenticated.
+			gcm, err = crypto.NewGCM(svc.PairingKey())
+			if err != nil {
+				// The client is left without a session until it pairs again, rather than halting the bottle.
+				l.Error("error initializing session cipher", "error", err)
+				gcm = nil
+				continue
+			}
+			// Streaming has to be requested anew by every client.
+			logStreaming = false
+			logTicker.Stop()
+			diagTicker.Reset(diagInterval)
+			logs.SetLevel(slog.LevelInfo)
+			// Pairing is done, idle in slow mode until the client requests a transfer.
+			connMode = transport.ConnectionSlow
+			svc.SetConnectionMode(connMode)
+			if build.BroadcastMode {
+				key, err := crypto.DeriveKey(svc.PairingKey(), crypto.BroadcastKeyLabel)
+				if err == nil {
+					err = svc.SetBroadcastKey(key)
+				}
+				if err != nil {
+					l.Error("error setting broadcast key", "error", err)
+				}
+			}
+			if err := publishDiagnostics(); err != nil {
+				l.Error("error publishing diagnostics", "error", err)
+			}
 
-		fillLevel, err = depthSensor.Read()
-		if err != nil {
-			l.Error("error reading fill level", "error", err)
-		} else {
+		case t := <-svc.TimeUpdates():
+			l.Debug("setting clock", "time", t, "previous", clock.Now())
+			clock.Set(t)
+			if err := svc.SetCurrentTime(clock.Now()); err != nil {
+				l.Error("error publishing current time", "error", err)
+			}
+
+		case <-svc.FirmwareReady():
+			// Activating the slot is left for a follow-up, rebooting would only restart the running image, see firmwareSlotSize.
+			l.Info("firmware image verified and staged, flash it via USB to boot it")
+
+		case level := <-svc.Alerts():
+			alerter.Alert(level)
+
+		case m := <-svc.Commands():
+			if err := handleCommand(m); err != nil {
+				l.Error("error handling command", "error", err)
+			}
+
+		case <-logTicker.C:
+			if err := publishLogs(); err != nil {
+				l.Error("error streaming logs", "error", err)
+			}
+
+		case connected := <-svc.Connections():
+			pm.SetConnected(connected, time.Now())
+			if !connected {
+				diagTicker.Stop()
+				logTicker.Stop()
+			}
+			if err := updateAdvertisementInterval(pm, advTimer); err != nil {
+				l.Error("error updating advertisement interval", "error", err)
+			}
+
+		case <-advTimer.C:
+			if err := updateAdvertisementInterval(pm, advTimer); err != nil {
+				l.Error("error updating advertisement interval", "error", err)
+			}
+
+		case <-modeTimer.C:
+			svc.SetConnectionMode(connMode)
+
+		case <-diagTicker.C:
+			if err := publishDiagnostics(); err != nil {
+				l.Error("error publishing diagnostics", "error", err)
+			}
+
+		case <-batteryTicker.C:
+			batteryLevel = battery.Read()
+			if err := svc.SetBatteryLevel(batteryLevel); err != nil {
+				l.Error("error publishing battery level", "error", err)
+			}
+
+		case <-ticker.C:
+			// The sensor is only powered while sampling.
+			if err := pm.PowerOn(); err != nil {
+				l.Error("error powering on depth sensor", "error", err)
+				continue
+			}
+			warmupTimer.Reset(pm.Config().SensorWarmup)
+
+		case <-warmupTimer.C:
+			// Readings are recorded regardless of whether a client is connected, allowing it to catch up later on.
+			fillLevel, err = depthSensor.Read()
+			if perr := pm.PowerOff(); perr != nil {
+				l.Error("error powering off depth sensor", "error", perr)
+			}
+			if err != nil {
+				l.Error("error reading fill level", "error", err)
+				continue
+			}
 			l.Debug("read fill level", "level", fillLevel)
+
+			if build.PublicMode {
+				// The chip's internal sensor only approximates the ambient temperature.
+				if err := svc.SetTemperature(machine.ReadTemperature()); err != nil {
+					l.Error("error publishing temperature", "error", err)
+				}
+				if err := svc.SetFillLevel(build.DefaultCalibration.FillRatio(fillLevel)); err != nil {
+					l.Error("error publishing public fill level", "error", err)
+				}
+			}
+
+			r, persistErr := readings.Append(uint32(clock.Now().Unix()), fillLevel)
+			if persistErr != nil {
+				l.Error("error persisting reading", "error", persistErr)
+			}
+			// The reading is buffered regardless, a client failing to receive it can sync it later on.
+			if err := publish(transport.WaterLevel, &r); err != nil {
+				l.Error("error publishing reading", "error", err)
+			}
+			// Its sequence number serves as the broadcast nonce, which could repeat after a reset unless persisted.
+			if persistErr == nil {
+				if err := svc.Broadcast(&transport.Broadcast{Seq: r.Seq, Level: r.Value, Battery: batteryLevel}); err != nil {
+					l.Error("error broadcasting reading", "error", err)
+				}
+			}
 		}
+	}
+}
 
-		binary.LittleEndian.PutUint32(fillBuf[:], math.Float32bits(fillLevel))
-		must("encrypt successfully", crypto.EncryptAES(gcm, fillBuf[:], out[:]))
+// updateAdvertisementInterval applies the advertisement interval appropriate for the current connection state, scheduling the next change if any.
+func updateAdvertisementInterval(pm *power.Manager, t *time.Timer) error {
+	d, next := pm.AdvertisementInterval(time.Now())
+	if next > 0 {
+		t.Reset(next)
+	}
+	return svc.SetAdvertisementInterval(d)
+}
 
-		msg.Load(out[:])
-		must("send successfully", svc.SendMessage(msg))
+// publish encrypts a reading and sends it to the connected client, if any.
+func publish(t transport.MessageType, r *transport.Reading) error {
+	if gcm == nil {
+		return nil
+	}
+	if err := crypto.EncryptAES(gcm, r.MarshalBytes(), out[:]); err != nil {
+		return err
+	}
+	msg.Type = t
+	msg.Load(out[:])
+	return svc.SendMessage(msg)
+}
+
+// publishDiagnostics encrypts the current diagnostics report for the connected client, if any.
+func publishDiagnostics() error {
+	if gcm == nil {
+		return nil
+	}
+	d := diag.Snapshot()
+	payload := d.MarshalBytes()
+	n := gcm.NonceSize() + len(payload) + gcm.Overhead()
+	if n > len(diagOut) {
+		return fmt.Errorf("diagnostics report of length %d exceeds buffer", n)
+	}
+	if err := crypto.EncryptAES(gcm, payload, diagOut[:n]); err != nil {
+		return err
+	}
+	m := transport.Message{Type: transport.Health}
+	m.Load(diagOut[:n])
+	return svc.SetDiagnostics(&m)
+}
+
+// publishLogs streams log lines buffered since the last call to the connected client, if it requested so.
+func publishLogs() error {
+	if !logStreaming || gcm == nil {
+		return nil
+	}
+	return logs.Since(logSeq, func(_ context.Context, seq uint32, line []byte) error {
+		e := transport.LogEntry{Seq: seq, Line: string(line)}
+		payload := e.MarshalBytes()
+		n := gcm.NonceSize() + len(payload) + gcm.Overhead()
+		if err := crypto.EncryptAES(gcm, payload, logOut[:n]); err != nil {
+			return err
+		}
+		m := transport.Message{Type: transport.Log}
+		m.Load(logOut[:n])
+		if err := svc.SendLog(&m); err != nil {
+			return err
+		}
+		logSeq = seq
+		return nil
+	})
+}
+
+func handleCommand(m transport.Message) error {
+	if gcm == nil {
+		return fmt.Errorf("received command before pairing")
+	}
+	n := len(m.Value) - gcm.NonceSize() - gcm.Overhead()
+	if n < 1 || n > len(cmdBuf) {
+		return fmt.Errorf("unexpected command length %d", n)
+	}
+	if err := crypto.DecryptAES(gcm, m.Value, cmdBuf[:]); err != nil {
+		return err
+	}
+	if err := transport.UnmarshalCommand(&cmd, cmdBuf[:n]); err != nil {
+		return err
+	}
+	l.Debug("received command", "code", cmd.Code)
+
+	switch cmd.Code {
+	case transport.CommandSync:
+		since, err := cmd.SyncSince()
+		if err != nil {
+			return err
+		}
+		svc.SetConnectionMode(transport.ConnectionFast)
+		defer modeTimer.Reset(replayLinger)
+		return readings.Since(since, func(r transport.Reading) error {
+			return publish(transport.History, &r)
+		})
+	case transport.CommandConnectionMode:
+		mode, err := cmd.ConnectionMode()
+		if err != nil {
+			return err
+		}
+		connMode = mode
+		svc.SetConnectionMode(connMode)
+		return nil
+	case transport.CommandLog:
+		enable, level, err := cmd.LogLevel()
+		if err != nil {
+			return err
+		}
+		l.Info("changing log streaming", "enable", enable, "level", level)
+		logStreaming, logSeq = enable, 0
+		if enable {
+			logTicker.Reset(logInterval)
+		} else {
+			logTicker.Stop()
+			level = slog.LevelInfo
+		}
+		logs.SetLevel(level)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %d", cmd.Code)
 	}
 }
 
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"device/rp"
+
+	"github.com/toalaah/smart-bottle/pkg/transport"
+)
+
+// resetReason reports what caused the chip to boot, as recorded by the watchdog. Resets via machine.CPUReset are not recorded and thus reported as power-on.
+func resetReason() transport.ResetReason {
+	reason := rp.WATCHDOG.REASON.Get()
+	switch {
+	case reason&rp.WATCHDOG_REASON_TIMER != 0:
+		return transport.ResetWatchdog
+	case reason&rp.WATCHDOG_REASON_FORCE != 0:
+		return transport.ResetForced
+	default:
+		return transport.ResetPowerOn
+	}
+}
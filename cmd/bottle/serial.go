@@ -0,0 +1,14 @@
+package main
+
+import "os"
+
+// serialPort is the USB CDC port. TinyGo connects the standard streams to it, with reads blocking until data arrives, as readers of a link expect.
+type serialPort struct{}
+
+func (serialPort) Read(b []byte) (int, error) {
+	return os.Stdin.Read(b)
+}
+
+func (serialPort) Write(b []byte) (int, error) {
+	return os.Stdout.Write(b)
+}
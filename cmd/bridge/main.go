@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+
+	"github.com/toalaah/smart-bottle/pkg/ble"
+	"github.com/toalaah/smart-bottle/pkg/ble/client"
+	"github.com/toalaah/smart-bottle/pkg/link"
+	"github.com/toalaah/smart-bottle/pkg/transport"
+)
+
+var l = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+const usage = `usage: bridge [-listen address] [-device id] [-address address] [-serial path]
+
+Relays a bottle to clients elsewhere, which connect to the bridge via their -bridge flag. The bridge connects to the bottle whenever a client connects, serving one client at a time. Readings and commands remain encrypted end to end, the bridge holds no keys.
+
+flags:
+  -listen address     listen on the given TCP address, or Unix socket if prefixed with unix: (default localhost:7107)
+  -device id          only relay the bottle with the given serial number
+  -address address    only relay the bottle with the given Bluetooth address
+  -serial path        relay the bottle attached via USB serial instead, e.g. /dev/ttyACM0
+`
+
+func main() {
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	listen := flag.String("listen", "localhost:7107", "")
+	device := flag.String("device", "", "")
+	address := flag.String("address", "", "")
+	serial := flag.String("serial", "", "")
+	flag.Parse()
+
+	opts := []client.ClientOption{client.WithLogger(l)}
+	if *device != "" {
+		id, err := transport.ParseDeviceID(*device)
+		must("parse device ID", err)
+		opts = append(opts, client.WithDeviceID(id))
+	}
+	if *address != "" {
+		opts = append(opts, client.WithAddress(*address))
+	}
+	if *serial != "" {
+		opts = append(opts, client.WithSerial(*serial))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	ln, err := net.Listen(link.SplitAddress(*listen))
+	must("listen", err)
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	l.Info("waiting for clients", "address", ln.Addr())
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			must("accept client", err)
+		}
+		l.Info("client connected", "remote", conn.RemoteAddr())
+		// Every client gets a fresh connection to the bottle, which resets its authentication state.
+		if err := ble.NewClient(opts...).Relay(ctx, conn); err != nil {
+			l.Error("stopped relaying", "remote", conn.RemoteAddr(), "error", err)
+		} else {
+			l.Info("client disconnected", "remote", conn.RemoteAddr())
+		}
+		conn.Close()
+	}
+}
+
+func must(action string, err error) {
+	if err != nil {
+		panic("failed to " + action + ": " + err.Error())
+	}
+}
@@ -1,50 +1,345 @@
 package main
 
 import (
-	"crypto/cipher"
-	"encoding/binary"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log/slog"
-	"math"
 	"os"
+	"os/signal"
+	"time"
 
 	"github.com/toalaah/smart-bottle/pkg/ble"
 	"github.com/toalaah/smart-bottle/pkg/ble/client"
+	"github.com/toalaah/smart-bottle/pkg/bond"
 	"github.com/toalaah/smart-bottle/pkg/build"
 	"github.com/toalaah/smart-bottle/pkg/build/secrets"
-	"github.com/toalaah/smart-bottle/pkg/crypto"
+	"github.com/toalaah/smart-bottle/pkg/link"
+	"github.com/toalaah/smart-bottle/pkg/ota"
+	"github.com/toalaah/smart-bottle/pkg/proximity"
+	"github.com/toalaah/smart-bottle/pkg/transport"
 	"tinygo.org/x/bluetooth"
 )
 
 var (
-	adapter     = bluetooth.DefaultAdapter
-	serviceUUID = build.ServiceUUID
-	l           = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
-	depth       float32
-	gcm         cipher.AEAD
-	buf         = [4]byte{}
+	adapter = bluetooth.DefaultAdapter
+	l       = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	sess    *client.Session
 )
 
+const usage = `usage: client [-device id] [-address address] [-serial path] [-bridge address] [-fast] [command]
+
+commands:
+  monitor        print readings as they arrive (default)
+  scan           list bottles in range without connecting
+  ota <image> [header]
+                 stage a firmware image signed by cmd/sign on the bottle (default header <image>.sig)
+  find           make the bottle beep, helping to locate it
+  proximity      warn when the bottle moves out of range
+  diag           print the bottle's health report
+  logs [level]   stream the bottle's logs at or above the given level (default INFO)
+  broadcast      pair once, then print readings from the bottle's encrypted advertisements
+  bonds          list the bottles paired with previously
+  forget <id>    forget a paired bottle, allowing to connect to any bottle in range again
+
+flags:
+  -device id          only connect to the bottle with the given serial number
+  -address address    only connect to the bottle with the given Bluetooth address
+  -serial path        connect to the bottle over USB serial instead, e.g. /dev/ttyACM0 or /dev/ttyACM*
+  -bridge address     connect to the bottle through a bridge instead, e.g. pi.local:7107 or unix:/run/bottle.sock
+  -fast               keep the connection in fast mode, trading battery life for latency
+`
+
 func main() {
-	c := ble.NewClient(
-		client.WithLogger(l),
-	)
-	must("init BLE client", c.Init())
-	key, err := c.Auth(secrets.PairingPin[:])
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	device := flag.String("device", "", "")
+	address := flag.String("address", "", "")
+	serial := flag.String("serial", "", "")
+	bridge := flag.String("bridge", "", "")
+	fast := flag.Bool("fast", false, "")
+	flag.Parse()
+
+	mode := "monitor"
+	if flag.NArg() > 0 {
+		mode = flag.Arg(0)
+	}
+	// Unknown modes are rejected before any Bluetooth work, rather than after connecting to a bottle.
+	switch mode {
+	case "monitor", "ota", "logs", "proximity", "find", "diag", "broadcast", "bonds", "forget", "scan":
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if (mode == "ota" || mode == "forget") && flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	opts := []client.ClientOption{client.WithLogger(l)}
+	if *device != "" {
+		id, err := transport.ParseDeviceID(*device)
+		must("parse device ID", err)
+		opts = append(opts, client.WithDeviceID(id))
+	}
+	if *address != "" {
+		opts = append(opts, client.WithAddress(*address))
+	}
+	if *serial != "" {
+		opts = append(opts, client.WithSerial(*serial))
+	}
+	if *bridge != "" {
+		opts = append(opts, client.WithBridge(link.SplitAddress(*bridge)))
+	}
+
+	// Paired bottles are remembered across runs and preferred when connecting.
+	bonds, err := bond.OpenDefault()
+	must("open bond store", err)
+	switch mode {
+	case "bonds":
+		listBonds(bonds)
+		return
+	case "forget":
+		id, err := transport.ParseDeviceID(flag.Arg(1))
+		must("parse device ID", err)
+		must("forget bottle", bonds.Forget(id))
+		l.Info("forgot bottle", "id", id)
+		return
+	case "scan":
+	default:
+		// Scanning lists all bottles in range, paired or not.
+		opts = append(opts, client.WithBonds(bonds))
+	}
+
+	// Interrupting aborts scanning and pairing, the default behavior is restored afterwards.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	c := ble.NewClient(opts...)
+	if mode == "scan" {
+		must("scan for bottles", scanBottles(ctx, c))
+		return
+	}
+	must("init BLE client", c.Init(ctx))
+	caps := c.Capabilities()
+	l.Info("connected to bottle", "id", c.DeviceID(), "protocol", caps.Version, "features", caps.Features)
+	pin := secrets.PairingPin[:]
+	if b, ok := c.Bond(); ok {
+		pin = b.Pin
+	}
+	sess, err = c.NewSession(ctx, pin)
+	if errors.Is(err, client.ErrIdentityMismatch) {
+		warnIdentity(c.DeviceID(), err)
+		os.Exit(1)
+	}
 	must("authenticate", err)
+	stop()
 
-	gcm, err := crypto.NewGCM(key)
-	must("init gcm", err)
+	if *fast {
+		must("request fast connection mode", sess.SetConnectionMode(transport.ConnectionFast))
+	}
+
+	switch mode {
+	case "monitor":
+		monitor(c)
+	case "ota":
+		header := flag.Arg(1) + ".sig"
+		if flag.NArg() > 2 {
+			header = flag.Arg(2)
+		}
+		must("update firmware", updateFirmware(c, flag.Arg(1), header))
+	case "logs":
+		level := slog.LevelInfo
+		if flag.NArg() > 1 {
+			must("parse log level", level.UnmarshalText([]byte(flag.Arg(1))))
+		}
+		must("stream logs", streamLogs(level))
+	case "proximity":
+		must("monitor proximity", c.MonitorProximity(proximity.New(), func(e proximity.Event) {
+			if e.State == proximity.StateOutOfRange {
+				l.Warn("you left your bottle behind", "rssi", e.RSSI)
+			} else {
+				l.Info("bottle is in range", "rssi", e.RSSI)
+			}
+		}))
+	case "find":
+		must("alert bottle", c.Alert(transport.AlertHigh))
+		// The alert level is written without response, disconnecting gracefully lets the stack flush the write rather than dropping it as the process exits.
+		must("disconnect", c.Disconnect(context.Background()))
+		l.Info("bottle is alerting")
+	case "diag":
+		must("read diagnostics", printDiagnostics())
+	case "broadcast":
+		must("scan broadcasts", scanBroadcasts(c))
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func monitor(c *client.GattClient) {
+	go func() {
+		for level := range c.Battery() {
+			if level < build.LowBatteryLevel {
+				l.Warn("bottle battery is low, please recharge", "level", level)
+			} else {
+				l.Info("received battery level", "level", level)
+			}
+		}
+	}()
+
+	// Catch up on readings which were buffered while no client was connected.
+	must("request buffered readings", sess.Sync(0))
 
-	for msg := range c.Queue() {
-		l.Debug("received message", "msg", msg)
-		err := crypto.DecryptAES(gcm, msg.Value, buf[:])
-		if err != nil {
-			l.Error("failed to decrypt", "error", err)
+	// The session requests readings missed while disconnected on its own.
+	go func() {
+		for e := range c.Events() {
+			l.Info("connection state changed", "state", e.State, "attempt", e.Attempt, "error", e.Err)
+			if errors.Is(e.Err, client.ErrIdentityMismatch) {
+				warnIdentity(c.DeviceID(), e.Err)
+			}
 		}
-		depth = math.Float32frombits(binary.LittleEndian.Uint32(buf[:]))
-		l.Debug("decrypted message", "msg", fmt.Sprintf("%+v", buf[:]), "depth", depth)
+	}()
+
+	go func() {
+		for err := range sess.Errors() {
+			l.Error("discarded message", "error", err)
+		}
+	}()
+
+	for r := range sess.Readings() {
+		l.Debug("received reading", "historic", r.Historic, "seq", r.Seq, "time", r.Time(), "depth", r.Value)
+	}
+}
+
+// updateFirmware stages the image at the given path on the bottle, along with the header signed by cmd/sign. The client holds no signing key, the bottle verifies the signature itself.
+func updateFirmware(c *client.GattClient, path, headerPath string) error {
+	image, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(headerPath)
+	if err != nil {
+		return err
+	}
+	var h ota.Header
+	if err := ota.UnmarshalHeader(&h, b); err != nil {
+		return err
+	}
+	if !h.Matches(image) {
+		return fmt.Errorf("header %s does not describe image %s, sign it anew", headerPath, path)
+	}
+	l.Info("pushing firmware image", "path", path, "size", h.Size, "hash", fmt.Sprintf("%x", h.Hash))
+	lastPercent := -1
+	err = c.UpdateFirmware(image, h, func(sent, total int) {
+		if p := sent * 100 / total; p != lastPercent {
+			lastPercent = p
+			l.Info("firmware update progress", "sent", sent, "total", total, "percent", p)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	l.Info("firmware image verified and staged on the bottle")
+	return nil
+}
+
+// streamLogs prints log lines streamed by the bottle until interrupted.
+func streamLogs(level slog.Level) error {
+	if err := sess.StreamLogs(level); err != nil {
+		return err
+	}
+	go func() {
+		for err := range sess.Errors() {
+			l.Error("discarded log entry", "error", err)
+		}
+	}()
+	var last uint32
+	for e := range sess.Logs() {
+		if last != 0 && e.Seq > last+1 {
+			fmt.Printf("... %d lines lost\n", e.Seq-last-1)
+		}
+		last = e.Seq
+		fmt.Printf("%s %s\n", time.Now().Format(time.TimeOnly), e.Line)
+	}
+	return nil
+}
+
+// printDiagnostics waits for the bottle to publish a health report for this session and prints it.
+func printDiagnostics() error {
+	var (
+		d   transport.Diagnostics
+		err error
+	)
+	// The bottle publishes a report right after pairing, give it a moment to do so.
+	for i := 0; i < 5; i++ {
+		time.Sleep(time.Second)
+		if d, err = sess.Diagnostics(); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("firmware version:  %s\n", d.Version)
+	fmt.Printf("uptime:            %s\n", time.Duration(d.Uptime)*time.Second)
+	fmt.Printf("reset reason:      %s\n", d.ResetReason)
+	fmt.Printf("sensor failures:   %d\n", d.SensorFailures)
+	fmt.Printf("checksum errors:   %d\n", d.ChecksumErrors)
+	fmt.Printf("auth failures:     %d\n", d.AuthFailures)
+	fmt.Printf("dropped messages:  %d\n", d.DroppedMessages)
+	fmt.Printf("free heap:         %d bytes\n", d.FreeHeap)
+	return nil
+}
+
+// warnIdentity explains how to proceed after a paired bottle presented an unexpected identity.
+func warnIdentity(id transport.DeviceID, err error) {
+	l.Error("refusing to authenticate, the bottle's identity changed since pairing", "id", id, "error", err)
+	fmt.Fprintf(os.Stderr, "\nWARNING: bottle %s does not hold the key it was paired with. Someone may be impersonating it.\n", id)
+	fmt.Fprintf(os.Stderr, "If you reflashed or replaced the bottle yourself, run `client forget %s` and pair again.\n", id)
+}
+
+// listBonds prints the bottles paired with previously.
+func listBonds(bonds *bond.Store) {
+	for _, b := range bonds.List() {
+		fmt.Printf("%s  %s  paired %s\n", b.ID, b.Address, b.PairedAt.Format(time.DateTime))
+	}
+}
+
+// scanBottles lists the bottles in range for a while, allowing the user to pick one via -device or -address.
+func scanBottles(ctx context.Context, c *client.GattClient) error {
+	bottles, err := c.Scan(ctx, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	seen := map[transport.DeviceID]bool{}
+	for b := range bottles {
+		if seen[b.ID] {
+			continue
+		}
+		seen[b.ID] = true
+		features := "unknown"
+		if b.Capabilities != nil {
+			features = b.Capabilities.Features.String()
+		}
+		fmt.Printf("%s  %s  %-12s  %4d dBm  %s\n", b.ID, b.Address.String(), b.Name, b.RSSI, features)
+	}
+	return nil
+}
+
+// scanBroadcasts registers the broadcast key of the paired bottle, disconnects and listens for its advertisements instead.
+func scanBroadcasts(c *client.GattClient) error {
+	key, err := c.BroadcastKey()
+	if err != nil {
+		return err
+	}
+	if err := c.AddBroadcastKey(key); err != nil {
+		return err
+	}
+	if err := c.Disconnect(context.Background()); err != nil {
+		return err
 	}
+	return c.ScanBroadcasts(func(address bluetooth.Address, b transport.Broadcast) {
+		l.Info("received broadcast", "address", address.String(), "seq", b.Seq, "depth", b.Level, "battery", b.Battery)
+	})
 }
 
 func must(action string, err error) {
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/toalaah/smart-bottle/pkg/ble/client"
+	"github.com/toalaah/smart-bottle/pkg/bond"
+	"github.com/toalaah/smart-bottle/pkg/build/secrets"
+	"github.com/toalaah/smart-bottle/pkg/gateway"
+	"github.com/toalaah/smart-bottle/pkg/transport"
+)
+
+var (
+	l = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	m *gateway.Manager
+)
+
+const usage = `usage: gateway [-status interval] id...
+
+Connects to all given bottles at once and prints their readings as they arrive. Bottles are identified by their serial number, see "client scan". Bottles paired with before are authenticated with the pin and public key remembered by the client, others are paired with and remembered.
+
+flags:
+  -status interval    print the state of all bottles at the given interval (default 30s)
+`
+
+func main() {
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	statusInterval := flag.Duration("status", 30*time.Second, "")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Bottles are pinned to the public key they presented when first paired with, just as by the client.
+	bonds, err := bond.OpenDefault()
+	must("open bond store", err)
+
+	m = gateway.New(gateway.WithLogger(l), gateway.WithClientOptions(client.WithBonds(bonds)))
+	for _, arg := range flag.Args() {
+		id, err := transport.ParseDeviceID(arg)
+		must("parse device ID", err)
+		// All bottles of a household share the pairing pin of this build, unless paired with another one before.
+		pin := secrets.PairingPin[:]
+		if b, ok := bonds.Get(id); ok {
+			pin = b.Pin
+		}
+		m.Add(id, pin)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	go func() {
+		for r := range m.Readings() {
+			l.Info("received reading", "device", r.Device, "historic", r.Historic, "seq", r.Seq, "time", r.Time(), "depth", r.Value)
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(*statusInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			printStatus()
+		}
+	}()
+
+	if err := m.Run(ctx); err != nil && ctx.Err() == nil {
+		must("run gateway", err)
+	}
+	printStatus()
+}
+
+func printStatus() {
+	for _, s := range m.Status() {
+		battery := "unknown"
+		if s.Battery >= 0 {
+			battery = fmt.Sprintf("%d%%", s.Battery)
+		}
+		errMsg := ""
+		if s.Err != nil {
+			errMsg = s.Err.Error()
+		}
+		fmt.Printf("%s  %-12s  battery %-7s  seq %-6d  dropped %-4d  malformed %-4d  %s\n", s.Device, s.State, battery, s.LastSeq, s.Dropped, s.Malformed, errMsg)
+	}
+}
+
+func must(action string, err error) {
+	if err != nil {
+		panic("failed to " + action + ": " + err.Error())
+	}
+}
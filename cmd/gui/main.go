@@ -2,11 +2,11 @@ package main
 
 import (
 	"bytes"
-	"crypto/cipher"
-	"encoding/binary"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"image/color"
-	"math"
 	"os"
 	"time"
 
@@ -23,7 +23,11 @@ import (
 	"gioui.org/widget/material"
 	"github.com/toalaah/smart-bottle/pkg/ble"
 	"github.com/toalaah/smart-bottle/pkg/ble/client"
-	"github.com/toalaah/smart-bottle/pkg/crypto"
+	"github.com/toalaah/smart-bottle/pkg/bond"
+	"github.com/toalaah/smart-bottle/pkg/build"
+	"github.com/toalaah/smart-bottle/pkg/link"
+	"github.com/toalaah/smart-bottle/pkg/proximity"
+	"github.com/toalaah/smart-bottle/pkg/transport"
 )
 
 var (
@@ -34,9 +38,15 @@ var (
 	isConnected           bool               = false
 	isAuthed              bool               = false
 	readings              ReadingsResponse
-	gcm                   cipher.AEAD = nil
+	session               *client.Session = nil
+	lastSeq               uint32          = 0
+	batteryLevel          int             = -1
+	leftBehind            bool            = false
+	reconnecting          bool            = false
+	identityChanged       bool            = false
 
 	connectButton = new(widget.Clickable)
+	findButton    = new(widget.Clickable)
 	authKeyBuf    = new(bytes.Buffer)
 	editor        = &widget.Editor{
 		Submit:     true,
@@ -52,10 +62,12 @@ type (
 )
 
 // Change according to height of water bottle
-var (
-	bottleDepthMax float32 = 13.6 // Empty
-	bottleDepthMin float32 = 5.11 // Full
+var calibration = build.DefaultCalibration
 
+// Connect over USB serial or through a bridge instead of Bluetooth if set, see client.WithSerial and client.WithBridge.
+var (
+	serialPath    = flag.String("serial", "", "connect to the bottle over USB serial instead, e.g. /dev/ttyACM0")
+	bridgeAddress = flag.String("bridge", "", "connect to the bottle through a bridge instead, e.g. pi.local:7107 or unix:/run/bottle.sock")
 )
 
 const (
@@ -63,6 +75,7 @@ const (
 )
 
 func main() {
+	flag.Parse()
 	l.Debug("obtaining access token")
 	err := Login()
 	if err != nil {
@@ -81,7 +94,7 @@ func main() {
 	go func() {
 		defer func() {
 			if c != nil && isConnected {
-				_ = c.Disconnect()
+				_ = c.Disconnect(context.Background())
 			}
 		}()
 		window := new(app.Window)
@@ -149,6 +162,57 @@ func drawLayout(gtx C, th *material.Theme) D {
 				return txt.Layout(gtx)
 			},
 		),
+		layout.Rigid(
+			func(gtx C) D {
+				if batteryLevel < 0 {
+					return D{}
+				}
+				txt := material.H6(th, fmt.Sprintf("Battery: %d%%", batteryLevel))
+				if batteryLevel < build.LowBatteryLevel {
+					txt.Text = fmt.Sprintf("Battery low (%d%%), please recharge your bottle!", batteryLevel)
+					txt.Color = color.NRGBA{R: 200, A: 255}
+					txt.Font.Weight = font.Bold
+				}
+				txt.Alignment = text.Middle
+				return txt.Layout(gtx)
+			},
+		),
+		layout.Rigid(
+			func(gtx C) D {
+				if !leftBehind {
+					return D{}
+				}
+				txt := material.H6(th, "You left your bottle behind!")
+				txt.Color = color.NRGBA{R: 200, A: 255}
+				txt.Font.Weight = font.Bold
+				txt.Alignment = text.Middle
+				return txt.Layout(gtx)
+			},
+		),
+		layout.Rigid(
+			func(gtx C) D {
+				if !reconnecting {
+					return D{}
+				}
+				txt := material.H6(th, "Connection lost, reconnecting...")
+				txt.Color = color.NRGBA{R: 200, A: 255}
+				txt.Font.Weight = font.Bold
+				txt.Alignment = text.Middle
+				return txt.Layout(gtx)
+			},
+		),
+		layout.Rigid(
+			func(gtx C) D {
+				if !identityChanged {
+					return D{}
+				}
+				txt := material.H6(th, "This bottle does not hold the key it was paired with, someone may be impersonating it. If you reflashed or replaced it, run \"client forget "+c.DeviceID().String()+"\" and pair again.")
+				txt.Color = color.NRGBA{R: 200, A: 255}
+				txt.Font.Weight = font.Bold
+				txt.Alignment = text.Middle
+				return txt.Layout(gtx)
+			},
+		),
 		layout.Rigid(
 			// The height of the spacer is 25 Device independent pixels
 			layout.Spacer{Height: unit.Dp(25)}.Layout,
@@ -183,8 +247,11 @@ func drawLayout(gtx C, th *material.Theme) D {
 				for connectButton.Clicked(gtx) {
 					if isConnected && isAuthed {
 						l.Info("disconnecting")
+						if session != nil {
+							session.Close()
+						}
 						if c != nil {
-							c.Disconnect()
+							c.Disconnect(context.Background())
 						}
 						isConnected = false
 						isAuthed = false
@@ -208,6 +275,25 @@ func drawLayout(gtx C, th *material.Theme) D {
 				})
 			},
 		),
+		layout.Rigid(
+			func(gtx C) D {
+				// Alerts are only accepted from authenticated clients.
+				if !isAuthed || !isConnected {
+					return D{}
+				}
+				for findButton.Clicked(gtx) {
+					go func() {
+						if err := c.Alert(transport.AlertHigh); err != nil {
+							l.Error("failed to alert bottle", "error", err)
+						}
+					}()
+				}
+				inset := layout.Inset{Left: unit.Dp(200), Right: unit.Dp(200), Top: unit.Dp(10)}
+				return inset.Layout(gtx, func(gtx C) D {
+					return material.Button(th, findButton, "Find my bottle").Layout(gtx)
+				})
+			},
+		),
 		layout.Rigid(
 			// The height of the spacer is 25 Device independent pixels
 			layout.Spacer{Height: unit.Dp(25)}.Layout,
@@ -267,61 +353,128 @@ func authBleClient() {
 		}
 	}
 	l.Debug("writing auth token", "pin", fmt.Sprintf("%+v", authKeyBuf.Bytes()))
-	aesKey, err := c.Auth(authKeyBuf.Bytes())
+	sess, err := c.NewSession(context.Background(), authKeyBuf.Bytes())
 	if err != nil {
 		l.Error("auth error", "error", err)
+		identityChanged = errors.Is(err, client.ErrIdentityMismatch)
+		return
 	}
-	gcm, err = crypto.NewGCM(aesKey)
-	if err != nil {
-		l.Error("failed to instantiate gcm cipher", "error", err)
+	identityChanged = false
+	if session != nil {
+		session.Close()
 	}
+	session = sess
 	isAuthed = true
+
+	// Only catch up on readings missed since this session's last one; older readings have already been posted by a previous run.
+	if lastSeq != 0 {
+		l.Debug("requesting buffered readings", "since", lastSeq)
+		if err := sess.Sync(lastSeq); err != nil {
+			l.Error("failed to request buffered readings", "error", err)
+		}
+	}
+	go receiveReadings(sess)
 }
 
 func setupBleClient() {
-	c = ble.NewClient(
-		client.WithLogger(l),
-	)
-	if err := c.Init(); err != nil {
-		l.Error("error while setting up ble client", "error", err)
-		return
+	opts := []client.ClientOption{client.WithLogger(l)}
+	// Remembering paired bottles spares entering the pin again after restarting.
+	if bonds, err := bond.OpenDefault(); err != nil {
+		l.Error("failed to open bond store", "error", err)
+	} else {
+		opts = append(opts, client.WithBonds(bonds))
+	}
+	if *serialPath != "" {
+		opts = append(opts, client.WithSerial(*serialPath))
+	}
+	if *bridgeAddress != "" {
+		opts = append(opts, client.WithBridge(link.SplitAddress(*bridgeAddress)))
+	}
+	c = ble.NewClient(opts...)
+	// Keep looking until the bottle is switched on or comes into range.
+	for {
+		err := c.Init(context.Background())
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, client.ErrNoDeviceFound) {
+			l.Error("error while setting up ble client", "error", err)
+			return
+		}
+		l.Info("no bottle found, scanning again")
 	}
 
-	buf := [4]byte{}
-	isConnected = true
-	for msg := range c.Queue() {
-		l.Debug("received message", "msg", msg)
-		if gcm == nil {
-			l.Debug("gcm is nil, skipping decryption")
-			continue
+	if b, ok := c.Bond(); ok {
+		l.Info("found paired bottle, authenticating", "id", b.ID)
+		calibration = b.Calibration
+		authKeyBuf.Reset()
+		authKeyBuf.Write(b.Pin)
+		go authBleClient()
+	}
+
+	go func() {
+		for level := range c.Battery() {
+			batteryLevel = int(level)
 		}
+	}()
 
-		err := crypto.DecryptAES(gcm, msg.Value, buf[:])
+	go func() {
+		for e := range c.Events() {
+			isConnected = e.State == client.StateConnected
+			// The session requests readings missed while disconnected on its own.
+			reconnecting = e.State == client.StateReconnecting
+			if errors.Is(e.Err, client.ErrIdentityMismatch) {
+				identityChanged = true
+			}
+		}
+	}()
+
+	go func() {
+		err := c.MonitorProximity(proximity.New(), func(e proximity.Event) {
+			leftBehind = e.State == proximity.StateOutOfRange
+		})
 		if err != nil {
-			l.Error("failed to decrypt", "error", err)
+			l.Error("failed to monitor bottle proximity", "error", err)
+		}
+	}()
+
+	isConnected = true
+}
+
+// receiveReadings posts the readings of the given session until it is closed.
+func receiveReadings(sess *client.Session) {
+	for {
+		var r client.Reading
+		select {
+		case err := <-sess.Errors():
+			l.Error("discarded reading", "error", err)
+			continue
+		case reading, ok := <-sess.Readings():
+			if !ok {
+				return
+			}
+			r = reading
+		}
+		if r.Seq > lastSeq {
+			lastSeq = r.Seq
+		}
+		l.Debug("received reading", "historic", r.Historic, "seq", r.Seq, "fillLevel", r.Value)
+		if !r.Historic {
+			currentFillPercentage = calibration.FillRatio(r.Value)
+			currentFillLevel = r.Value
 		}
-		d := math.Float32frombits(binary.LittleEndian.Uint32(buf[:]))
-		l.Debug("decrypted message", "msg", fmt.Sprintf("%+v", buf), "fillLevel", d)
-		currentFillPercentage = getFillRatioFromDepth(d)
-		currentFillLevel = d
 
 		l.Debug("posting new reading to api")
-		reading := Reading{Timestamp: time.Now(), Value: float64(currentFillLevel)}
-		err = PostReading(reading)
+		// Prefer the capture time, falling back to the time of arrival for readings captured before the bottle's clock was set.
+		ts := r.Time()
+		if !r.HasTime() {
+			ts = time.Now()
+		}
+		reading := Reading{Timestamp: ts, Value: float64(r.Value)}
+		err := PostReading(reading)
 		readings.Data = append(readings.Data, reading)
 		if err != nil {
 			l.Error("failed to post reading", "error", err)
 		}
 	}
 }
-
-func getFillRatioFromDepth(d float32) float32 {
-	if d >= bottleDepthMax {
-		return 0
-	}
-	if d <= bottleDepthMin {
-		return 1
-	}
-	// For the sake of simplicity we assume a linear relationship, that is that the bottle is a perfect cylinder
-	return (bottleDepthMax - d) / (bottleDepthMax - bottleDepthMin)
-}
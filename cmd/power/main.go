@@ -0,0 +1,29 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/toalaah/smart-bottle/pkg/power"
+)
+
+var (
+	config = power.DefaultConfig
+	budget = power.DefaultBudget
+)
+
+func main() {
+	flag.DurationVar(&config.SampleInterval, "sample", config.SampleInterval, "interval between two depth readings")
+	flag.DurationVar(&config.SensorWarmup, "warmup", config.SensorWarmup, "time the sensor needs to warm up")
+	flag.DurationVar(&config.SlowAdvertisementInterval, "adv", config.SlowAdvertisementInterval, "advertisement interval while idle")
+	flag.Float64Var(&budget.Capacity, "capacity", budget.Capacity, "battery capacity in mAh")
+	flag.Float64Var(&budget.ConnectedRatio, "connected", budget.ConnectedRatio, "fraction of time a client is connected")
+	flag.Parse()
+
+	e := budget.Estimate(config)
+	fmt.Printf("sample interval:   %s\n", config.SampleInterval)
+	fmt.Printf("sensor duty cycle: %.2f%%\n", e.DutyCycle*100)
+	fmt.Printf("average current:   %.3f mA\n", e.AverageCurrent)
+	fmt.Printf("battery life:      %s (%.1f days)\n", e.Lifetime.Round(time.Minute), e.Lifetime.Hours()/24)
+}
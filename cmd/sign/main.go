@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/toalaah/smart-bottle/pkg/ota"
+)
+
+var l = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+const usage = `usage: sign [-key path] [-out path] <image>
+
+Signs a firmware image for bottles built with the matching public key, writing the header the client pushes along with the image, see the client's ota command. The private key is only ever read by this tool, keep it offline and away from machines merely updating bottles.
+
+flags:
+  -key path    read the PEM encoded Ed25519 private key from path (default pkg/build/secrets/firmware-private.pem)
+  -out path    write the header to path (default <image>.sig)
+`
+
+func main() {
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	keyPath := flag.String("key", "pkg/build/secrets/firmware-private.pem", "")
+	out := flag.String("out", "", "")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	path := flag.Arg(0)
+	if *out == "" {
+		*out = path + ".sig"
+	}
+
+	key, err := loadKey(*keyPath)
+	must("load signing key", err)
+	image, err := os.ReadFile(path)
+	must("read firmware image", err)
+	h := ota.NewHeader(image, key)
+	must("write header", os.WriteFile(*out, h.MarshalBytes(), 0o644))
+	l.Info("signed firmware image", "path", path, "size", h.Size, "hash", fmt.Sprintf("%x", h.Hash), "header", *out)
+}
+
+// loadKey reads a PEM encoded Ed25519 private key as written by openssl, see gen25519.sh.
+func loadKey(path string) (ed25519.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if k, ok := key.(ed25519.PrivateKey); ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("expected Ed25519 key, got %T", key)
+}
+
+func must(action string, err error) {
+	if err != nil {
+		panic("failed to " + action + ": " + err.Error())
+	}
+}
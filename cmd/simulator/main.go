@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/toalaah/smart-bottle/pkg/ble/schema"
+	"github.com/toalaah/smart-bottle/pkg/ble/service"
+	"github.com/toalaah/smart-bottle/pkg/build"
+	"github.com/toalaah/smart-bottle/pkg/build/secrets"
+	"github.com/toalaah/smart-bottle/pkg/crypto"
+	"github.com/toalaah/smart-bottle/pkg/history"
+	"github.com/toalaah/smart-bottle/pkg/link"
+	"github.com/toalaah/smart-bottle/pkg/transport"
+)
+
+var (
+	l = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	deviceID = transport.DeviceID{0x51, 0x3d, 0x00, 0x01}
+	nonce    [build.NonceLen]byte
+
+	// Readings are captured regardless of whether a client is connected, guarded by mu along with the current session and nonce.
+	mu       sync.Mutex
+	readings = history.New(history.WithCapacity(1024))
+	srv      *link.Server
+	gcm      cipher.AEAD
+)
+
+const usage = `usage: simulator [-listen address] [-interval duration]
+
+Simulates a bottle without any hardware, serving the bottle protocol to clients connecting via their -bridge flag. It authenticates clients with the pairing pin and keys of this build and notifies a reading of a slowly emptying bottle at the given interval, buffering readings for clients to sync while disconnected. Serves one client at a time.
+
+flags:
+  -listen address      listen on the given TCP address, or Unix socket if prefixed with unix: (default localhost:7107)
+  -interval duration   capture a reading at the given interval (default 5s)
+`
+
+func main() {
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	listen := flag.String("listen", "localhost:7107", "")
+	interval := flag.Duration("interval", 5*time.Second, "")
+	flag.Parse()
+
+	_, err := rand.Read(nonce[:])
+	must("generate nonce", err)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	ln, err := net.Listen(link.SplitAddress(*listen))
+	must("listen", err)
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	go capture(ctx, *interval)
+	l.Info("simulating bottle", "id", deviceID, "address", ln.Addr())
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			must("accept client", err)
+		}
+		l.Info("client connected", "remote", conn.RemoteAddr())
+		if err := serve(conn); err != nil && !errors.Is(err, io.EOF) {
+			l.Error("stopped serving client", "remote", conn.RemoteAddr(), "error", err)
+		} else {
+			l.Info("client disconnected", "remote", conn.RemoteAddr())
+		}
+		conn.Close()
+	}
+}
+
+// serve serves the characteristics of the simulated bottle over rw until the client disconnects.
+func serve(rw io.ReadWriter) error {
+	caps := transport.Capabilities{
+		Version:    transport.ProtocolVersion,
+		MinVersion: transport.MinProtocolVersion,
+		Features:   transport.FeatureAuth | transport.FeatureCommands | transport.FeatureBatching,
+		Formats:    transport.FormatReadingV1,
+	}
+	mu.Lock()
+	nonceValue, err := service.NonceValue(nonce[:])
+	mu.Unlock()
+	if err != nil {
+		return err
+	}
+	s := link.NewServer(rw, []link.Characteristic{
+		{UUID: schema.ManufacturerName.UUID, Value: []byte(build.ServiceName)},
+		{UUID: schema.FirmwareRevision.UUID, Value: []byte(build.ServiceVersion + "-simulator")},
+		{UUID: schema.ModelNumber.UUID, Value: []byte(build.ModelNumber)},
+		{UUID: schema.HardwareRevision.UUID, Value: []byte("simulator")},
+		{UUID: schema.SerialNumber.UUID, Value: []byte(deviceID.String())},
+		{UUID: schema.FillLevel.UUID},
+		{UUID: schema.Command.UUID, OnWrite: handleCommand},
+		{UUID: schema.Diagnostics.UUID},
+		{UUID: schema.Log.UUID},
+		{UUID: schema.Capabilities.UUID, Value: caps.MarshalBytes()},
+		{UUID: schema.Nonce.UUID, Value: nonceValue},
+		{UUID: schema.Auth.UUID, OnWrite: handleAuth},
+		{UUID: schema.Identity.UUID, Value: secrets.BottlePublicKey},
+		// Readings are timestamped using the host's clock, which needs no setting.
+		{UUID: schema.CurrentTime.UUID, OnWrite: func(value []byte) {}},
+	}, func() {
+		// Every session over the link starts unauthenticated, as on the bottle.
+		mu.Lock()
+		gcm = nil
+		mu.Unlock()
+	})
+	mu.Lock()
+	srv, gcm = s, nil
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		srv, gcm = nil, nil
+		mu.Unlock()
+	}()
+	return s.Serve()
+}
+
+// handleAuth checks a handshake as the bottle does, starting a session if it succeeds. As on the bottle, every nonce is good for a single attempt.
+func handleAuth(value []byte) {
+	mu.Lock()
+	defer mu.Unlock()
+	status := transport.AuthSucceeded
+	key, err := service.AcceptHandshake(nonce[:], value)
+	if err != nil {
+		l.Warn("auth failed", "error", err)
+		status, key = transport.AuthFailed, nil
+	}
+	gcm = nil
+	if err := rotateNonce(); err != nil {
+		l.Error("failed to rotate nonce", "error", err)
+	}
+	if status == transport.AuthSucceeded {
+		if gcm, err = crypto.NewGCM(key); err != nil {
+			l.Error("failed to create session cipher", "error", err)
+			status, key = transport.AuthFailed, nil
+		} else {
+			l.Info("client authenticated")
+		}
+	}
+	v, err := service.AuthConfirmation(status, key)
+	if err != nil {
+		l.Error("failed to confirm auth", "error", err)
+		return
+	}
+	// Notifying from within a write handler is fine, as the server does not hold its lock while calling it.
+	if err := srv.Notify(schema.Auth.UUID, v); err != nil {
+		l.Error("failed to confirm auth", "error", err)
+	}
+}
+
+// rotateNonce draws a new nonce and publishes it to the client. Callers must hold mu.
+func rotateNonce() error {
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+	v, err := service.NonceValue(nonce[:])
+	if err != nil {
+		return err
+	}
+	return srv.Notify(schema.Nonce.UUID, v)
+}
+
+// handleCommand decrypts and handles a command of an authenticated client. Only syncing is simulated, other commands are acknowledged in the log only.
+func handleCommand(value []byte) {
+	mu.Lock()
+	defer mu.Unlock()
+	if gcm == nil {
+		l.Warn("dropping command of unauthenticated client")
+		return
+	}
+	msg := transport.Message{}
+	if err := transport.UnmarshalBytes(&msg, append([]byte{}, value...)); err != nil || msg.Type != transport.Control {
+		l.Warn("received malformed command")
+		return
+	}
+	n := len(msg.Value) - gcm.NonceSize() - gcm.Overhead()
+	if n < 1 {
+		l.Warn("received malformed command")
+		return
+	}
+	buf := make([]byte, n)
+	if err := crypto.DecryptAES(gcm, msg.Value, buf); err != nil {
+		l.Warn("failed to decrypt command", "error", err)
+		return
+	}
+	cmd := transport.Command{}
+	if err := transport.UnmarshalCommand(&cmd, buf); err != nil {
+		l.Warn("received malformed command", "error", err)
+		return
+	}
+	l.Info("received command", "code", cmd.Code)
+	if cmd.Code != transport.CommandSync {
+		return
+	}
+	since, err := cmd.SyncSince()
+	if err != nil {
+		l.Warn("received malformed sync command", "error", err)
+		return
+	}
+	err = readings.Since(since, func(r transport.Reading) error {
+		return publish(transport.History, &r)
+	})
+	if err != nil {
+		l.Error("failed to replay readings", "error", err)
+	}
+}
+
+// capture appends a reading of a bottle which is slowly emptied and refilled every hour at the given interval, publishing it to an authenticated client.
+func capture(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			// The sensor measures the distance to the water surface, which grows as the bottle is emptied.
+			minute := float64(now.Unix()%3600) / 60
+			depth := float32(20 + 180*minute/60 + 2*math.Sin(minute))
+			mu.Lock()
+			r, err := readings.Append(uint32(now.Unix()), depth)
+			if err == nil {
+				err = publish(transport.WaterLevel, &r)
+			}
+			mu.Unlock()
+			if err != nil {
+				l.Error("failed to publish reading", "error", err)
+			}
+		}
+	}
+}
+
+// publish encrypts a reading and notifies it to the client, if one has authenticated. Callers must hold mu.
+func publish(typ transport.MessageType, r *transport.Reading) error {
+	if gcm == nil {
+		return nil
+	}
+	out := make([]byte, gcm.NonceSize()+transport.ReadingLen+gcm.Overhead())
+	if err := crypto.EncryptAES(gcm, r.MarshalBytes(), out); err != nil {
+		return err
+	}
+	msg := transport.Message{Type: typ}
+	msg.Load(out)
+	return srv.Notify(schema.FillLevel.UUID, msg.MarshalBytes())
+}
+
+func must(action string, err error) {
+	if err != nil {
+		panic("failed to " + action + ": " + err.Error())
+	}
+}
@@ -5,6 +5,7 @@ go 1.24.2
 require (
 	gioui.org v0.8.0
 	golang.org/x/crypto v0.33.0
+	golang.org/x/sys v0.30.0
 	tinygo.org/x/bluetooth v0.11.1-0.20250613143449-33613a1f5a75
 )
 
@@ -23,6 +24,5 @@ require (
 	golang.org/x/exp v0.0.0-20240808152545-0cdaa3abc0fa // indirect
 	golang.org/x/exp/shiny v0.0.0-20240707233637-46b078467d37 // indirect
 	golang.org/x/image v0.24.0 // indirect
-	golang.org/x/sys v0.30.0 // indirect
 	golang.org/x/text v0.22.0 // indirect
 )
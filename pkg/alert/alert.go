@@ -0,0 +1,124 @@
+package alert
+
+import (
+	"log/slog"
+	"machine"
+	"time"
+
+	"github.com/toalaah/smart-bottle/pkg/transport"
+)
+
+// Pin drives a buzzer or LED. It is implemented by machine.Pin.
+type Pin interface {
+	Configure(config machine.PinConfig)
+	High()
+	Low()
+}
+
+// pattern describes how a buzzer or LED is toggled for a given alert level.
+type pattern struct {
+	on, off time.Duration
+	repeat  int
+}
+
+// Alerter plays alert patterns on a buzzer or LED, helping to locate the bottle. Patterns are played in the background, a new alert replaces the one currently playing.
+type Alerter struct {
+	logger   *slog.Logger
+	pin      Pin
+	patterns [3]pattern
+	levels   chan transport.AlertLevel
+}
+
+func New(opts ...AlerterOption) *Alerter {
+	a := &Alerter{
+		logger: nil,
+		pin:    machine.GPIO15,
+		patterns: [3]pattern{
+			transport.AlertMild: {on: 200 * time.Millisecond, off: 800 * time.Millisecond, repeat: 10},
+			transport.AlertHigh: {on: 100 * time.Millisecond, off: 100 * time.Millisecond, repeat: 50},
+		},
+		levels: make(chan transport.AlertLevel, 1),
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+func (a *Alerter) Init() error {
+	a.debug("init alerter", "pin", a.pin)
+	a.pin.Configure(machine.PinConfig{Mode: machine.PinOutput})
+	a.pin.Low()
+	go a.run()
+	return nil
+}
+
+// Alert starts playing the pattern of the given level, or stops the current one for AlertNone. Unknown levels are treated as high alerts.
+func (a *Alerter) Alert(level transport.AlertLevel) {
+	if level > transport.AlertHigh {
+		level = transport.AlertHigh
+	}
+	a.debug("alerting", "level", level)
+	// Only the latest level is of interest, replace any level which has not been played yet.
+	select {
+	case <-a.levels:
+	default:
+	}
+	select {
+	case a.levels <- level:
+	default:
+	}
+}
+
+func (a *Alerter) run() {
+	for level := range a.levels {
+		for level != transport.AlertNone {
+			next, interrupted := a.play(a.patterns[level])
+			if !interrupted {
+				break
+			}
+			level = next
+		}
+	}
+}
+
+// play toggles the pin according to the pattern. It returns early if a new level is requested in the meantime.
+func (a *Alerter) play(p pattern) (transport.AlertLevel, bool) {
+	defer a.pin.Low()
+	for i := 0; i < p.repeat; i++ {
+		a.pin.High()
+		select {
+		case level := <-a.levels:
+			return level, true
+		case <-time.After(p.on):
+		}
+		a.pin.Low()
+		select {
+		case level := <-a.levels:
+			return level, true
+		case <-time.After(p.off):
+		}
+	}
+	return transport.AlertNone, false
+}
+
+func (a *Alerter) debug(msg string, args ...any) {
+	if a.logger != nil {
+		a.logger.Debug(msg, args...)
+	}
+}
+
+type AlerterOption func(*Alerter)
+
+// WithPin sets the pin driving the buzzer or LED.
+func WithPin(p Pin) AlerterOption {
+	return func(a *Alerter) {
+		a.pin = p
+	}
+}
+
+func WithLogger(l *slog.Logger) AlerterOption {
+	return func(a *Alerter) {
+		a.logger = l.With("service", "alert")
+	}
+}
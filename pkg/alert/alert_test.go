@@ -0,0 +1,113 @@
+package alert
+
+import (
+	"machine"
+	"testing"
+	"time"
+
+	"github.com/toalaah/smart-bottle/pkg/transport"
+)
+
+// fakePin records every toggle of the pin.
+type fakePin struct {
+	states chan bool
+}
+
+func (p *fakePin) Configure(config machine.PinConfig) {}
+
+func (p *fakePin) High() {
+	p.states <- true
+}
+
+func (p *fakePin) Low() {
+	p.states <- false
+}
+
+func newTestAlerter(t *testing.T, mild, high pattern) (*Alerter, *fakePin) {
+	p := &fakePin{states: make(chan bool, 256)}
+	a := New(WithPin(p))
+	a.patterns[transport.AlertMild] = mild
+	a.patterns[transport.AlertHigh] = high
+	if err := a.Init(); err != nil {
+		t.Fatal(err)
+	}
+	// Init pulls the pin low.
+	expectState(t, p, false)
+	return a, p
+}
+
+func expectState(t *testing.T, p *fakePin, state bool) {
+	t.Helper()
+	select {
+	case got := <-p.states:
+		if got != state {
+			t.Fatalf("Expected pin state to be '%v', got '%v'", state, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected pin state to be '%v', got none", state)
+	}
+}
+
+// countPulses counts the times the pin is pulled high until it remains untouched for a while, expecting it to end up low.
+func countPulses(t *testing.T, p *fakePin) int {
+	t.Helper()
+	n, last := 0, false
+	for {
+		select {
+		case state := <-p.states:
+			if state {
+				n++
+			}
+			last = state
+		case <-time.After(50 * time.Millisecond):
+			if last {
+				t.Error("Expected pin to be low once done playing")
+			}
+			return n
+		}
+	}
+}
+
+var (
+	blocking = pattern{on: time.Hour, off: time.Hour, repeat: 1}
+	short    = pattern{on: time.Millisecond, off: time.Millisecond, repeat: 3}
+)
+
+func TestAlerterPlay(t *testing.T) {
+	a, p := newTestAlerter(t, pattern{on: time.Millisecond, off: time.Millisecond, repeat: 2}, short)
+	a.Alert(transport.AlertMild)
+	if n := countPulses(t, p); n != 2 {
+		t.Errorf("Expected '%d' pulses, got '%d'", 2, n)
+	}
+}
+
+func TestAlerterReplace(t *testing.T) {
+	a, p := newTestAlerter(t, blocking, short)
+	a.Alert(transport.AlertMild)
+	expectState(t, p, true)
+	a.Alert(transport.AlertHigh)
+	// The mild pattern is interrupted while the pin is high.
+	expectState(t, p, false)
+	if n := countPulses(t, p); n != short.repeat {
+		t.Errorf("Expected '%d' pulses of the replacing pattern, got '%d'", short.repeat, n)
+	}
+}
+
+func TestAlerterStop(t *testing.T) {
+	a, p := newTestAlerter(t, blocking, short)
+	a.Alert(transport.AlertMild)
+	expectState(t, p, true)
+	a.Alert(transport.AlertNone)
+	expectState(t, p, false)
+	if n := countPulses(t, p); n != 0 {
+		t.Errorf("Expected playback to stop, got '%d' pulses", n)
+	}
+}
+
+func TestAlerterUnknownLevel(t *testing.T) {
+	a, p := newTestAlerter(t, pattern{on: time.Millisecond, off: time.Millisecond, repeat: 1}, short)
+	a.Alert(transport.AlertHigh + 1)
+	if n := countPulses(t, p); n != short.repeat {
+		t.Errorf("Expected unknown level to play the high pattern with '%d' pulses, got '%d'", short.repeat, n)
+	}
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"fmt"
+	"sync"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// Adapters only support a single connect handler, which is shared by all clients connected via the same adapter.
+var (
+	clientsMu sync.Mutex
+	clients   = map[*bluetooth.Adapter][]*GattClient{}
+)
+
+// register routes disconnects reported by the client's adapter to the client.
+func register(s *GattClient) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	registered := clients[s.adapter]
+	for _, c := range registered {
+		if c == s {
+			return
+		}
+	}
+	if len(registered) == 0 {
+		adapter := s.adapter
+		adapter.SetConnectHandler(func(device bluetooth.Device, connected bool) {
+			// Not all platforms report disconnects of peripherals, which the liveness probe makes up for.
+			if connected {
+				return
+			}
+			clientsMu.Lock()
+			registered := append([]*GattClient{}, clients[adapter]...)
+			clientsMu.Unlock()
+			for _, c := range registered {
+				if device.Address.String() == c.device.Address.String() {
+					c.handleDisconnect(fmt.Errorf("bottle disconnected"))
+				}
+			}
+		})
+	}
+	clients[s.adapter] = append(registered, s)
+}
+
+// unregister stops dispatching disconnects to the given client, e.g. once it is done relaying.
+func unregister(s *GattClient) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	registered := clients[s.adapter]
+	for i, c := range registered {
+		if c == s {
+			clients[s.adapter] = append(registered[:i:i], registered[i+1:]...)
+			return
+		}
+	}
+}
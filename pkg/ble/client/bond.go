@@ -0,0 +1,68 @@
+package client
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/toalaah/smart-bottle/pkg/bond"
+	"github.com/toalaah/smart-bottle/pkg/build"
+	"github.com/toalaah/smart-bottle/pkg/transport"
+)
+
+// ErrIdentityMismatch is returned by Auth if a paired bottle presents another public key than when it was first paired with, see bond.Store.Verify.
+var ErrIdentityMismatch = bond.ErrIdentityMismatch
+
+// WithBonds records every bottle the client authenticates with in the given store, pinning the public key it presents on first use. Unless restricted to a specific bottle via WithDeviceID or WithAddress, the client then only connects to bottles in the store, falling back to any bottle while the store is empty.
+func WithBonds(store *bond.Store) ClientOption {
+	return func(c *GattClient) {
+		c.bonds = store
+	}
+}
+
+// Bond returns the stored bond with the connected bottle, whose pin can be passed to Auth or NewSession.
+func (s *GattClient) Bond() (bond.Bond, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.bond()
+}
+
+func (s *GattClient) bond() (bond.Bond, bool) {
+	if s.bonds == nil {
+		return bond.Bond{}, false
+	}
+	return s.bonds.Get(s.deviceID)
+}
+
+// bonded reports whether the client may connect to the bottle with the given ID as far as its bonds are concerned.
+func (s *GattClient) bonded(id transport.DeviceID) bool {
+	if s.bonds == nil || s.bonds.Len() == 0 {
+		return true
+	}
+	_, ok := s.bonds.Get(id)
+	return ok
+}
+
+// remember records the bond with the connected bottle after authenticating. The calibration and pairing time of an existing bond are kept.
+func (s *GattClient) remember(pin []byte) {
+	if s.bonds == nil {
+		return
+	}
+	address := s.device.Address.String()
+	if s.link != nil {
+		address = s.linkAddress
+	}
+	b, ok := s.bonds.Get(s.deviceID)
+	if ok && b.Address == address && bytes.Equal(b.Pin, pin) && bytes.Equal(b.PublicKey, s.identity) {
+		return
+	}
+	if !ok {
+		b = bond.Bond{ID: s.deviceID, Calibration: build.DefaultCalibration, PairedAt: time.Now()}
+	}
+	b.Address = address
+	b.Pin = append([]byte{}, pin...)
+	b.PublicKey = append([]byte{}, s.identity...)
+	s.debug("storing bond", "id", b.ID, "address", address)
+	if err := s.bonds.Put(b); err != nil {
+		s.debug("failed to store bond", "error", err)
+	}
+}
@@ -0,0 +1,80 @@
+package client
+
+import (
+	"github.com/toalaah/smart-bottle/pkg/crypto"
+	"github.com/toalaah/smart-bottle/pkg/transport"
+	"tinygo.org/x/bluetooth"
+)
+
+// BroadcastKey returns the key used by the bottle to encrypt broadcast advertisements. It is only valid after authenticating and remains so until the bottle is paired with again, or reboots.
+func (s *GattClient) BroadcastKey() ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if err := s.require(transport.FeatureBroadcast); err != nil {
+		return nil, err
+	}
+	return crypto.DeriveKey(s.key, crypto.BroadcastKeyLabel)
+}
+
+// AddBroadcastKey registers the broadcast key of a paired bottle, allowing ScanBroadcasts to decode its advertisements.
+func (s *GattClient) AddBroadcastKey(key []byte) error {
+	c, err := crypto.NewBroadcastCipher(key)
+	if err != nil {
+		return err
+	}
+	s.broadcastCiphers = append(s.broadcastCiphers, c)
+	return nil
+}
+
+// ScanBroadcasts passively scans for broadcast advertisements of paired bottles in range, honoring the client's target filters, calling fn for every newly received broadcast. It blocks until StopScan is called.
+func (s *GattClient) ScanBroadcasts(fn func(address bluetooth.Address, b transport.Broadcast)) error {
+	s.debug("enabling adapter")
+	if err := s.adapter.Enable(); err != nil {
+		return err
+	}
+	// Counters are tracked per address in order to reject replayed advertisements.
+	counters := map[bluetooth.Address]uint32{}
+	s.debug("scanning for broadcasts...")
+	return s.adapter.Scan(func(adapter *bluetooth.Adapter, result bluetooth.ScanResult) {
+		for _, d := range result.ManufacturerData() {
+			if _, ok := s.matches(result.Address, d); !ok {
+				continue
+			}
+			_, typ, frame, _ := transport.UnmarshalManufacturerData(d.Data)
+			if typ != transport.AdvertisementBroadcast {
+				continue
+			}
+			for _, c := range s.broadcastCiphers {
+				counter, plaintext, err := c.Open(frame)
+				if err != nil {
+					continue
+				}
+				if last, ok := counters[result.Address]; ok && counter <= last {
+					break
+				}
+				counters[result.Address] = counter
+				b := transport.Broadcast{}
+				if err := transport.UnmarshalBroadcast(&b, plaintext); err != nil {
+					s.debug("received malformed broadcast", "address", result.Address.String(), "error", err)
+					break
+				}
+				s.debug("received broadcast", "address", result.Address.String(), "rssi", result.RSSI, "counter", counter)
+				fn(result.Address, b)
+				break
+			}
+		}
+	})
+}
+
+func (s *GattClient) StopScan() error {
+	return s.adapter.StopScan()
+}
+
+// WithBroadcastKey registers the broadcast key of a previously paired bottle, see AddBroadcastKey.
+func WithBroadcastKey(key []byte) ClientOption {
+	return func(c *GattClient) {
+		if err := c.AddBroadcastKey(key); err != nil {
+			c.debug("failed to add broadcast key", "error", err)
+		}
+	}
+}
@@ -1,168 +1,832 @@
 package client
 
 import (
+	"context"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/toalaah/smart-bottle/pkg/ble/schema"
+	"github.com/toalaah/smart-bottle/pkg/bond"
 	"github.com/toalaah/smart-bottle/pkg/build"
 	"github.com/toalaah/smart-bottle/pkg/build/secrets"
 	"github.com/toalaah/smart-bottle/pkg/crypto"
+	"github.com/toalaah/smart-bottle/pkg/link"
+	"github.com/toalaah/smart-bottle/pkg/ota"
 	"github.com/toalaah/smart-bottle/pkg/transport"
 	"tinygo.org/x/bluetooth"
 )
 
+var (
+	ErrNoDeviceFound = errors.New("no matching bottle found")
+	// ErrServiceMissing is returned if the bottle lacks a service or characteristic required by the schema.
+	ErrServiceMissing = errors.New("bottle is missing a required service")
+	ErrAuthTimeout    = errors.New("bottle did not confirm authentication in time")
+	ErrAuthFailed     = errors.New("bottle rejected authentication")
+)
+
+const (
+	// DefaultScanTimeout bounds scanning for a bottle unless the context passed to Init has a deadline.
+	DefaultScanTimeout = 30 * time.Second
+	// DefaultTimeout bounds connecting, discovery, authentication and disconnecting unless the context passed has a deadline.
+	DefaultTimeout = 10 * time.Second
+)
+
+// characteristic is the subset of bluetooth.DeviceCharacteristic used by the client, allowing bottles to be reached over links other than Bluetooth, see package link.
+type characteristic interface {
+	UUID() bluetooth.UUID
+	Read(p []byte) (int, error)
+	WriteWithoutResponse(p []byte) (int, error)
+	EnableNotifications(fn func(p []byte)) error
+	GetMTU() (uint16, error)
+}
+
 type GattClient struct {
 	adapter *bluetooth.Adapter
 	logger  *slog.Logger
 	c       chan transport.Message
+	errors  chan error
+	battery chan uint8
+	logs    chan transport.Message
+
+	// Delivery of notifications, see delivery.go.
+	queueSize int
+	policy    OverflowPolicy
+	counters  deliveryCounters
 
-	rxChar, authChar *bluetooth.DeviceCharacteristic
+	// mu guards the state of the current connection, i.e. the device or link, the discovered characteristics, the bottle's capabilities, identity and session key, as well as onConnectionChange, all of which reconnecting replaces while other goroutines use the client. Exported methods take it, unexported ones expect their caller to hold it, so exported methods must not call each other.
+	mu sync.RWMutex
+
+	rxChar, authChar characteristic
+	capChar          characteristic
+	cmdChar          characteristic
+	diagChar         characteristic
+	logChar          characteristic
+	alertChar        characteristic
+	timeChar         characteristic
+	firmware         *firmwareTarget
 	device           bluetooth.Device
-	authNonce        [build.NonceLen]byte
+	nonceChar        characteristic
+	identity         []byte
+	authStatus       chan []byte
+	key              []byte
+	scanTimeout      time.Duration
+	timeout          time.Duration
+	capabilities     transport.Capabilities
+
+	// Set if the bottle is reached over a link rather than Bluetooth, see link.go.
+	link        *link.Conn
+	linkAddress string
+	dial        func(ctx context.Context) (io.ReadWriteCloser, error)
+
+	broadcastCiphers []*crypto.BroadcastCipher
+
+	// Optional filters restricting which bottle to connect to.
+	targetID      *transport.DeviceID
+	targetAddress string
+	deviceID      transport.DeviceID
+	bonds         *bond.Store
+
+	// Reconnection state, see reconnect.go.
+	events                 chan ConnectionEvent
+	reconnect              bool
+	backoffMin, backoffMax time.Duration
+	connected, closing     atomic.Bool
+	pin                    []byte
+	onConnectionChange     func(connected bool)
+
+	// The session opened after authenticating, if any, see session.go.
+	session atomic.Pointer[Session]
 }
 
 func New(opts ...ClientOption) *GattClient {
 	s := &GattClient{
 		adapter: bluetooth.DefaultAdapter,
-		c:       make(chan transport.Message),
+		battery: make(chan uint8, 1),
+		logs:    make(chan transport.Message, 16),
+		events:  make(chan ConnectionEvent, 8),
+		errors:  make(chan error, 8),
+
+		queueSize: 64,
+		policy:    DropOldest,
+
+		authStatus:  make(chan []byte, 1),
+		scanTimeout: DefaultScanTimeout,
+		timeout:     DefaultTimeout,
+
+		reconnect:  true,
+		backoffMin: time.Second,
+		backoffMax: 30 * time.Second,
 	}
 	for _, opt := range opts {
 		opt(s)
 	}
+	s.c = make(chan transport.Message, s.queueSize)
 	return s
 }
 
-func (s *GattClient) Init() error {
-	s.debug("enabling adapter")
-	if err := s.adapter.Enable(); err != nil {
-		return err
+// Init scans for a bottle matching the client's target filters and connects to the first one found, see Scan and Connect. Scanning stops once ctx is canceled, returning ErrNoDeviceFound. Clients configured to reach the bottle over a link connect to it directly.
+func (s *GattClient) Init(ctx context.Context) error {
+	if s.dial != nil {
+		return s.connectLink(ctx)
 	}
-
-	s.debug("scanning...")
-	devices := make(chan bluetooth.ScanResult, 1)
-	err := s.adapter.Scan(func(adapter *bluetooth.Adapter, result bluetooth.ScanResult) {
-		if result.LocalName() == "" {
-			return
-		}
-		s.debug("found device", "name", result.LocalName())
-		d := result.ManufacturerData()
-		if result.LocalName() == build.ServiceName && len(d) > 0 && d[0].CompanyID == build.ManufacturerUUID {
-			s.debug("device has matching manufacturer UUID", "name", result.LocalName(), "manufacturerData", d[0].CompanyID)
-			devices <- result
-			adapter.StopScan()
-		}
-	})
+	address, err := s.find(ctx)
 	if err != nil {
 		return err
 	}
+	return s.Connect(ctx, address)
+}
 
-	result := <-devices
-	s.debug("connecting to device", "address", s.device.Address.String())
-	s.device, err = s.adapter.Connect(result.Address, bluetooth.ConnectionParams{})
+// find scans for the first bottle matching the client's target filters, returning its address.
+func (s *GattClient) find(ctx context.Context) (bluetooth.Address, error) {
+	scanCtx, cancel := withTimeout(ctx, s.scanTimeout)
+	defer cancel()
+	bottles, err := s.Scan(scanCtx, 0)
 	if err != nil {
-		return err
+		return bluetooth.Address{}, err
 	}
+	b, ok := <-bottles
+	cancel()
+	for range bottles {
+	}
+	if !ok {
+		return bluetooth.Address{}, fmt.Errorf("%w: %w", ErrNoDeviceFound, scanCtx.Err())
+	}
+	s.mu.Lock()
+	s.deviceID = b.ID
+	s.mu.Unlock()
+	return b.Address, nil
+}
 
-	serviceIDs := []bluetooth.UUID{build.ServiceUUID}
-	s.debug("scanning for matching service", "device", s.device, "serviceIDs", serviceIDs)
-	svcs, err := s.device.DiscoverServices(serviceIDs)
-	if err != nil {
+// Connect connects to the bottle with the given address, which must have been discovered by a previous scan, and discovers its services.
+func (s *GattClient) Connect(ctx context.Context, address bluetooth.Address) error {
+	s.debug("enabling adapter")
+	if err := s.adapter.Enable(); err != nil {
+		return err
+	}
+	s.debug("connecting to device", "address", address.String())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	if s.device, err = s.connect(ctx, address); err != nil {
 		return err
 	}
-	if len(svcs) == 0 {
-		return fmt.Errorf("could not find matching service")
+	if err := s.setup(ctx); err != nil {
+		s.device.Disconnect()
+		return err
 	}
+	s.debug("connected to device", "address", address.String(), "id", s.deviceID)
+	s.connected.Store(true)
+	s.emit(ConnectionEvent{State: StateConnected})
 
-	svc := svcs[0]
-	s.debug("found service", "service", svc)
-	s.debug("discovering service characteristics", "id", svc.UUID().String())
-	characteristicIDs := []bluetooth.UUID{build.CharacteristicUUIDFillLevel, build.CharacteristicUUIDAuth, build.CharacteristicUUIDNonce}
-	s.debug("scanning for matching characteristics", "service", svc.UUID().String(), "characteristicIDs", characteristicIDs)
+	register(s)
+	go s.probe(livenessInterval)
+	return nil
+}
 
-	chars, err := svc.DiscoverCharacteristics(characteristicIDs)
+// setup discovers the services of the connected bottle, reads its capabilities and auth nonce and enables notifications. It runs on every (re)connect.
+func (s *GattClient) setup(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var (
+		services map[*schema.Service]map[bluetooth.UUID]characteristic
+		err      error
+	)
+	if s.link != nil {
+		services, err = s.discoverLink()
+	} else {
+		services, err = s.discoverServices(ctx)
+	}
 	if err != nil {
 		return err
 	}
-	if len(chars) == 0 {
-		return fmt.Errorf("could not find characteristic")
-	}
 
-	for _, char := range chars {
-		switch char.UUID() {
-		case build.CharacteristicUUIDFillLevel:
-			s.debug("found fill level characteristic", "characteristicID", char.UUID().String())
-			s.rxChar = &char
-		case build.CharacteristicUUIDAuth:
-			s.debug("found auth characteristic", "characteristicID", char.UUID().String())
-			s.authChar = &char
-		case build.CharacteristicUUIDNonce:
-			s.debug("found auth nonce", "characteristicID", char.UUID().String())
-			encNonce := make([]byte, 256)
-			msg := transport.Message{}
-			if n, err := char.Read(encNonce); err != nil {
-				return err
+	var main map[bluetooth.UUID]characteristic
+	for _, decl := range schema.Services {
+		chars, ok := services[decl]
+		if !ok {
+			continue
+		}
+		switch decl {
+		case schema.DeviceInformation:
+			// The serial number doubles as the device ID, which is not known yet if connecting without scanning first.
+			if id, err := readDeviceID(lookup(chars, schema.SerialNumber)); err != nil {
+				s.debug("failed to read serial number", "error", err)
 			} else {
-				encNonce = encNonce[:n]
-			}
-			s.debug("read auth nonce", "value", fmt.Sprintf("%+v", encNonce))
-			if err := transport.UnmarshalBytes(&msg, encNonce); err != nil {
-				return err
+				s.deviceID = id
 			}
-			decNonce, err := crypto.DecryptEphemeralStaticX25519(msg.Value, secrets.UserPrivateKey)
-			if err != nil {
-				return err
+		case schema.Main:
+			main = chars
+		case schema.CurrentTimeService:
+			s.timeChar = lookup(chars, schema.CurrentTime)
+		case schema.Firmware:
+			s.firmware = &firmwareTarget{control: chars[schema.OTAControl.UUID], data: chars[schema.OTAData.UUID], status: chars[schema.OTAStatus.UUID]}
+		case schema.ImmediateAlert:
+			s.alertChar = lookup(chars, schema.AlertLevel)
+		case schema.Battery:
+			// The battery service is optional, failing to subscribe to it should not prevent receiving readings.
+			if err := s.subscribeBattery(chars[schema.BatteryLevel.UUID]); err != nil {
+				s.debug("failed to subscribe to battery service", "error", err)
 			}
-			s.debug("decrypted nonce", "value", fmt.Sprintf("%+v", decNonce))
-			copy(s.authNonce[:], decNonce[0:build.NonceLen])
 		}
 	}
+	if main == nil {
+		return fmt.Errorf("%w: %s", ErrServiceMissing, schema.Main.Name)
+	}
 
-	if s.rxChar == nil || s.authChar == nil {
-		return fmt.Errorf("could not discover all required characteristics")
+	// Bail out before touching anything else, as an incompatible bottle may not behave as declared by the schema.
+	s.capChar = lookup(main, schema.Capabilities)
+	if err := s.readCapabilities(s.capChar); err != nil {
+		return err
 	}
 
-	s.rxChar.EnableNotifications(func(p []byte) {
-		msg := transport.Message{}
-		if err := transport.UnmarshalBytes(&msg, p); err != nil {
-			panic(err)
+	s.rxChar = lookup(main, schema.FillLevel)
+	if s.rxChar == nil {
+		return fmt.Errorf("%w: %s", ErrServiceMissing, schema.FillLevel.Name)
+	}
+	s.cmdChar = lookup(main, schema.Command)
+	s.diagChar = lookup(main, schema.Diagnostics)
+	s.logChar = lookup(main, schema.Log)
+	// Bottles built without authentication expose neither the nonce nor the auth characteristic.
+	s.authChar = lookup(main, schema.Auth)
+	s.nonceChar = lookup(main, schema.Nonce)
+	if s.capabilities.Features.Has(transport.FeatureAuth) && (s.authChar == nil || s.nonceChar == nil) {
+		return fmt.Errorf("%w: bottle requires authentication, but does not expose the %s and %s characteristics", ErrServiceMissing, schema.Auth.Name, schema.Nonce.Name)
+	}
+	if s.authChar != nil && s.capabilities.Version >= transport.AuthConfirmationVersion {
+		err := s.authChar.EnableNotifications(func(p []byte) {
+			if len(p) < 1 {
+				return
+			}
+			select {
+			case s.authStatus <- append([]byte{}, p...):
+			default:
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// Bottles predating identity pinning are assumed to hold the key the client was built with.
+	s.identity = secrets.BottlePublicKey
+	if char := lookup(main, schema.Identity); char != nil {
+		buf := make([]byte, 64)
+		n, err := char.Read(buf)
+		if err != nil {
+			return err
+		}
+		if n != schema.Identity.Size {
+			return fmt.Errorf("expected identity of length %d, got %d", schema.Identity.Size, n)
+		}
+		s.identity = buf[:n]
+	}
+
+	err = s.rxChar.EnableNotifications(func(p []byte) {
+		if msg, ok := s.parseFrame(p); ok {
+			s.deliver(msg)
 		}
-		s.c <- msg
 	})
+	if err != nil {
+		return fmt.Errorf("enabling %s notifications: %w", schema.FillLevel.Name, err)
+	}
+
+	if s.logChar != nil {
+		err := s.logChar.EnableNotifications(func(p []byte) {
+			msg, ok := s.parseFrame(p)
+			if !ok {
+				return
+			}
+			// Never block the stack on a slow consumer, missing lines are detected by their sequence numbers.
+			select {
+			case s.logs <- msg:
+			default:
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("enabling %s notifications: %w", schema.Log.Name, err)
+		}
+	}
 
 	return nil
 }
 
-// Auth takes a static, preshared pairing pin and writes it to the bottle's auth characteristic in order to initiate readings. The pin is appended to a nonce value in order to prevent replay attacks.
-func (s *GattClient) Auth(pin []byte) ([]byte, error) {
-	v := s.authNonce[:]
+// readNonce reads and decrypts the nonce for the next handshake. The bottle draws a new one after every handshake, so it is read anew for every attempt.
+func (s *GattClient) readNonce() ([]byte, error) {
+	encNonce := make([]byte, 256)
+	n, err := s.nonceChar.Read(encNonce)
+	if err != nil {
+		return nil, err
+	}
+	s.debug("read auth nonce", "value", fmt.Sprintf("%+v", encNonce[:n]))
+	msg := transport.Message{}
+	if err := transport.UnmarshalBytes(&msg, encNonce[:n]); err != nil {
+		return nil, err
+	}
+	nonce, err := crypto.DecryptEphemeralStaticX25519(msg.Value, secrets.UserPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) < build.NonceLen {
+		return nil, fmt.Errorf("expected nonce of length %d, got %d", build.NonceLen, len(nonce))
+	}
+	return nonce[:build.NonceLen], nil
+}
+
+// Auth takes a static, preshared pairing pin and writes it to the bottle's auth characteristic in order to initiate readings. The pin is appended to a nonce value in order to prevent replay attacks and encrypted to the public key presented by the bottle, along with a secret from which both derive the session key. If the bottle is paired and presents another key than when first paired with, the pin is withheld and ErrIdentityMismatch is returned, as it is if the bottle fails to prove having derived the session key, which requires the private key to the presented one. Bottles which confirm handshakes are waited for until ctx is done, returning ErrAuthTimeout, or until they reject the pin, returning ErrAuthFailed.
+func (s *GattClient) Auth(ctx context.Context, pin []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.auth(ctx, pin)
+}
+
+func (s *GattClient) auth(ctx context.Context, pin []byte) ([]byte, error) {
+	if !s.capabilities.Features.Has(transport.FeatureAuth) {
+		// The bottle was built without authentication and starts a session with every client on connecting, whose key is all zeros.
+		s.debug("bottle does not require authentication")
+		s.pin = []byte{}
+		s.key = make([]byte, build.NonceLen)
+		s.remember(s.pin)
+		if err := s.setTime(time.Now()); err != nil {
+			s.debug("failed to set bottle time", "error", err)
+		}
+		return s.key, nil
+	}
+	// Never reveal the pin to a bottle impersonating a paired one.
+	if s.bonds != nil {
+		if err := s.bonds.Verify(s.deviceID, s.identity); err != nil {
+			return nil, err
+		}
+	}
+	if s.capabilities.Version < transport.KeyAgreementVersion {
+		// Older bottles use the nonce as session key, whose handshakes could be replayed, and an impostor could evade proving its identity by claiming such a version.
+		return nil, fmt.Errorf("%w: bottle speaks protocol version %d, which cannot prove its identity, please update the bottle's firmware", transport.ErrIncompatible, s.capabilities.Version)
+	}
+	nonce, err := s.readNonce()
+	if err != nil {
+		return nil, err
+	}
+	v := append([]byte{}, nonce...)
 	if pin != nil && len(pin) > 0 {
 		v = append(v, pin...)
 	}
-	s.debug("re-encrypting nonce with static pin", "pin", fmt.Sprintf("%+v", v), "nonce", fmt.Sprintf("%+v", s.authNonce))
-	reencNonce, err := crypto.EncryptEphemeralStaticX25519(v, secrets.BottlePublicKey)
+	secret := make([]byte, build.NonceLen)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	v = append(v, secret...)
+	key, err := crypto.DeriveKey(append(append([]byte{}, nonce...), secret...), crypto.SessionKeyLabel)
+	if err != nil {
+		return nil, err
+	}
+	s.debug("re-encrypting nonce with static pin", "pin", fmt.Sprintf("%+v", v), "nonce", fmt.Sprintf("%+v", nonce))
+	reencNonce, err := crypto.EncryptEphemeralStaticX25519(v, s.identity)
 	if err != nil {
 		return nil, err
 	}
 	s.debug("performing authentication", "pin", fmt.Sprintf("%+v", v))
-	if s.authChar == nil {
-		return nil, fmt.Errorf("auth characteristic is nil")
+	// Discard the outcome of a previous handshake.
+	select {
+	case <-s.authStatus:
+	default:
+	}
+	if _, err = s.authChar.WriteWithoutResponse(reencNonce); err != nil {
+		return nil, err
+	}
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	select {
+	case p := <-s.authStatus:
+		status := transport.AuthStatus(p[0])
+		s.debug("received auth confirmation", "status", status)
+		if status != transport.AuthSucceeded {
+			return nil, ErrAuthFailed
+		}
+		tag, err := crypto.KeyConfirmation(key)
+		if err != nil {
+			return nil, err
+		}
+		if !hmac.Equal(p[1:], tag) {
+			return nil, fmt.Errorf("%w: bottle failed to prove holding the private key to the public key it presented", ErrIdentityMismatch)
+		}
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%w: %w", ErrAuthTimeout, ctx.Err())
+	}
+	s.key = key
+	// Remembered for re-authenticating after reconnecting.
+	s.pin = append([]byte{}, pin...)
+	s.remember(s.pin)
+	// The bottle only accepts time updates from authenticated clients. As writes are processed in order, the update is guaranteed to arrive after the auth payload.
+	if err := s.setTime(time.Now()); err != nil {
+		s.debug("failed to set bottle time", "error", err)
+	}
+	return s.key, nil
+}
+
+// SetTime writes the given wall clock time to the bottle, which it uses to timestamp readings.
+func (s *GattClient) SetTime(t time.Time) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.setTime(t)
+}
+
+func (s *GattClient) setTime(t time.Time) error {
+	if s.timeChar == nil {
+		return fmt.Errorf("current time characteristic is nil")
 	}
-	_, err = s.authChar.WriteWithoutResponse(reencNonce)
-	return s.authNonce[:], err
+	s.debug("setting bottle time", "time", t)
+	_, err := s.timeChar.WriteWithoutResponse(transport.MarshalCurrentTime(t))
+	return err
 }
 
-func (s *GattClient) Disconnect() error {
+// SendCommand encrypts a command with the session cipher obtained after authenticating and writes it to the bottle's command characteristic.
+func (s *GattClient) SendCommand(gcm cipher.AEAD, cmd *transport.Command) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sendCommand(gcm, cmd)
+}
+
+func (s *GattClient) sendCommand(gcm cipher.AEAD, cmd *transport.Command) error {
+	if err := s.require(transport.FeatureCommands); err != nil {
+		return err
+	}
+	if s.cmdChar == nil {
+		return fmt.Errorf("command characteristic is nil")
+	}
+	payload := cmd.MarshalBytes()
+	out := make([]byte, gcm.NonceSize()+len(payload)+gcm.Overhead())
+	if err := crypto.EncryptAES(gcm, payload, out); err != nil {
+		return err
+	}
+	msg := transport.Message{Type: transport.Control}
+	msg.Load(out)
+	s.debug("sending command", "code", cmd.Code)
+	_, err := s.cmdChar.WriteWithoutResponse(msg.MarshalBytes())
+	return err
+}
+
+// Sync requests all readings buffered by the bottle following the given sequence number. They are delivered to the queue as messages of type History.
+func (s *GattClient) Sync(gcm cipher.AEAD, since uint32) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if err := s.require(transport.FeatureBatching); err != nil {
+		return err
+	}
+	return s.sendCommand(gcm, transport.NewSyncCommand(since))
+}
+
+// Alert makes the bottle beep or blink at the given level, helping to locate it. The bottle only accepts alerts after authenticating.
+func (s *GattClient) Alert(level transport.AlertLevel) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.alertChar == nil {
+		return fmt.Errorf("bottle does not support alerts")
+	}
+	s.debug("sending alert", "level", level)
+	_, err := s.alertChar.WriteWithoutResponse([]byte{byte(level)})
+	return err
+}
+
+// SetConnectionMode requests the bottle to switch to the connection parameters of the given mode. The bottle temporarily switches to fast mode during transfers regardless.
+func (s *GattClient) SetConnectionMode(gcm cipher.AEAD, mode transport.ConnectionMode) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sendCommand(gcm, transport.NewConnectionModeCommand(mode))
+}
+
+// StreamLogs requests the bottle to stream its log lines at or above the given level, starting with the lines it has buffered. They are delivered to Logs as encrypted messages of type Log.
+func (s *GattClient) StreamLogs(gcm cipher.AEAD, level slog.Level) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if err := s.require(transport.FeatureLogs); err != nil {
+		return err
+	}
+	if s.capabilities.Formats&transport.FormatLogV1 == 0 {
+		return fmt.Errorf("%w: bottle does not offer a log format known to this client", transport.ErrIncompatible)
+	}
+	if s.logChar == nil {
+		return fmt.Errorf("log characteristic is nil")
+	}
+	return s.sendCommand(gcm, transport.NewLogCommand(true, level))
+}
+
+// StopLogs requests the bottle to stop streaming log lines.
+func (s *GattClient) StopLogs(gcm cipher.AEAD) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sendCommand(gcm, transport.NewLogCommand(false, slog.LevelInfo))
+}
+
+func (s *GattClient) Logs() <-chan transport.Message {
+	return s.logs
+}
+
+// Diagnostics reads the bottle's most recent health report. The bottle refreshes it periodically while an authenticated client is connected.
+func (s *GattClient) Diagnostics(gcm cipher.AEAD) (transport.Diagnostics, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	d := transport.Diagnostics{}
+	if err := s.require(transport.FeatureDiagnostics); err != nil {
+		return d, err
+	}
+	if s.capabilities.Formats&transport.FormatDiagnosticsV1 == 0 {
+		return d, fmt.Errorf("%w: bottle does not offer a diagnostics format known to this client", transport.ErrIncompatible)
+	}
+	if s.diagChar == nil {
+		return d, fmt.Errorf("diagnostics characteristic is nil")
+	}
+	buf := make([]byte, 256)
+	n, err := s.diagChar.Read(buf)
+	if err != nil {
+		return d, err
+	}
+	msg := transport.Message{}
+	if err := transport.UnmarshalBytes(&msg, buf[:n]); err != nil {
+		return d, err
+	}
+	if msg.Type != transport.Health {
+		return d, fmt.Errorf("no diagnostics have been published yet")
+	}
+	if len(msg.Value) < gcm.NonceSize()+gcm.Overhead() {
+		return d, fmt.Errorf("diagnostics report is too short")
+	}
+	out := make([]byte, len(msg.Value)-gcm.NonceSize()-gcm.Overhead())
+	if err := crypto.DecryptAES(gcm, msg.Value, out); err != nil {
+		return d, err
+	}
+	return d, transport.UnmarshalDiagnostics(&d, out)
+}
+
+// UpdateFirmware transfers a signed firmware image to the bottle, which stages it once verified. Interrupted transfers of the same image resume where they left off. The optional progress callback is invoked with the number of bytes acknowledged by the bottle.
+func (s *GattClient) UpdateFirmware(image []byte, h ota.Header, progress func(sent, total int)) error {
+	// The transfer takes a while, so it is not allowed to hold up reconnecting. It fails with the connection regardless.
+	s.mu.RLock()
+	firmware := s.firmware
+	s.mu.RUnlock()
+	if firmware == nil {
+		return fmt.Errorf("bottle does not support firmware updates")
+	}
+	// Fill each write up to the ATT MTU, minus the ATT header and chunk offset.
+	chunkSize := 20 - ota.ChunkOverhead
+	if mtu, err := firmware.data.GetMTU(); err == nil && mtu > 23 {
+		chunkSize = int(mtu) - 3 - ota.ChunkOverhead
+	}
+	s.debug("updating firmware", "size", h.Size, "chunkSize", chunkSize)
+	return ota.Send(firmware, image, h, chunkSize, progress)
+}
+
+// Disconnect disconnects from the bottle. The client does not attempt to reconnect afterwards.
+func (s *GattClient) Disconnect(ctx context.Context) error {
+	s.closing.Store(true)
+	unregister(s)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	s.debug("performing disconnect", "device", s.device)
+	if s.link != nil {
+		return s.link.Close()
+	}
 	if s.device.Address == (bluetooth.Address{}) {
 		return fmt.Errorf("device is nil")
 	}
-	return s.device.Disconnect()
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	return await(ctx, s.device.Disconnect)
+}
+
+// connect connects to the bottle with the given address until ctx is done.
+func (s *GattClient) connect(ctx context.Context, address bluetooth.Address) (bluetooth.Device, error) {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	type result struct {
+		device bluetooth.Device
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		device, err := s.adapter.Connect(address, bluetooth.ConnectionParams{})
+		done <- result{device, err}
+	}()
+	select {
+	case r := <-done:
+		return r.device, r.err
+	case <-ctx.Done():
+		// Connecting cannot be aborted, so drop the connection should it still succeed.
+		go func() {
+			if r := <-done; r.err == nil {
+				r.device.Disconnect()
+			}
+		}()
+		return bluetooth.Device{}, ctx.Err()
+	}
+}
+
+// withTimeout bounds ctx by the given timeout, unless it already has a deadline.
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// await runs fn, which cannot be canceled, returning early with the context's error once ctx is done.
+func await(ctx context.Context, fn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (s *GattClient) Queue() chan transport.Message {
 	return s.c
 }
 
+// Battery returns a channel of battery level updates in percent. Only the most recent level is retained if the channel is not drained. No updates are delivered if the bottle does not expose the Battery Service.
+func (s *GattClient) Battery() <-chan uint8 {
+	return s.battery
+}
+
+// readCapabilities reads the bottle's capabilities and checks whether they are compatible with this client. Bottles lacking the capabilities characteristic predate versioning and are treated as speaking protocol version 0.
+func (s *GattClient) readCapabilities(char characteristic) error {
+	if char == nil {
+		s.capabilities = transport.Capabilities{}
+		return s.capabilities.Compatible()
+	}
+	buf := make([]byte, 64)
+	n, err := char.Read(buf)
+	if err != nil {
+		return err
+	}
+	if err := transport.UnmarshalCapabilities(&s.capabilities, buf[:n]); err != nil {
+		return err
+	}
+	s.debug("read capabilities", "version", s.capabilities.Version, "minVersion", s.capabilities.MinVersion, "features", s.capabilities.Features)
+	return s.capabilities.Compatible()
+}
+
+// Capabilities returns the protocol version, features and payload formats of the connected bottle.
+func (s *GattClient) Capabilities() transport.Capabilities {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.capabilities
+}
+
+// require returns an error unless the connected bottle has all of the given features enabled.
+func (s *GattClient) require(f transport.Feature) error {
+	if !s.capabilities.Features.Has(f) {
+		return fmt.Errorf("bottle does not support %s", f&^s.capabilities.Features)
+	}
+	return nil
+}
+
+// discoverServices discovers the services of the bottle connected via Bluetooth, returning the characteristics of those declared by the schema.
+func (s *GattClient) discoverServices(ctx context.Context) (map[*schema.Service]map[bluetooth.UUID]characteristic, error) {
+	// Discover all services, as filtering fails if any of the requested (including optional) services are missing.
+	s.debug("scanning for matching service", "device", s.device, "serviceID", schema.Main.UUID.String())
+	var svcs []bluetooth.DeviceService
+	err := await(ctx, func() (err error) {
+		svcs, err = s.device.DiscoverServices(nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	services := map[*schema.Service]map[bluetooth.UUID]characteristic{}
+	for _, service := range svcs {
+		decl := schema.Lookup(service.UUID())
+		if decl == nil {
+			continue
+		}
+		chars, err := s.discoverCharacteristics(ctx, service, decl)
+		if err != nil {
+			if !decl.Optional {
+				return nil, err
+			}
+			s.debug("skipping optional service", "service", decl.Name, "error", err)
+			continue
+		}
+		s.debug("found service", "service", decl.Name, "serviceID", service.UUID().String())
+		services[decl] = chars
+	}
+	return services, nil
+}
+
+// discoverCharacteristics discovers the characteristics of the given service and validates them against its declaration, returning those which are declared by UUID.
+func (s *GattClient) discoverCharacteristics(ctx context.Context, svc bluetooth.DeviceService, decl *schema.Service) (map[bluetooth.UUID]characteristic, error) {
+	// As with services, filtering fails if any of the requested characteristics are missing, so discover all and validate afterwards.
+	var chars []bluetooth.DeviceCharacteristic
+	err := await(ctx, func() (err error) {
+		chars, err = svc.DiscoverCharacteristics(nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[bluetooth.UUID]characteristic, len(chars))
+	uuids := make([]bluetooth.UUID, 0, len(chars))
+	for _, char := range chars {
+		if c := decl.Characteristic(char.UUID()); c != nil {
+			s.debug("found characteristic", "service", decl.Name, "characteristic", c.Name, "characteristicID", char.UUID().String())
+			found[char.UUID()] = &char
+			uuids = append(uuids, char.UUID())
+		}
+	}
+	if err := decl.Validate(uuids); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrServiceMissing, err)
+	}
+	return found, nil
+}
+
+// readDeviceID reads the device ID from the given serial number characteristic.
+func readDeviceID(char characteristic) (transport.DeviceID, error) {
+	buf := make([]byte, 2*transport.DeviceIDLen)
+	n, err := char.Read(buf)
+	if err != nil {
+		return transport.DeviceID{}, err
+	}
+	return transport.ParseDeviceID(string(buf[:n]))
+}
+
+// lookup returns the discovered characteristic matching the given declaration, or nil if the bottle does not expose it.
+func lookup(chars map[bluetooth.UUID]characteristic, c *schema.Characteristic) characteristic {
+	char, ok := chars[c.UUID]
+	if !ok {
+		return nil
+	}
+	return char
+}
+
+func (s *GattClient) subscribeBattery(char characteristic) error {
+	s.debug("found battery level characteristic", "characteristicID", char.UUID().String())
+
+	buf := make([]byte, 1)
+	if n, err := char.Read(buf); err != nil {
+		return err
+	} else if n == 1 {
+		s.publishBattery(buf[0])
+	}
+	return char.EnableNotifications(func(p []byte) {
+		if len(p) > 0 {
+			s.publishBattery(p[0])
+		}
+	})
+}
+
+func (s *GattClient) publishBattery(level uint8) {
+	s.debug("received battery level", "level", level)
+	// Replace any stale level which has not been consumed yet.
+	select {
+	case <-s.battery:
+	default:
+	}
+	select {
+	case s.battery <- level:
+	default:
+	}
+}
+
+// DeviceID returns the ID of the bottle the client connected to.
+func (s *GattClient) DeviceID() transport.DeviceID {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.deviceID
+}
+
+// matches reports whether the manufacturer data advertised at the given address belongs to a bottle targeted by the client.
+func (s *GattClient) matches(address bluetooth.Address, d bluetooth.ManufacturerDataElement) (transport.DeviceID, bool) {
+	if d.CompanyID != build.ManufacturerUUID {
+		return transport.DeviceID{}, false
+	}
+	id, _, _, err := transport.UnmarshalManufacturerData(d.Data)
+	if err != nil {
+		return id, false
+	}
+	if s.targetID != nil && id != *s.targetID {
+		return id, false
+	}
+	if s.targetAddress != "" && !strings.EqualFold(address.String(), s.targetAddress) {
+		return id, false
+	}
+	if s.targetID == nil && s.targetAddress == "" && !s.bonded(id) {
+		return id, false
+	}
+	return id, true
+}
+
 func (s *GattClient) debug(msg string, args ...any) {
 	if s.logger != nil {
 		s.logger.Debug(msg, args...)
@@ -176,3 +840,83 @@ func WithLogger(l *slog.Logger) ClientOption {
 		c.logger = l
 	}
 }
+
+// WithDeviceID restricts the client to the bottle with the given ID, as printed on its serial number label.
+func WithDeviceID(id transport.DeviceID) ClientOption {
+	return func(c *GattClient) {
+		c.targetID = &id
+	}
+}
+
+// WithAddress restricts the client to the bottle with the given Bluetooth address.
+func WithAddress(address string) ClientOption {
+	return func(c *GattClient) {
+		c.targetAddress = address
+	}
+}
+
+// WithQueue sets the number of messages buffered for Queue and what happens to messages arriving while it is full. Defaults to 64 messages and DropOldest, so that a slow consumer never stalls the Bluetooth stack. Consumers syncing large histories should raise the size rather than opting into Block. Sizes below 1 are raised to 1, as the overflow policies need room for at least one message.
+func WithQueue(size int, policy OverflowPolicy) ClientOption {
+	return func(c *GattClient) {
+		c.queueSize = max(size, 1)
+		c.policy = policy
+	}
+}
+
+// WithReconnect controls whether the client reconnects to the bottle after losing the connection, see Events. Enabled by default.
+func WithReconnect(enable bool) ClientOption {
+	return func(c *GattClient) {
+		c.reconnect = enable
+	}
+}
+
+// WithBackoff sets the delay between reconnection attempts, which doubles after every failed attempt up to max.
+func WithBackoff(min, max time.Duration) ClientOption {
+	return func(c *GattClient) {
+		c.backoffMin = min
+		c.backoffMax = max
+	}
+}
+
+// WithScanTimeout bounds scanning for a bottle in Init, unless the context passed has a deadline. Defaults to DefaultScanTimeout.
+func WithScanTimeout(d time.Duration) ClientOption {
+	return func(c *GattClient) {
+		c.scanTimeout = d
+	}
+}
+
+// WithTimeout bounds connecting, discovery, authentication and disconnecting, unless the context passed has a deadline. Defaults to DefaultTimeout.
+func WithTimeout(d time.Duration) ClientOption {
+	return func(c *GattClient) {
+		c.timeout = d
+	}
+}
+
+// firmwareTarget relays firmware update operations to the bottle's firmware update service.
+type firmwareTarget struct {
+	control, data, status characteristic
+}
+
+func (t *firmwareTarget) Begin(h ota.Header) error {
+	_, err := t.control.WriteWithoutResponse(append([]byte{byte(ota.OpBegin)}, h.MarshalBytes()...))
+	return err
+}
+
+func (t *firmwareTarget) Write(offset uint32, chunk []byte) error {
+	_, err := t.data.WriteWithoutResponse(ota.MarshalChunk(offset, chunk))
+	return err
+}
+
+func (t *firmwareTarget) Finish() error {
+	_, err := t.control.WriteWithoutResponse([]byte{byte(ota.OpFinish)})
+	return err
+}
+
+func (t *firmwareTarget) Status() (ota.Status, error) {
+	st := ota.Status{}
+	buf := make([]byte, ota.StatusLen)
+	if _, err := t.status.Read(buf); err != nil {
+		return st, err
+	}
+	return st, ota.UnmarshalStatus(&st, buf)
+}
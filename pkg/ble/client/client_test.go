@@ -0,0 +1,97 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/toalaah/smart-bottle/pkg/build/secrets"
+	"github.com/toalaah/smart-bottle/pkg/link"
+)
+
+func TestAuthTimeout(t *testing.T) {
+	b := &fakeBottle{silent: true}
+	c := newTestClient(t, b, WithTimeout(50*time.Millisecond))
+	start := time.Now()
+	_, err := c.Auth(context.Background(), secrets.PairingPin[:])
+	if !errors.Is(err, ErrAuthTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected auth to fail with '%v', got '%v'", ErrAuthTimeout, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Expected auth to time out after '%v', took '%v'", 50*time.Millisecond, d)
+	}
+}
+
+func TestAuthCanceled(t *testing.T) {
+	b := &fakeBottle{silent: true}
+	c := newTestClient(t, b, WithTimeout(time.Minute))
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := c.Auth(ctx, secrets.PairingPin[:])
+	if !errors.Is(err, ErrAuthTimeout) || !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected auth to fail with '%v', got '%v'", context.Canceled, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Expected auth to abort once canceled, took '%v'", d)
+	}
+}
+
+func TestInitLinkTimeout(t *testing.T) {
+	c := New(WithTimeout(50 * time.Millisecond))
+	// A bottle which never answers, e.g. as it runs firmware without link support.
+	c.dial = func(ctx context.Context) (io.ReadWriteCloser, error) {
+		client, conn := net.Pipe()
+		go io.Copy(io.Discard, conn)
+		return client, nil
+	}
+	start := time.Now()
+	if err := c.Init(context.Background()); !errors.Is(err, link.ErrTimeout) {
+		t.Errorf("Expected init to fail with '%v', got '%v'", link.ErrTimeout, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Expected init to time out after '%v', took '%v'", 50*time.Millisecond, d)
+	}
+	if c.Connected() {
+		t.Error("Expected client to remain disconnected")
+	}
+}
+
+func TestAwait(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	block := make(chan struct{})
+	defer close(block)
+	err := await(ctx, func() error {
+		<-block
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected await to return '%v', got '%v'", context.Canceled, err)
+	}
+
+	want := errors.New("failed")
+	if err := await(context.Background(), func() error { return want }); err != want {
+		t.Errorf("Expected await to return '%v', got '%v'", want, err)
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	ctx, cancel := withTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > time.Minute {
+		t.Errorf("Expected deadline within '%v', got '%v'", time.Minute, deadline)
+	}
+
+	// An existing deadline takes precedence, even if later than the timeout.
+	parent, cancelParent := context.WithTimeout(context.Background(), time.Hour)
+	defer cancelParent()
+	ctx, cancel = withTimeout(parent, time.Minute)
+	defer cancel()
+	if deadline, _ := ctx.Deadline(); time.Until(deadline) <= time.Minute {
+		t.Errorf("Expected parent deadline to be kept, got '%v'", deadline)
+	}
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/toalaah/smart-bottle/pkg/transport"
+)
+
+// ErrMalformedFrame is reported on Errors for notifications which could not be parsed.
+var ErrMalformedFrame = errors.New("malformed frame")
+
+// OverflowPolicy determines what happens to notifications arriving while the queue is full.
+type OverflowPolicy uint8
+
+const (
+	// Block waits for the consumer to catch up. No message is lost, but the Bluetooth stack stalls in the meantime, delaying all other notifications and possibly the connection's supervision, so it has to be opted into via WithQueue.
+	Block OverflowPolicy = iota
+	// DropOldest discards the oldest queued message to make room, favoring fresh readings.
+	DropOldest
+	// DropNewest discards the arriving message.
+	DropNewest
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case Block:
+		return "block"
+	case DropOldest:
+		return "drop-oldest"
+	case DropNewest:
+		return "drop-newest"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(p))
+	}
+}
+
+// DeliveryStats counts the notifications received from the bottle.
+type DeliveryStats struct {
+	Delivered uint64
+	// Dropped messages were discarded according to the overflow policy.
+	Dropped uint64
+	// Malformed frames could not be parsed and were reported on Errors.
+	Malformed uint64
+}
+
+type deliveryCounters struct {
+	delivered, dropped, malformed atomic.Uint64
+}
+
+// Stats returns the number of notifications delivered, dropped and found malformed since the client was created.
+func (s *GattClient) Stats() DeliveryStats {
+	return DeliveryStats{
+		Delivered: s.counters.delivered.Load(),
+		Dropped:   s.counters.dropped.Load(),
+		Malformed: s.counters.malformed.Load(),
+	}
+}
+
+// Errors returns a channel of errors encountered while handling notifications, such as malformed frames. Errors are dropped if not consumed in time.
+func (s *GattClient) Errors() <-chan error {
+	return s.errors
+}
+
+// parseFrame parses a notification into a message. Malformed frames are counted and reported on Errors.
+func (s *GattClient) parseFrame(p []byte) (transport.Message, bool) {
+	// The stack may reuse the underlying buffer once the handler returns.
+	b := make([]byte, len(p))
+	copy(b, p)
+	msg := transport.Message{}
+	if err := transport.UnmarshalBytes(&msg, b); err != nil {
+		s.counters.malformed.Add(1)
+		s.debug("received malformed frame", "value", fmt.Sprintf("%+v", p), "error", err)
+		select {
+		case s.errors <- fmt.Errorf("%w: %w", ErrMalformedFrame, err):
+		default:
+		}
+		return msg, false
+	}
+	return msg, true
+}
+
+// deliver queues a message according to the overflow policy. It is called from the stack's notification handlers.
+func (s *GattClient) deliver(msg transport.Message) {
+	switch s.policy {
+	case Block:
+		s.c <- msg
+	case DropNewest:
+		select {
+		case s.c <- msg:
+		default:
+			s.counters.dropped.Add(1)
+			s.debug("queue is full, dropping newest message", "type", msg.Type)
+			return
+		}
+	case DropOldest:
+		for sent := false; !sent; {
+			select {
+			case s.c <- msg:
+				sent = true
+				continue
+			default:
+			}
+			select {
+			case <-s.c:
+				s.counters.dropped.Add(1)
+				s.debug("queue is full, dropping oldest message")
+			default:
+			}
+		}
+	}
+	s.counters.delivered.Add(1)
+}
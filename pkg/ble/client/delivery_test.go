@@ -0,0 +1,146 @@
+package client
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/toalaah/smart-bottle/pkg/transport"
+)
+
+// message returns a frame as notified by the bottle, carrying the given value.
+func message(v byte) []byte {
+	msg := transport.Message{Type: transport.WaterLevel}
+	msg.Load([]byte{v})
+	return msg.MarshalBytes()
+}
+
+// notify parses and delivers a frame as the client's notification handlers do.
+func notify(s *GattClient, p []byte) {
+	if msg, ok := s.parseFrame(p); ok {
+		s.deliver(msg)
+	}
+}
+
+// drain returns the first value of every queued message.
+func drain(s *GattClient) []byte {
+	var values []byte
+	for {
+		select {
+		case msg := <-s.Queue():
+			values = append(values, msg.Value[0])
+		default:
+			return values
+		}
+	}
+}
+
+func TestDeliverBlock(t *testing.T) {
+	s := New(WithQueue(1, Block))
+	notify(s, message(1))
+	delivered := make(chan struct{})
+	go func() {
+		notify(s, message(2))
+		close(delivered)
+	}()
+	select {
+	case <-delivered:
+		t.Fatal("Expected delivery to block while the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if v := (<-s.Queue()).Value[0]; v != 1 {
+		t.Errorf("Expected first message to be '%v', got '%v'", 1, v)
+	}
+	select {
+	case <-delivered:
+	case <-time.After(time.Second):
+		t.Fatal("Expected delivery to resume once the queue has room")
+	}
+	if v := (<-s.Queue()).Value[0]; v != 2 {
+		t.Errorf("Expected second message to be '%v', got '%v'", 2, v)
+	}
+	if stats := s.Stats(); stats.Delivered != 2 || stats.Dropped != 0 {
+		t.Errorf("Expected '%v' delivered and '%v' dropped messages, got '%+v'", 2, 0, stats)
+	}
+}
+
+func TestDeliverDrop(t *testing.T) {
+	for _, tt := range []struct {
+		policy OverflowPolicy
+		want   []byte
+	}{
+		{DropOldest, []byte{2, 3}},
+		{DropNewest, []byte{1, 2}},
+	} {
+		s := New(WithQueue(2, tt.policy))
+		for v := byte(1); v <= 3; v++ {
+			notify(s, message(v))
+		}
+		if got := drain(s); string(got) != string(tt.want) {
+			t.Errorf("Expected %s to queue '%v', got '%v'", tt.policy, tt.want, got)
+		}
+		if stats := s.Stats(); stats.Dropped != 1 {
+			t.Errorf("Expected %s to drop '%v' messages, got '%v'", tt.policy, 1, stats.Dropped)
+		}
+	}
+
+	// A queue without room would otherwise make dropping the oldest message spin forever.
+	s := New(WithQueue(0, DropOldest))
+	done := make(chan struct{})
+	go func() {
+		notify(s, message(1))
+		notify(s, message(2))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected delivery to an empty queue to return")
+	}
+	if got := drain(s); len(got) != 1 || got[0] != 2 {
+		t.Errorf("Expected queue of size 0 to hold the latest message, got '%v'", got)
+	}
+}
+
+func TestDeliverDefaultPolicy(t *testing.T) {
+	// The stack's notification handlers must never block on a slow consumer unless opted into.
+	s := New()
+	if s.policy != DropOldest {
+		t.Errorf("Expected default policy to be '%v', got '%v'", DropOldest, s.policy)
+	}
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i <= s.queueSize; i++ {
+			notify(s, message(byte(i)))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected delivery to a full queue to return")
+	}
+	if stats := s.Stats(); stats.Dropped != 1 {
+		t.Errorf("Expected '%v' dropped messages, got '%v'", 1, stats.Dropped)
+	}
+}
+
+func TestDeliverMalformed(t *testing.T) {
+	s := New()
+	notify(s, []byte{byte(transport.WaterLevel)})
+	notify(s, []byte{byte(transport.WaterLevel), 4, 1})
+	notify(s, message(1))
+	if stats := s.Stats(); stats.Malformed != 2 || stats.Delivered != 1 {
+		t.Errorf("Expected '%v' malformed and '%v' delivered messages, got '%+v'", 2, 1, stats)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-s.Errors():
+			if !errors.Is(err, ErrMalformedFrame) {
+				t.Errorf("Expected error to wrap '%v', got '%v'", ErrMalformedFrame, err)
+			}
+		default:
+			t.Fatal("Expected malformed frames to be reported")
+		}
+	}
+}
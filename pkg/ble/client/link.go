@@ -0,0 +1,128 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+
+	"github.com/toalaah/smart-bottle/pkg/ble/schema"
+	"github.com/toalaah/smart-bottle/pkg/link"
+	"tinygo.org/x/bluetooth"
+)
+
+// WithSerial reaches the bottle over USB serial rather than Bluetooth. The path may be a glob pattern such as /dev/ttyACM*, in which case the first port which can be opened is used. Authentication, commands and readings work exactly as over Bluetooth.
+func WithSerial(path string) ClientOption {
+	return func(c *GattClient) {
+		c.linkAddress = path
+		c.dial = func(ctx context.Context) (io.ReadWriteCloser, error) {
+			return dialSerial(path)
+		}
+	}
+}
+
+// WithBridge reaches the bottle through a bridge relaying it over the network, see Relay. The network is "tcp" or "unix", see link.SplitAddress. As with WithSerial, the client behaves exactly as if connected via Bluetooth.
+func WithBridge(network, address string) ClientOption {
+	return func(c *GattClient) {
+		c.linkAddress = address
+		c.dial = func(ctx context.Context) (io.ReadWriteCloser, error) {
+			ctx, cancel := withTimeout(ctx, c.timeout)
+			defer cancel()
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		}
+	}
+}
+
+// ConnectLink connects to the bottle on the other end of the given stream, see package link, and discovers its services. The stream is closed when disconnecting.
+func (s *GattClient) ConnectLink(ctx context.Context, rwc io.ReadWriteCloser) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.attach(ctx, rwc); err != nil {
+		return err
+	}
+	s.debug("connected to device", "link", s.linkAddress, "id", s.deviceID)
+	s.connected.Store(true)
+	s.emit(ConnectionEvent{State: StateConnected})
+	return nil
+}
+
+// connectLink dials the bottle as configured via WithSerial or WithBridge.
+func (s *GattClient) connectLink(ctx context.Context) error {
+	rwc, err := s.dial(ctx)
+	if err != nil {
+		return err
+	}
+	return s.ConnectLink(ctx, rwc)
+}
+
+// attach starts a session over the given stream and sets it up, watching for the stream to fail afterwards.
+func (s *GattClient) attach(ctx context.Context, rwc io.ReadWriteCloser) error {
+	conn, err := link.NewConn(rwc, s.timeout)
+	if err != nil {
+		return err
+	}
+	s.link = conn
+	if err := s.setup(ctx); err != nil {
+		conn.Close()
+		return err
+	}
+	go func() {
+		<-conn.Done()
+		s.handleDisconnect(conn.Err())
+	}()
+	return nil
+}
+
+// discoverLink discovers the characteristics served over the link, grouping them by the schema services declaring them.
+func (s *GattClient) discoverLink() (map[*schema.Service]map[bluetooth.UUID]characteristic, error) {
+	uuids, err := s.link.Discover()
+	if err != nil {
+		return nil, err
+	}
+	services := map[*schema.Service]map[bluetooth.UUID]characteristic{}
+	for _, decl := range schema.Services {
+		chars := map[bluetooth.UUID]characteristic{}
+		found := []bluetooth.UUID{}
+		for _, uuid := range uuids {
+			if c := decl.Characteristic(uuid); c != nil {
+				s.debug("found characteristic", "service", decl.Name, "characteristic", c.Name, "characteristicID", uuid.String())
+				chars[uuid] = s.link.Characteristic(uuid)
+				found = append(found, uuid)
+			}
+		}
+		if len(found) == 0 && decl.Optional {
+			continue
+		}
+		if err := decl.Validate(found); err != nil {
+			if !decl.Optional {
+				return nil, fmt.Errorf("%w: %w", ErrServiceMissing, err)
+			}
+			s.debug("skipping optional service", "service", decl.Name, "error", err)
+			continue
+		}
+		services[decl] = chars
+	}
+	return services, nil
+}
+
+// dialSerial opens the first serial port matching the given pattern.
+func dialSerial(pattern string) (io.ReadWriteCloser, error) {
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("%w: no serial port matches %s", ErrNoDeviceFound, pattern)
+	}
+	var errs []error
+	for _, path := range paths {
+		port, err := openSerial(path)
+		if err == nil {
+			return port, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", path, err))
+	}
+	return nil, fmt.Errorf("failed to open serial port: %v", errs)
+}
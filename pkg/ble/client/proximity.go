@@ -0,0 +1,56 @@
+package client
+
+import (
+	"time"
+
+	"github.com/toalaah/smart-bottle/pkg/proximity"
+	"tinygo.org/x/bluetooth"
+)
+
+// MonitorProximity feeds the signal strength of the paired bottle's advertisements and the state of the connection to it into the given monitor, calling fn for every proximity change. Init must have been called before, so that the bottle can be told apart from others. It blocks until StopScan is called.
+func (s *GattClient) MonitorProximity(m *proximity.Monitor, fn func(e proximity.Event)) error {
+	s.debug("enabling adapter")
+	if err := s.adapter.Enable(); err != nil {
+		return err
+	}
+	emit := func(e proximity.Event, ok bool) {
+		if ok {
+			s.debug("bottle proximity changed", "state", e.State, "rssi", e.RSSI)
+			fn(e)
+		}
+	}
+
+	s.mu.Lock()
+	s.onConnectionChange = func(connected bool) {
+		emit(m.SetConnected(connected, time.Now()))
+	}
+	id := s.deviceID
+	s.mu.Unlock()
+	// The connection was established before the hook was in place.
+	emit(m.SetConnected(s.connected.Load(), time.Now()))
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				emit(m.Tick(now))
+			}
+		}
+	}()
+
+	s.debug("scanning for advertisements of paired bottle", "id", id)
+	return s.adapter.Scan(func(adapter *bluetooth.Adapter, result bluetooth.ScanResult) {
+		for _, d := range result.ManufacturerData() {
+			if found, ok := s.matches(result.Address, d); ok && found == id {
+				emit(m.Update(result.RSSI, time.Now()))
+				return
+			}
+		}
+	})
+}
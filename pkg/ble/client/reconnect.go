@@ -0,0 +1,213 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// livenessInterval is the interval at which the connection to the bottle is probed, as not all platforms report disconnects of peripherals.
+const livenessInterval = 5 * time.Second
+
+// ConnectionState describes the state of the connection to the bottle.
+type ConnectionState uint8
+
+const (
+	StateDisconnected ConnectionState = iota
+	StateReconnecting
+	StateConnected
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateConnected:
+		return "connected"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(s))
+	}
+}
+
+// ConnectionEvent reports a change of the connection state.
+type ConnectionEvent struct {
+	State ConnectionState
+	// Attempt counts reconnection attempts since the connection was lost, starting at 1.
+	Attempt int
+	// Err is the error which caused the disconnect, or which failed the previous reconnection attempt.
+	Err error
+	// Key is the session key after reconnecting, if the client had authenticated before. It differs from the previous key, as every authentication agrees on a fresh one, so ciphers derived from it must be recreated. Sessions do so on their own.
+	Key []byte
+}
+
+// Events returns a channel of connection state changes. Events are dropped if not consumed in time, oldest first.
+func (s *GattClient) Events() <-chan ConnectionEvent {
+	return s.events
+}
+
+// Connected reports whether the client is currently connected to the bottle.
+func (s *GattClient) Connected() bool {
+	return s.connected.Load()
+}
+
+func (s *GattClient) emit(e ConnectionEvent) {
+	s.debug("connection state changed", "state", e.State, "attempt", e.Attempt, "error", e.Err)
+	for {
+		select {
+		case s.events <- e:
+			return
+		default:
+		}
+		select {
+		case <-s.events:
+		default:
+		}
+	}
+}
+
+// probe reads the capabilities characteristic at the given interval, which is cheap and readable without authenticating, until the client is closed.
+func (s *GattClient) probe(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if s.closing.Load() {
+			return
+		}
+		if !s.connected.Load() {
+			continue
+		}
+		s.mu.RLock()
+		char := s.capChar
+		s.mu.RUnlock()
+		buf := make([]byte, 16)
+		if _, err := char.Read(buf); err != nil {
+			s.handleDisconnect(err)
+		}
+	}
+}
+
+// handleDisconnect marks the connection as lost and starts reconnecting, unless the client is closing or reconnecting is disabled.
+func (s *GattClient) handleDisconnect(err error) {
+	if !s.connected.CompareAndSwap(true, false) {
+		return
+	}
+	s.emit(ConnectionEvent{State: StateDisconnected, Err: err})
+	s.notifyConnectionChange(false)
+	if s.closing.Load() || !s.reconnect {
+		return
+	}
+	go s.reconnectLoop(err)
+}
+
+// reconnectLoop reconnects to the bottle with exponential backoff until it succeeds or the client is closed. It gives up if the bottle presents another identity, as retrying would not change it, reporting ErrIdentityMismatch with a final StateDisconnected event.
+func (s *GattClient) reconnectLoop(err error) {
+	delay := s.backoffMin
+	for attempt := 1; !s.closing.Load(); attempt++ {
+		s.emit(ConnectionEvent{State: StateReconnecting, Attempt: attempt, Err: err})
+		var key []byte
+		if key, err = s.resume(context.Background()); err == nil {
+			s.connected.Store(true)
+			if sess := s.session.Load(); sess != nil && key != nil {
+				sess.resume(key)
+			}
+			s.emit(ConnectionEvent{State: StateConnected, Attempt: attempt, Key: key})
+			s.notifyConnectionChange(true)
+			return
+		}
+		if errors.Is(err, ErrIdentityMismatch) {
+			s.emit(ConnectionEvent{State: StateDisconnected, Attempt: attempt, Err: err})
+			return
+		}
+		s.debug("failed to reconnect", "attempt", attempt, "delay", delay, "error", err)
+		time.Sleep(delay)
+		delay = min(2*delay, s.backoffMax)
+	}
+}
+
+// notifyConnectionChange calls the hook installed by MonitorProximity or Relay, if any.
+func (s *GattClient) notifyConnectionChange(connected bool) {
+	s.mu.RLock()
+	fn := s.onConnectionChange
+	s.mu.RUnlock()
+	if fn != nil {
+		fn(connected)
+	}
+}
+
+// resume reconnects to the bottle, rediscovers its characteristics and re-enables notifications. If the client had authenticated before, it authenticates again using the same pin and returns the resulting session key.
+func (s *GattClient) resume(ctx context.Context) ([]byte, error) {
+	if s.dial != nil {
+		return s.resumeLink(ctx)
+	}
+	// Scanning happens before taking the lock, so that it does not hold up other goroutines while the bottle is out of range.
+	address := s.locate(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	device, err := s.connect(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	s.device = device
+	if err := s.setup(ctx); err != nil {
+		s.device.Disconnect()
+		return nil, err
+	}
+	if s.pin == nil {
+		return nil, nil
+	}
+	key, err := s.auth(ctx, s.pin)
+	if err != nil {
+		s.device.Disconnect()
+		return nil, err
+	}
+	return append([]byte{}, key...), nil
+}
+
+// locate scans for the bottle the client was connected to, as its address may have changed in the meantime, e.g. if it rotates private addresses. It falls back to the last known address if the bottle is not found, e.g. because another scan is running, see MonitorProximity.
+func (s *GattClient) locate(ctx context.Context) bluetooth.Address {
+	s.mu.RLock()
+	id, last := s.deviceID, s.device.Address
+	s.mu.RUnlock()
+	ctx, cancel := withTimeout(ctx, s.scanTimeout)
+	defer cancel()
+	bottles, err := s.Scan(ctx, 0)
+	if err != nil {
+		s.debug("failed to scan for bottle", "error", err)
+		return last
+	}
+	address := last
+	for b := range bottles {
+		if b.ID == id {
+			address = b.Address
+			cancel()
+		}
+	}
+	return address
+}
+
+// resumeLink is the equivalent of resume for bottles reached over a link, which is dialed anew.
+func (s *GattClient) resumeLink(ctx context.Context) ([]byte, error) {
+	rwc, err := s.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.attach(ctx, rwc); err != nil {
+		return nil, err
+	}
+	if s.pin == nil {
+		return nil, nil
+	}
+	key, err := s.auth(ctx, s.pin)
+	if err != nil {
+		s.link.Close()
+		return nil, err
+	}
+	return append([]byte{}, key...), nil
+}
@@ -0,0 +1,267 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/toalaah/smart-bottle/pkg/ble/schema"
+	"github.com/toalaah/smart-bottle/pkg/ble/service"
+	"github.com/toalaah/smart-bottle/pkg/build"
+	"github.com/toalaah/smart-bottle/pkg/build/secrets"
+	"github.com/toalaah/smart-bottle/pkg/link"
+	"github.com/toalaah/smart-bottle/pkg/transport"
+	"tinygo.org/x/bluetooth"
+)
+
+var testDeviceID = transport.DeviceID{0x51, 0x3d, 0x00, 0x02}
+
+// fakeBottle serves the characteristics of a bottle over in-memory pipes, authenticating clients as the bottle does. Every dial hands out a new connection, as if the bottle came back into range.
+type fakeBottle struct {
+	mu    sync.Mutex
+	nonce [build.NonceLen]byte
+	srv   *link.Server
+	conn  net.Conn
+	dials int
+	// unreachable is the number of dials failing before the bottle is reachable again.
+	unreachable int
+	// impostor confirms handshakes without having derived the session key, as a bottle lacking the private key to the presented identity would.
+	impostor bool
+	// silent never confirms handshakes.
+	silent bool
+}
+
+func (b *fakeBottle) dial(ctx context.Context) (io.ReadWriteCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dials++
+	if b.unreachable > 0 {
+		b.unreachable--
+		return nil, errors.New("bottle is out of range")
+	}
+	nonceValue, err := service.NonceValue(b.nonce[:])
+	if err != nil {
+		return nil, err
+	}
+	caps := transport.Capabilities{
+		Version:    transport.ProtocolVersion,
+		MinVersion: transport.MinProtocolVersion,
+		Features:   transport.FeatureAuth | transport.FeatureCommands,
+		Formats:    transport.FormatReadingV1,
+	}
+	client, conn := net.Pipe()
+	var srv *link.Server
+	srv = link.NewServer(conn, []link.Characteristic{
+		{UUID: schema.ManufacturerName.UUID, Value: []byte(build.ServiceName)},
+		{UUID: schema.FirmwareRevision.UUID, Value: []byte(build.ServiceVersion)},
+		{UUID: schema.ModelNumber.UUID, Value: []byte(build.ModelNumber)},
+		{UUID: schema.HardwareRevision.UUID, Value: []byte("test")},
+		{UUID: schema.SerialNumber.UUID, Value: []byte(testDeviceID.String())},
+		{UUID: schema.FillLevel.UUID},
+		{UUID: schema.Command.UUID, OnWrite: func(value []byte) {}},
+		{UUID: schema.Diagnostics.UUID},
+		{UUID: schema.Log.UUID},
+		{UUID: schema.Capabilities.UUID, Value: caps.MarshalBytes()},
+		{UUID: schema.Nonce.UUID, Value: nonceValue},
+		{UUID: schema.Auth.UUID, OnWrite: func(value []byte) { b.handleAuth(srv, value) }},
+		{UUID: schema.Identity.UUID, Value: secrets.BottlePublicKey},
+		{UUID: schema.CurrentTime.UUID, OnWrite: func(value []byte) {}},
+	}, nil)
+	b.srv, b.conn = srv, conn
+	go srv.Serve()
+	return client, nil
+}
+
+// handleAuth checks a handshake as the bottle does, drawing a new nonce for every attempt.
+func (b *fakeBottle) handleAuth(srv *link.Server, value []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.silent {
+		return
+	}
+	status := transport.AuthSucceeded
+	key, err := service.AcceptHandshake(b.nonce[:], value)
+	if err != nil {
+		status, key = transport.AuthFailed, nil
+	} else if b.impostor {
+		key = make([]byte, len(key))
+	}
+	rand.Read(b.nonce[:])
+	if v, err := service.NonceValue(b.nonce[:]); err == nil {
+		srv.Notify(schema.Nonce.UUID, v)
+	}
+	if v, err := service.AuthConfirmation(status, key); err == nil {
+		srv.Notify(schema.Auth.UUID, v)
+	}
+}
+
+// drop severs the current connection, as if the bottle rebooted or moved out of range.
+func (b *fakeBottle) drop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.conn.Close()
+}
+
+func (b *fakeBottle) notify(uuid bluetooth.UUID, value []byte) error {
+	b.mu.Lock()
+	srv := b.srv
+	b.mu.Unlock()
+	return srv.Notify(uuid, value)
+}
+
+// newTestClient connects a client to the given bottle, retrying reconnects in quick succession. It is disconnected once the test completes.
+func newTestClient(t *testing.T, b *fakeBottle, opts ...ClientOption) *GattClient {
+	t.Helper()
+	c := New(append([]ClientOption{WithBackoff(10*time.Millisecond, 20*time.Millisecond), WithTimeout(time.Second)}, opts...)...)
+	c.dial = b.dial
+	if err := c.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Disconnect(context.Background()) })
+	return c
+}
+
+// expectEvent waits for the next connection event, which must be of the given state.
+func expectEvent(t *testing.T, c *GattClient, state ConnectionState) ConnectionEvent {
+	t.Helper()
+	select {
+	case e := <-c.Events():
+		if e.State != state {
+			t.Fatalf("Expected connection state to be '%v', got '%v' (attempt %d, error %v)", state, e.State, e.Attempt, e.Err)
+		}
+		return e
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected connection state to be '%v', got none", state)
+	}
+	return ConnectionEvent{}
+}
+
+func TestReconnect(t *testing.T) {
+	b := &fakeBottle{}
+	c := newTestClient(t, b)
+	expectEvent(t, c, StateConnected)
+	key, err := c.Auth(context.Background(), secrets.PairingPin[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.mu.Lock()
+	b.unreachable = 2
+	b.mu.Unlock()
+	b.drop()
+	if e := expectEvent(t, c, StateDisconnected); e.Err == nil {
+		t.Error("Expected disconnect to report an error")
+	}
+	start := time.Now()
+	for attempt := 1; attempt <= 3; attempt++ {
+		if e := expectEvent(t, c, StateReconnecting); e.Attempt != attempt {
+			t.Errorf("Expected reconnection attempt '%d', got '%d'", attempt, e.Attempt)
+		}
+	}
+	// The delay doubles after the first failed attempt, up to the maximum.
+	if d := time.Since(start); d < 30*time.Millisecond {
+		t.Errorf("Expected reconnection attempts to back off for at least '%v', got '%v'", 30*time.Millisecond, d)
+	}
+	e := expectEvent(t, c, StateConnected)
+	if e.Attempt != 3 {
+		t.Errorf("Expected to reconnect at attempt '%d', got '%d'", 3, e.Attempt)
+	}
+	if len(e.Key) != len(key) || bytes.Equal(e.Key, key) {
+		t.Errorf("Expected a fresh session key after reconnecting, got '%x'", e.Key)
+	}
+	if !c.Connected() {
+		t.Error("Expected client to be connected")
+	}
+
+	// Notifications are re-enabled, feeding the same queue.
+	msg := transport.Message{Type: transport.WaterLevel}
+	msg.Load([]byte("reading"))
+	if err := b.notify(schema.FillLevel.UUID, msg.MarshalBytes()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-c.Queue():
+		if !bytes.Equal(got.Value, msg.Value) {
+			t.Errorf("Expected queued message to be '%v', got '%v'", msg.Value, got.Value)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected message to be queued after reconnecting")
+	}
+}
+
+func TestReconnectIdentityMismatch(t *testing.T) {
+	b := &fakeBottle{}
+	c := newTestClient(t, b)
+	expectEvent(t, c, StateConnected)
+	if _, err := c.Auth(context.Background(), secrets.PairingPin[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	b.mu.Lock()
+	b.impostor = true
+	b.mu.Unlock()
+	b.drop()
+	expectEvent(t, c, StateDisconnected)
+	expectEvent(t, c, StateReconnecting)
+	if e := expectEvent(t, c, StateDisconnected); !errors.Is(e.Err, ErrIdentityMismatch) {
+		t.Errorf("Expected reconnecting to fail with '%v', got '%v'", ErrIdentityMismatch, e.Err)
+	}
+	select {
+	case e := <-c.Events():
+		t.Errorf("Expected client to stop reconnecting, got state '%v'", e.State)
+	case <-time.After(100 * time.Millisecond):
+	}
+	b.mu.Lock()
+	dials := b.dials
+	b.mu.Unlock()
+	if dials != 2 {
+		t.Errorf("Expected '%d' dials, got '%d'", 2, dials)
+	}
+	if c.Connected() {
+		t.Error("Expected client to remain disconnected")
+	}
+}
+
+func TestReconnectDisabled(t *testing.T) {
+	b := &fakeBottle{}
+	c := newTestClient(t, b, WithReconnect(false))
+	expectEvent(t, c, StateConnected)
+	b.drop()
+	expectEvent(t, c, StateDisconnected)
+	select {
+	case e := <-c.Events():
+		t.Errorf("Expected client not to reconnect, got state '%v'", e.State)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// failingCharacteristic fails every operation, as characteristics of a bottle which silently disappeared do.
+type failingCharacteristic struct{}
+
+var errGone = errors.New("bottle is gone")
+
+func (failingCharacteristic) UUID() bluetooth.UUID                        { return schema.Capabilities.UUID }
+func (failingCharacteristic) Read(p []byte) (int, error)                  { return 0, errGone }
+func (failingCharacteristic) WriteWithoutResponse(p []byte) (int, error)  { return 0, errGone }
+func (failingCharacteristic) EnableNotifications(fn func(p []byte)) error { return errGone }
+func (failingCharacteristic) GetMTU() (uint16, error)                     { return 0, errGone }
+
+func TestProbe(t *testing.T) {
+	c := New(WithReconnect(false))
+	c.capChar = failingCharacteristic{}
+	c.connected.Store(true)
+	go c.probe(time.Millisecond)
+	defer c.closing.Store(true)
+	if e := expectEvent(t, c, StateDisconnected); !errors.Is(e.Err, errGone) {
+		t.Errorf("Expected probe to report '%v', got '%v'", errGone, e.Err)
+	}
+	if c.Connected() {
+		t.Error("Expected client to be disconnected")
+	}
+}
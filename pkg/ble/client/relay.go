@@ -0,0 +1,150 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/toalaah/smart-bottle/pkg/ble/schema"
+	"github.com/toalaah/smart-bottle/pkg/link"
+)
+
+// Relay connects to a bottle as Init does and serves its characteristics over rw, see package link, until either side disconnects or ctx is canceled. It lets a host within range of the bottle act as a bridge for clients elsewhere, which reach it via WithBridge. Readings and commands remain encrypted end to end, so the relaying host needs neither the pin nor any keys. A client relays a single connection only and never reconnects, clients on the other side reconnect through the bridge instead. Relay returns nil once the other side closes rw.
+func (s *GattClient) Relay(ctx context.Context, rw io.ReadWriter) error {
+	s.reconnect = false
+	defer s.closing.Store(true)
+	if s.dial != nil {
+		return s.relayLink(ctx, rw)
+	}
+
+	address, err := s.find(ctx)
+	if err != nil {
+		return err
+	}
+	if err := s.adapter.Enable(); err != nil {
+		return err
+	}
+	if s.device, err = s.connect(ctx, address); err != nil {
+		return err
+	}
+	defer s.device.Disconnect()
+	services, err := s.discoverServices(ctx)
+	if err != nil {
+		return err
+	}
+	if _, ok := services[schema.Main]; !ok {
+		return fmt.Errorf("%w: %s", ErrServiceMissing, schema.Main.Name)
+	}
+	// Clients on the other side check compatibility themselves, the bridge only needs the capabilities for probing the connection.
+	if s.capChar = lookup(services[schema.Main], schema.Capabilities); s.capChar == nil {
+		return s.readCapabilities(nil)
+	}
+
+	var (
+		chars  []link.Characteristic
+		notify = map[*schema.Characteristic]characteristic{}
+	)
+	for _, decl := range schema.Services {
+		for _, c := range decl.Characteristics {
+			char, ok := services[decl][c.UUID]
+			if !ok {
+				continue
+			}
+			chars = append(chars, s.relayed(c, char))
+			if c.Flags.Notify() {
+				notify[c] = char
+			}
+		}
+	}
+	srv := link.NewServer(rw, chars, nil)
+	for decl, char := range notify {
+		err := char.EnableNotifications(func(p []byte) {
+			if err := srv.Notify(decl.UUID, p); err != nil {
+				s.debug("failed to relay notification", "characteristic", decl.Name, "error", err)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Reuse the liveness probe and disconnect handling of regular connections to notice losing the bottle.
+	lost := make(chan struct{})
+	s.mu.Lock()
+	s.onConnectionChange = func(connected bool) {
+		if !connected {
+			close(lost)
+		}
+	}
+	s.mu.Unlock()
+	s.connected.Store(true)
+	register(s)
+	defer unregister(s)
+	go s.probe(livenessInterval)
+	s.debug("relaying bottle", "address", address.String(), "id", s.deviceID)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve()
+	}()
+	select {
+	case err := <-served:
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		return err
+	case <-lost:
+		return errors.New("bottle disconnected")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// relayed relays reads and writes of the given characteristic of the bottle. Notifications are relayed separately, as they require the server to exist.
+func (s *GattClient) relayed(decl *schema.Characteristic, char characteristic) link.Characteristic {
+	c := link.Characteristic{UUID: decl.UUID}
+	if decl.Flags.Read() {
+		c.OnRead = func() ([]byte, error) {
+			buf := make([]byte, link.MaxPayload)
+			n, err := char.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			return buf[:n], nil
+		}
+	}
+	if decl.Flags.Write() || decl.Flags.WriteWithoutResponse() {
+		c.OnWrite = func(v []byte) {
+			if _, err := char.WriteWithoutResponse(v); err != nil {
+				s.debug("failed to relay write", "characteristic", decl.Name, "error", err)
+			}
+		}
+	}
+	return c
+}
+
+// relayLink relays a bottle reached over a link, which already speaks the protocol served by Relay, by copying the stream as is.
+func (s *GattClient) relayLink(ctx context.Context, rw io.ReadWriter) error {
+	rwc, err := s.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer rwc.Close()
+	s.debug("relaying bottle", "link", s.linkAddress)
+	copied := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(rwc, rw)
+		copied <- err
+	}()
+	go func() {
+		_, err := io.Copy(rw, rwc)
+		copied <- err
+	}()
+	select {
+	case err := <-copied:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/toalaah/smart-bottle/pkg/build"
+	"github.com/toalaah/smart-bottle/pkg/transport"
+	"tinygo.org/x/bluetooth"
+)
+
+// Bottle describes a bottle discovered while scanning.
+type Bottle struct {
+	Address bluetooth.Address
+	Name    string
+	// ID doubles as the bottle's serial number.
+	ID   transport.DeviceID
+	RSSI int16
+	// Capabilities advertised by the bottle, without payload formats. Nil if the bottle currently advertises something else, e.g. broadcasts.
+	Capabilities *transport.Capabilities
+}
+
+// Scan scans for bottles matching the client's target filters for the given duration, or until ctx is done if the duration is zero. Every advertisement received is sent to the returned channel, which is closed once scanning stops. Advertisements are dropped if not consumed in time.
+func (s *GattClient) Scan(ctx context.Context, d time.Duration) (<-chan Bottle, error) {
+	s.debug("enabling adapter")
+	if err := s.adapter.Enable(); err != nil {
+		return nil, err
+	}
+	cancel := func() {}
+	if d > 0 {
+		ctx, cancel = context.WithTimeout(ctx, d)
+	}
+
+	bottles := make(chan Bottle, 16)
+	done := make(chan struct{})
+	go func() {
+		defer cancel()
+		select {
+		case <-ctx.Done():
+			s.adapter.StopScan()
+		case <-done:
+		}
+	}()
+	go func() {
+		defer close(bottles)
+		defer close(done)
+		s.debug("scanning...")
+		err := s.adapter.Scan(func(adapter *bluetooth.Adapter, result bluetooth.ScanResult) {
+			if ctx.Err() != nil {
+				// Scanning may have been requested to stop before it started.
+				adapter.StopScan()
+				return
+			}
+			if b, ok := s.bottle(result); ok {
+				select {
+				case bottles <- b:
+				default:
+				}
+			}
+		})
+		if err != nil {
+			s.debug("scanning failed", "error", err)
+		}
+	}()
+	return bottles, nil
+}
+
+// bottle checks whether the given scan result was advertised by a bottle matching the client's target filters.
+func (s *GattClient) bottle(result bluetooth.ScanResult) (Bottle, bool) {
+	if result.LocalName() != build.ServiceName {
+		return Bottle{}, false
+	}
+	for _, d := range result.ManufacturerData() {
+		id, ok := s.matches(result.Address, d)
+		if !ok {
+			continue
+		}
+		b := Bottle{Address: result.Address, Name: result.LocalName(), ID: id, RSSI: result.RSSI}
+		if _, typ, payload, _ := transport.UnmarshalManufacturerData(d.Data); typ == transport.AdvertisementCapabilities {
+			caps := transport.Capabilities{}
+			if err := transport.UnmarshalAdvertisedCapabilities(&caps, payload); err == nil {
+				b.Capabilities = &caps
+			}
+		}
+		s.debug("found bottle", "name", b.Name, "address", b.Address.String(), "id", b.ID, "rssi", b.RSSI)
+		return b, true
+	}
+	return Bottle{}, false
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package client
+
+import (
+	"errors"
+	"io"
+)
+
+func openSerial(path string) (io.ReadWriteCloser, error) {
+	return nil, errors.New("serial links are only supported on Linux")
+}
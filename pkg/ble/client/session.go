@@ -0,0 +1,261 @@
+package client
+
+import (
+	"context"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/toalaah/smart-bottle/pkg/crypto"
+	"github.com/toalaah/smart-bottle/pkg/transport"
+)
+
+// ErrInvalidReading is reported on a session's error channel for readings which fail to decrypt or hold implausible values.
+var ErrInvalidReading = errors.New("invalid reading")
+
+// Reading is a decrypted and validated reading received from a bottle.
+type Reading struct {
+	Device transport.DeviceID
+	// Historic reports whether the reading was replayed by the bottle in response to Sync rather than notified as it was captured.
+	Historic bool
+	transport.Reading
+}
+
+// Session owns the cipher negotiated while authenticating with a bottle and decrypts everything the bottle sends, so that applications never handle keys or ciphertext themselves. If the connection is lost and resumed, the session picks up the new key and requests the readings missed in the meantime.
+type Session struct {
+	c        *GattClient
+	device   transport.DeviceID
+	mu       sync.RWMutex
+	gcm      cipher.AEAD
+	readings chan Reading
+	logs     chan transport.LogEntry
+	errors   chan error
+	lastSeq  atomic.Uint32
+	// liveFrom is the sequence number of the first live reading received since the latest Sync, or -1. The bottle's replay includes the readings captured after the request, which are dropped from then on as they have been delivered live already.
+	liveFrom atomic.Int64
+	done     chan struct{}
+	once     sync.Once
+}
+
+// NewSession authenticates with the bottle using the given pin and starts decrypting its readings. The client's Queue and Logs must not be consumed elsewhere afterwards.
+func (s *GattClient) NewSession(ctx context.Context, pin []byte) (*Session, error) {
+	key, err := s.Auth(ctx, pin)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := crypto.NewGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	sess := &Session{
+		c:        s,
+		device:   s.DeviceID(),
+		gcm:      gcm,
+		readings: make(chan Reading, s.queueSize),
+		logs:     make(chan transport.LogEntry, cap(s.logs)),
+		errors:   make(chan error, 8),
+		done:     make(chan struct{}),
+	}
+	sess.liveFrom.Store(-1)
+	s.session.Store(sess)
+	go sess.pumpReadings()
+	go sess.pumpLogs()
+	return sess, nil
+}
+
+// Readings returns a channel of decrypted readings, which is closed once the session is closed.
+func (s *Session) Readings() <-chan Reading {
+	return s.readings
+}
+
+// Logs returns a channel of decrypted log entries streamed after calling StreamLogs.
+func (s *Session) Logs() <-chan transport.LogEntry {
+	return s.logs
+}
+
+// Errors returns a channel of readings and log entries which were discarded, wrapping ErrInvalidReading or ErrMalformedFrame. Errors are dropped if not consumed in time.
+func (s *Session) Errors() <-chan error {
+	return s.errors
+}
+
+// LastSeq returns the highest sequence number received so far, which readings are requested from after reconnecting.
+func (s *Session) LastSeq() uint32 {
+	return s.lastSeq.Load()
+}
+
+// Sync requests all readings buffered by the bottle following the given sequence number. Readings received before are not requested again after reconnecting.
+func (s *Session) Sync(since uint32) error {
+	s.observe(since)
+	s.liveFrom.Store(-1)
+	return s.c.Sync(s.cipher(), since)
+}
+
+// SendCommand encrypts a command and writes it to the bottle.
+func (s *Session) SendCommand(cmd *transport.Command) error {
+	return s.c.SendCommand(s.cipher(), cmd)
+}
+
+// SetConnectionMode requests the bottle to switch to the connection parameters of the given mode.
+func (s *Session) SetConnectionMode(mode transport.ConnectionMode) error {
+	return s.c.SetConnectionMode(s.cipher(), mode)
+}
+
+// StreamLogs requests the bottle to stream its log lines at or above the given level. They are delivered to Logs.
+func (s *Session) StreamLogs(level slog.Level) error {
+	return s.c.StreamLogs(s.cipher(), level)
+}
+
+// StopLogs requests the bottle to stop streaming log lines.
+func (s *Session) StopLogs() error {
+	return s.c.StopLogs(s.cipher())
+}
+
+// Diagnostics reads and decrypts the bottle's most recent health report.
+func (s *Session) Diagnostics() (transport.Diagnostics, error) {
+	return s.c.Diagnostics(s.cipher())
+}
+
+// Close stops decrypting and closes the readings channel. It does not disconnect the client.
+func (s *Session) Close() {
+	s.once.Do(func() {
+		s.c.session.CompareAndSwap(s, nil)
+		close(s.done)
+	})
+}
+
+// resume swaps in the cipher derived from the key obtained after reconnecting and requests the readings missed while disconnected.
+func (s *Session) resume(key []byte) {
+	gcm, err := crypto.NewGCM(key)
+	if err != nil {
+		s.c.debug("failed to recreate session cipher", "error", err)
+		return
+	}
+	s.mu.Lock()
+	s.gcm = gcm
+	s.mu.Unlock()
+	if !s.c.Capabilities().Features.Has(transport.FeatureBatching) {
+		return
+	}
+	if err := s.Sync(s.LastSeq()); err != nil {
+		s.c.debug("failed to request buffered readings", "error", err)
+	}
+}
+
+func (s *Session) cipher() cipher.AEAD {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.gcm
+}
+
+// observe raises the last sequence number to seq.
+func (s *Session) observe(seq uint32) {
+	for {
+		last := s.lastSeq.Load()
+		if seq <= last || s.lastSeq.CompareAndSwap(last, seq) {
+			return
+		}
+	}
+}
+
+func (s *Session) pumpReadings() {
+	defer close(s.readings)
+	for {
+		var msg transport.Message
+		select {
+		case <-s.done:
+			return
+		case msg = <-s.c.c:
+		}
+		if msg.Type != transport.WaterLevel && msg.Type != transport.History {
+			continue
+		}
+		r, err := s.decryptReading(msg)
+		if err != nil {
+			s.report(err)
+			continue
+		}
+		if s.duplicate(r) {
+			s.c.debug("dropping replayed reading which was delivered live", "seq", r.Seq)
+			continue
+		}
+		s.observe(r.Seq)
+		select {
+		case <-s.done:
+			return
+		case s.readings <- r:
+		}
+	}
+}
+
+// duplicate reports whether the given reading was replayed by the bottle after having been delivered live, see liveFrom.
+func (s *Session) duplicate(r Reading) bool {
+	if !r.Historic {
+		s.liveFrom.CompareAndSwap(-1, int64(r.Seq))
+		return false
+	}
+	from := s.liveFrom.Load()
+	return from >= 0 && int64(r.Seq) >= from
+}
+
+func (s *Session) decryptReading(msg transport.Message) (Reading, error) {
+	r := Reading{Device: s.device, Historic: msg.Type == transport.History}
+	gcm := s.cipher()
+	if len(msg.Value) != gcm.NonceSize()+transport.ReadingLen+gcm.Overhead() {
+		return r, fmt.Errorf("%w: unexpected length %d", ErrInvalidReading, len(msg.Value))
+	}
+	buf := [transport.ReadingLen]byte{}
+	if err := crypto.DecryptAES(gcm, msg.Value, buf[:]); err != nil {
+		return r, fmt.Errorf("%w: %w", ErrInvalidReading, err)
+	}
+	if err := transport.UnmarshalReading(&r.Reading, buf[:]); err != nil {
+		return r, fmt.Errorf("%w: %w", ErrInvalidReading, err)
+	}
+	// The sensor reports distances, which are never negative.
+	if v := float64(r.Value); math.IsNaN(v) || math.IsInf(v, 0) || v < 0 {
+		return r, fmt.Errorf("%w: implausible value %v for seq %d", ErrInvalidReading, r.Value, r.Seq)
+	}
+	return r, nil
+}
+
+func (s *Session) pumpLogs() {
+	for {
+		var msg transport.Message
+		select {
+		case <-s.done:
+			return
+		case msg = <-s.c.logs:
+		}
+		gcm := s.cipher()
+		n := len(msg.Value) - gcm.NonceSize() - gcm.Overhead()
+		if n < 0 {
+			s.report(fmt.Errorf("%w: log entry is too short", ErrMalformedFrame))
+			continue
+		}
+		buf := make([]byte, n)
+		if err := crypto.DecryptAES(gcm, msg.Value, buf); err != nil {
+			s.report(fmt.Errorf("failed to decrypt log entry: %w", err))
+			continue
+		}
+		e := transport.LogEntry{}
+		if err := transport.UnmarshalLogEntry(&e, buf); err != nil {
+			s.report(fmt.Errorf("failed to unmarshal log entry: %w", err))
+			continue
+		}
+		select {
+		case s.logs <- e:
+		default:
+		}
+	}
+}
+
+func (s *Session) report(err error) {
+	s.c.debug("discarding message", "error", err)
+	select {
+	case s.errors <- err:
+	default:
+	}
+}
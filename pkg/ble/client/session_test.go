@@ -0,0 +1,105 @@
+package client
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/toalaah/smart-bottle/pkg/crypto"
+	"github.com/toalaah/smart-bottle/pkg/transport"
+)
+
+var sessionKey = []byte("0123456789abcdef0123456789abcdef")
+
+// newTestSession returns a session decrypting with sessionKey, whose readings are pumped from the client's queue.
+func newTestSession(t *testing.T) *Session {
+	t.Helper()
+	gcm, err := crypto.NewGCM(sessionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New()
+	s := &Session{c: c, gcm: gcm, readings: make(chan Reading, c.queueSize), errors: make(chan error, 8), done: make(chan struct{})}
+	s.liveFrom.Store(-1)
+	return s
+}
+
+// sealReading encrypts a reading as the bottle does.
+func sealReading(t *testing.T, key []byte, typ transport.MessageType, r transport.Reading) transport.Message {
+	t.Helper()
+	gcm, err := crypto.NewGCM(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make([]byte, gcm.NonceSize()+transport.ReadingLen+gcm.Overhead())
+	if err := crypto.EncryptAES(gcm, r.MarshalBytes(), out); err != nil {
+		t.Fatal(err)
+	}
+	msg := transport.Message{Type: typ}
+	msg.Load(out)
+	return msg
+}
+
+func TestDecryptReading(t *testing.T) {
+	s := newTestSession(t)
+	want := transport.Reading{Seq: 42, Timestamp: 1735689600, Value: 12.5}
+	r, err := s.decryptReading(sealReading(t, sessionKey, transport.History, want))
+	if err != nil {
+		t.Fatalf("Expected nil error decrypting reading, got %s", err)
+	}
+	if r.Reading != want || !r.Historic {
+		t.Errorf("Expected historic reading '%+v', got '%+v'", want, r)
+	}
+
+	truncated := sealReading(t, sessionKey, transport.WaterLevel, want)
+	truncated.Load(truncated.Value[:len(truncated.Value)-1])
+	for name, msg := range map[string]transport.Message{
+		"truncated": truncated,
+		"wrong key": sealReading(t, []byte("fedcba9876543210fedcba9876543210"), transport.WaterLevel, want),
+		"NaN":       sealReading(t, sessionKey, transport.WaterLevel, transport.Reading{Seq: 1, Value: float32(math.NaN())}),
+		"infinite":  sealReading(t, sessionKey, transport.WaterLevel, transport.Reading{Seq: 1, Value: float32(math.Inf(1))}),
+		"negative":  sealReading(t, sessionKey, transport.WaterLevel, transport.Reading{Seq: 1, Value: -1}),
+	} {
+		if _, err := s.decryptReading(msg); !errors.Is(err, ErrInvalidReading) {
+			t.Errorf("Expected %s reading to return '%v', got '%v'", name, ErrInvalidReading, err)
+		}
+	}
+}
+
+func TestSessionDropsReplayedReadings(t *testing.T) {
+	s := newTestSession(t)
+	go s.pumpReadings()
+	defer s.Close()
+
+	// The bottle was disconnected after reading 1 and notifies reading 4 live before replaying 2 to 5.
+	s.c.c <- sealReading(t, sessionKey, transport.WaterLevel, transport.Reading{Seq: 1})
+	expect(t, s, 1, false)
+	// As requested by Sync after reconnecting, without a bottle to send the command to.
+	s.liveFrom.Store(-1)
+	s.c.c <- sealReading(t, sessionKey, transport.WaterLevel, transport.Reading{Seq: 4})
+	for seq := uint32(2); seq <= 5; seq++ {
+		s.c.c <- sealReading(t, sessionKey, transport.History, transport.Reading{Seq: seq})
+	}
+	s.c.c <- sealReading(t, sessionKey, transport.WaterLevel, transport.Reading{Seq: 5})
+	expect(t, s, 4, false)
+	expect(t, s, 2, true)
+	expect(t, s, 3, true)
+	expect(t, s, 5, false)
+	if seq := s.LastSeq(); seq != 5 {
+		t.Errorf("Expected last seq to be '%v', got '%v'", 5, seq)
+	}
+}
+
+// expect fails the test unless the next reading of the session has the given sequence number.
+func expect(t *testing.T, s *Session, seq uint32, historic bool) {
+	t.Helper()
+	select {
+	case r := <-s.Readings():
+		if r.Seq != seq || r.Historic != historic {
+			t.Errorf("Expected reading with seq '%v' (historic %v), got '%v' (historic %v)", seq, historic, r.Seq, r.Historic)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected reading with seq '%v'", seq)
+	}
+}
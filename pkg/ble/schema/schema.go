@@ -0,0 +1,143 @@
+// Package schema declares the bottle's GATT services and characteristics. The service registers characteristics from it, while the client discovers and validates them against it, so that both sides cannot drift apart.
+package schema
+
+import (
+	"fmt"
+
+	"github.com/toalaah/smart-bottle/pkg/ota"
+	"github.com/toalaah/smart-bottle/pkg/transport"
+	"tinygo.org/x/bluetooth"
+)
+
+// Payload describes how the value of a characteristic is encoded.
+type Payload uint8
+
+const (
+	PayloadBytes Payload = iota
+	// UTF-8 string without terminator.
+	PayloadString
+	// Single unsigned byte, e.g. a percentage or an alert level.
+	PayloadUint8
+	// Signed 16-bit little endian integer in units of 0.01 degrees Celsius.
+	PayloadTemperature
+	// Current Time characteristic value, see transport.MarshalCurrentTime.
+	PayloadCurrentTime
+	// Framed transport.Message with a plaintext value.
+	PayloadMessage
+	// Framed transport.Message whose value is encrypted with the session key, see crypto.EncryptAES.
+	PayloadEncryptedMessage
+	// Ciphertext of the ephemeral-static X25519 handshake, see crypto.EncryptEphemeralStaticX25519.
+	PayloadHandshake
+	// Firmware update control operation, chunk and status, see package ota.
+	PayloadOTAControl
+	PayloadOTAChunk
+	PayloadOTAStatus
+	// Protocol version, features and payload formats, see transport.Capabilities.
+	PayloadCapabilities
+)
+
+// Characteristic declares a characteristic of a service.
+type Characteristic struct {
+	Name    string
+	UUID    bluetooth.UUID
+	Flags   bluetooth.CharacteristicPermissions
+	Payload Payload
+	// Maximum length of the value, which the bottle allocates up front. Zero if it depends on the bottle's configuration, e.g. its TX buffer size.
+	Size int
+	// Authenticated characteristics ignore writes from clients which have not yet authenticated, and only carry values for authenticated clients.
+	Authenticated bool
+	// Optional characteristics are only exposed if the respective feature is enabled on the bottle.
+	Optional bool
+}
+
+// ValidateValue checks a value written by a client against the characteristic's declared payload and size, so that handlers only ever see well-formed values.
+func (c *Characteristic) ValidateValue(v []byte) error {
+	if c.Size > 0 && len(v) > c.Size {
+		return fmt.Errorf("%s value exceeds %d bytes, got %d", c.Name, c.Size, len(v))
+	}
+	var err error
+	switch c.Payload {
+	case PayloadUint8:
+		if len(v) != 1 {
+			err = fmt.Errorf("expected single byte, got %d", len(v))
+		}
+	case PayloadCurrentTime:
+		_, err = transport.UnmarshalCurrentTime(v)
+	case PayloadMessage, PayloadEncryptedMessage:
+		err = transport.UnmarshalBytes(&transport.Message{}, v)
+	case PayloadHandshake, PayloadOTAControl:
+		if len(v) == 0 {
+			err = fmt.Errorf("expected non-empty value")
+		}
+	case PayloadOTAChunk:
+		_, _, err = ota.UnmarshalChunk(v)
+	}
+	if err != nil {
+		return fmt.Errorf("malformed %s value: %w", c.Name, err)
+	}
+	return nil
+}
+
+// Service declares a GATT service and its characteristics.
+type Service struct {
+	Name            string
+	UUID            bluetooth.UUID
+	Characteristics []*Characteristic
+	// Optional services are only exposed if the respective feature is enabled on the bottle.
+	Optional bool
+}
+
+// Characteristic returns the declared characteristic with the given UUID, if any.
+func (s *Service) Characteristic(uuid bluetooth.UUID) *Characteristic {
+	for _, c := range s.Characteristics {
+		if c.UUID == uuid {
+			return c
+		}
+	}
+	return nil
+}
+
+// UUIDs returns the UUIDs of all declared characteristics.
+func (s *Service) UUIDs() []bluetooth.UUID {
+	uuids := make([]bluetooth.UUID, len(s.Characteristics))
+	for i, c := range s.Characteristics {
+		uuids[i] = c.UUID
+	}
+	return uuids
+}
+
+// Validate checks the characteristics discovered on a bottle against the declaration, returning an error if a required characteristic is missing.
+func (s *Service) Validate(found []bluetooth.UUID) error {
+	for _, c := range s.Characteristics {
+		if c.Optional {
+			continue
+		}
+		ok := false
+		for _, uuid := range found {
+			ok = ok || uuid == c.UUID
+		}
+		if !ok {
+			return fmt.Errorf("%s service is missing required %s characteristic %s", s.Name, c.Name, c.UUID.String())
+		}
+	}
+	return nil
+}
+
+// Lookup returns the declared service with the given UUID, if any.
+func Lookup(uuid bluetooth.UUID) *Service {
+	for _, s := range Services {
+		if s.UUID == uuid {
+			return s
+		}
+	}
+	return nil
+}
+
+// vendorBase is the base of the bottle's vendor-specific 128-bit UUIDs, 5b07xxxx-0c3e-4f6a-9d2b-8e1f4a7c3d60. Services and characteristics are distinguished by the 16 bits following the first two bytes.
+var vendorBase = [16]byte{0x5b, 0x07, 0x00, 0x00, 0x0c, 0x3e, 0x4f, 0x6a, 0x9d, 0x2b, 0x8e, 0x1f, 0x4a, 0x7c, 0x3d, 0x60}
+
+func vendorUUID(short uint16) bluetooth.UUID {
+	b := vendorBase
+	b[2], b[3] = byte(short>>8), byte(short)
+	return bluetooth.NewUUID(b)
+}
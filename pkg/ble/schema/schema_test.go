@@ -0,0 +1,78 @@
+package schema
+
+import (
+	"testing"
+
+	"tinygo.org/x/bluetooth"
+)
+
+func TestUniqueUUIDs(t *testing.T) {
+	seen := map[bluetooth.UUID]string{}
+	for _, s := range Services {
+		if name, ok := seen[s.UUID]; ok {
+			t.Errorf("Expected UUID of %s service to be unique, got duplicate of '%v'", s.Name, name)
+		}
+		seen[s.UUID] = s.Name
+		for _, c := range s.Characteristics {
+			if name, ok := seen[c.UUID]; ok {
+				t.Errorf("Expected UUID of %s characteristic to be unique, got duplicate of '%v'", c.Name, name)
+			}
+			seen[c.UUID] = c.Name
+		}
+	}
+}
+
+func TestVendorUUID(t *testing.T) {
+	expected := "5b070100-0c3e-4f6a-9d2b-8e1f4a7c3d60"
+	if got := Main.UUID.String(); got != expected {
+		t.Errorf("Expected main service UUID to be '%v', got '%v'", expected, got)
+	}
+	if Main.UUID.Is16Bit() || Main.UUID.Is32Bit() {
+		t.Errorf("Expected main service UUID to be a 128-bit vendor UUID, got '%v'", Main.UUID.String())
+	}
+}
+
+func TestValidate(t *testing.T) {
+	// A bottle built without authentication exposes neither the nonce nor the auth characteristic.
+	found := []bluetooth.UUID{FillLevel.UUID, Command.UUID, Diagnostics.UUID, Log.UUID, Capabilities.UUID}
+	if err := Main.Validate(found); err != nil {
+		t.Errorf("Expected validation without optional characteristics to succeed, got '%v'", err)
+	}
+	// Bottles predating capabilities are recognized as such by clients rather than failing validation.
+	if err := Main.Validate(found[:len(found)-1]); err != nil {
+		t.Errorf("Expected validation without capabilities characteristic to succeed, got '%v'", err)
+	}
+	if err := Main.Validate(found[1:]); err == nil {
+		t.Errorf("Expected validation without fill level characteristic to fail, got '%v'", err)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	if s := Lookup(bluetooth.ServiceUUIDBattery); s != Battery {
+		t.Errorf("Expected lookup of battery service UUID to be '%v', got '%v'", Battery.Name, s)
+	}
+	if s := Lookup(bluetooth.ServiceUUIDHeartRate); s != nil {
+		t.Errorf("Expected lookup of undeclared service to be '%v', got '%v'", nil, s)
+	}
+}
+
+func TestValidateValue(t *testing.T) {
+	for _, tc := range []struct {
+		c     *Characteristic
+		value []byte
+		ok    bool
+	}{
+		{AlertLevel, []byte{1}, true},
+		{AlertLevel, []byte{}, false},
+		{AlertLevel, []byte{1, 2}, false},
+		{Command, []byte{0x02, 2, 0xaa, 0xbb}, true},
+		{Command, []byte{0x02, 3, 0xaa}, false},
+		{CurrentTime, make([]byte, 4), false},
+		{Auth, []byte{}, false},
+		{OTAData, []byte{0, 0}, false},
+	} {
+		if err := tc.c.ValidateValue(tc.value); (err == nil) != tc.ok {
+			t.Errorf("Expected validating %s value '%v' to succeed to be '%v', got '%v'", tc.c.Name, tc.value, tc.ok, err)
+		}
+	}
+}
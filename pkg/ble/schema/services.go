@@ -0,0 +1,121 @@
+package schema
+
+import (
+	"github.com/toalaah/smart-bottle/pkg/ota"
+	"github.com/toalaah/smart-bottle/pkg/remotelog"
+	"github.com/toalaah/smart-bottle/pkg/transport"
+	"tinygo.org/x/bluetooth"
+)
+
+const (
+	read        = bluetooth.CharacteristicReadPermission
+	write       = bluetooth.CharacteristicWritePermission | bluetooth.CharacteristicWriteWithoutResponsePermission
+	notify      = bluetooth.CharacteristicNotifyPermission
+	writeNoResp = bluetooth.CharacteristicWriteWithoutResponsePermission
+)
+
+// Device Information Service
+var (
+	ManufacturerName = &Characteristic{Name: "manufacturer name", UUID: bluetooth.CharacteristicUUIDManufacturerNameString, Flags: read, Payload: PayloadString}
+	FirmwareRevision = &Characteristic{Name: "firmware revision", UUID: bluetooth.CharacteristicUUIDFirmwareRevisionString, Flags: read, Payload: PayloadString}
+	ModelNumber      = &Characteristic{Name: "model number", UUID: bluetooth.CharacteristicUUIDModelNumberString, Flags: read, Payload: PayloadString}
+	HardwareRevision = &Characteristic{Name: "hardware revision", UUID: bluetooth.CharacteristicUUIDHardwareRevisionString, Flags: read, Payload: PayloadString}
+	SerialNumber     = &Characteristic{Name: "serial number", UUID: bluetooth.CharacteristicUUIDSerialNumberString, Flags: read, Payload: PayloadString}
+
+	DeviceInformation = &Service{
+		Name:            "device information",
+		UUID:            bluetooth.ServiceUUIDDeviceInformation,
+		Characteristics: []*Characteristic{ManufacturerName, FirmwareRevision, ModelNumber, HardwareRevision, SerialNumber},
+	}
+)
+
+// Main transport service
+var (
+	// Readings are notified on the fill level characteristic, its size depends on the bottle's TX buffer size.
+	FillLevel = &Characteristic{Name: "fill level", UUID: vendorUUID(0x0101), Flags: read | notify, Payload: PayloadEncryptedMessage, Authenticated: true}
+	Command   = &Characteristic{Name: "command", UUID: vendorUUID(0x0102), Flags: write, Payload: PayloadEncryptedMessage, Authenticated: true}
+	// Fits an encrypted diagnostics report including a firmware version of reasonable length.
+	Diagnostics = &Characteristic{Name: "diagnostics", UUID: vendorUUID(0x0103), Flags: read, Payload: PayloadEncryptedMessage, Size: 96, Authenticated: true}
+	// Fits an encrypted log entry of maximum length, see remotelog.MaxLineLen.
+	Log   = &Characteristic{Name: "log", UUID: vendorUUID(0x0104), Flags: read | notify, Payload: PayloadEncryptedMessage, Size: 2 + 12 + 4 + remotelog.MaxLineLen + 16, Authenticated: true}
+	Nonce = &Characteristic{Name: "nonce", UUID: vendorUUID(0x0105), Flags: read, Payload: PayloadMessage, Optional: true}
+	// Handshakes are written to the auth characteristic, which notifies their outcome as a transport.AuthStatus.
+	Auth = &Characteristic{Name: "auth", UUID: vendorUUID(0x0106), Flags: write | notify, Payload: PayloadHandshake, Optional: true}
+	// Readable before authenticating, so that clients can bail out before attempting a handshake they do not understand. Only optional in that bottles predating it lack it, which clients refuse as speaking protocol version 0.
+	Capabilities = &Characteristic{Name: "capabilities", UUID: vendorUUID(0x0107), Flags: read, Payload: PayloadCapabilities, Size: transport.CapabilitiesLen, Optional: true}
+	// Presents the bottle's static X25519 public key, which handshakes are encrypted to. Clients pin it on first use.
+	Identity = &Characteristic{Name: "identity", UUID: vendorUUID(0x0108), Flags: read, Payload: PayloadBytes, Size: 32, Optional: true}
+
+	Main = &Service{
+		Name:            "bottle",
+		UUID:            vendorUUID(0x0100),
+		Characteristics: []*Characteristic{FillLevel, Command, Diagnostics, Log, Nonce, Auth, Capabilities, Identity},
+	}
+)
+
+// Current Time Service
+var (
+	CurrentTime = &Characteristic{Name: "current time", UUID: bluetooth.CharacteristicUUIDCurrentTime, Flags: read | write | notify, Payload: PayloadCurrentTime, Size: transport.CurrentTimeLen, Authenticated: true}
+
+	CurrentTimeService = &Service{
+		Name:            "current time",
+		UUID:            bluetooth.ServiceUUIDCurrentTime,
+		Characteristics: []*Characteristic{CurrentTime},
+	}
+)
+
+// Battery Service
+var (
+	BatteryLevel = &Characteristic{Name: "battery level", UUID: bluetooth.CharacteristicUUIDBatteryLevel, Flags: read | notify, Payload: PayloadUint8, Size: 1}
+
+	Battery = &Service{
+		Name:            "battery",
+		UUID:            bluetooth.ServiceUUIDBattery,
+		Characteristics: []*Characteristic{BatteryLevel},
+		Optional:        true,
+	}
+)
+
+// Immediate Alert Service
+var (
+	AlertLevel = &Characteristic{Name: "alert level", UUID: bluetooth.CharacteristicUUIDAlertLevel, Flags: writeNoResp, Payload: PayloadUint8, Size: 1, Authenticated: true}
+
+	ImmediateAlert = &Service{
+		Name:            "immediate alert",
+		UUID:            bluetooth.ServiceUUIDImmediateAlert,
+		Characteristics: []*Characteristic{AlertLevel},
+		Optional:        true,
+	}
+)
+
+// Firmware update service
+var (
+	OTAControl = &Characteristic{Name: "firmware update control", UUID: vendorUUID(0x0201), Flags: write, Payload: PayloadOTAControl, Size: 1 + ota.HeaderLen, Authenticated: true}
+	// Chunks fill the bottle's TX buffer.
+	OTAData   = &Characteristic{Name: "firmware update data", UUID: vendorUUID(0x0202), Flags: write, Payload: PayloadOTAChunk, Authenticated: true}
+	OTAStatus = &Characteristic{Name: "firmware update status", UUID: vendorUUID(0x0203), Flags: read | notify, Payload: PayloadOTAStatus, Size: ota.StatusLen}
+
+	Firmware = &Service{
+		Name:            "firmware update",
+		UUID:            vendorUUID(0x0200),
+		Characteristics: []*Characteristic{OTAControl, OTAData, OTAStatus},
+		Optional:        true,
+	}
+)
+
+// Environmental Sensing Service, exposing readings to generic GATT tools in public mode. The stack adds the CCCD to notifying characteristics by itself, but other descriptors such as ES Measurement or Valid Range cannot be declared via the bluetooth package, so consumers relying on them will not recognize the characteristics.
+var (
+	// Percentage 8 characteristic, not (yet) part of the bluetooth package's assigned numbers.
+	Percentage8 = &Characteristic{Name: "fill level percentage", UUID: bluetooth.New16BitUUID(0x2B04), Flags: read | notify, Payload: PayloadUint8, Size: 1}
+	Temperature = &Characteristic{Name: "temperature", UUID: bluetooth.CharacteristicUUIDTemperature, Flags: read | notify, Payload: PayloadTemperature, Size: 2}
+
+	EnvironmentalSensing = &Service{
+		Name:            "environmental sensing",
+		UUID:            bluetooth.ServiceUUIDEnvironmentalSensing,
+		Characteristics: []*Characteristic{Percentage8, Temperature},
+		Optional:        true,
+	}
+)
+
+// Services lists all services a bottle may expose.
+var Services = []*Service{DeviceInformation, Main, CurrentTimeService, Battery, ImmediateAlert, Firmware, EnvironmentalSensing}
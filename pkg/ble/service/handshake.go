@@ -0,0 +1,52 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/toalaah/smart-bottle/pkg/build"
+	"github.com/toalaah/smart-bottle/pkg/build/secrets"
+	"github.com/toalaah/smart-bottle/pkg/crypto"
+	"github.com/toalaah/smart-bottle/pkg/transport"
+)
+
+// ErrHandshake is returned by AcceptHandshake for handshakes which do not carry the bottle's nonce and pairing pin.
+var ErrHandshake = errors.New("handshake does not match nonce and pin")
+
+// NonceValue returns the value of the nonce characteristic, which holds the given nonce encrypted to the user's public key.
+func NonceValue(nonce []byte) ([]byte, error) {
+	encNonce, err := crypto.EncryptEphemeralStaticX25519(nonce, secrets.UserPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	msg := transport.Message{Type: transport.Nonce}
+	msg.Load(encNonce)
+	return msg.MarshalBytes(), nil
+}
+
+// AcceptHandshake decrypts a handshake written to the auth characteristic and checks it against the given nonce and the pairing pin, returning the session key derived from the nonce and the secret appended by the client. Handshakes without a secret, as sent by clients predating transport.KeyAgreementVersion, are rejected, as their key would be the nonce itself.
+func AcceptHandshake(nonce, value []byte) ([]byte, error) {
+	payload, err := crypto.DecryptEphemeralStaticX25519(value, secrets.BottlePrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	expected := append(append([]byte{}, nonce...), secrets.PairingPin[:]...)
+	secret := payload[min(len(expected), len(payload)):]
+	if !bytes.HasPrefix(payload, expected) || len(secret) != build.NonceLen {
+		return nil, ErrHandshake
+	}
+	return crypto.DeriveKey(append(append([]byte{}, nonce...), secret...), crypto.SessionKeyLabel)
+}
+
+// AuthConfirmation returns the value notified on the auth characteristic to confirm the outcome of a handshake. Successful handshakes are confirmed along with a tag derived from the agreed key, proving to the client that the bottle could decrypt its secret and thus holds the private key to its identity.
+func AuthConfirmation(status transport.AuthStatus, key []byte) ([]byte, error) {
+	v := []byte{byte(status)}
+	if key == nil {
+		return v, nil
+	}
+	tag, err := crypto.KeyConfirmation(key)
+	if err != nil {
+		return nil, err
+	}
+	return append(v, tag...), nil
+}
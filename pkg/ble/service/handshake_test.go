@@ -0,0 +1,72 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/toalaah/smart-bottle/pkg/build/secrets"
+	"github.com/toalaah/smart-bottle/pkg/crypto"
+	"github.com/toalaah/smart-bottle/pkg/transport"
+)
+
+func handshake(t *testing.T, parts ...[]byte) []byte {
+	t.Helper()
+	v, err := crypto.EncryptEphemeralStaticX25519(bytes.Join(parts, nil), secrets.BottlePublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestAcceptHandshake(t *testing.T) {
+	nonce := bytes.Repeat([]byte{1}, 32)
+	secret := bytes.Repeat([]byte{2}, 32)
+
+	key, err := AcceptHandshake(nonce, handshake(t, nonce, secrets.PairingPin[:], secret))
+	if err != nil {
+		t.Fatalf("Expected nil error accepting handshake, got %s", err)
+	}
+	expected, err := crypto.DeriveKey(append(append([]byte{}, nonce...), secret...), crypto.SessionKeyLabel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, expected) {
+		t.Errorf("Expected session key to be derived from nonce and secret, got '%x'", key)
+	}
+
+	for name, v := range map[string][]byte{
+		"wrong nonce":      handshake(t, secret, secrets.PairingPin[:], secret),
+		"wrong pin":        handshake(t, nonce, []byte{0, 0, 0, 0}, secret),
+		"truncated":        handshake(t, nonce[:16]),
+		"truncated secret": handshake(t, nonce, secrets.PairingPin[:], secret[:16]),
+		// Clients predating key agreement would use the nonce as key.
+		"no secret": handshake(t, nonce, secrets.PairingPin[:]),
+	} {
+		if _, err := AcceptHandshake(nonce, v); !errors.Is(err, ErrHandshake) {
+			t.Errorf("Expected handshake with %s to return '%v', got '%v'", name, ErrHandshake, err)
+		}
+	}
+	if _, err := AcceptHandshake(nonce, []byte("garbage")); err == nil {
+		t.Error("Expected error accepting handshake which cannot be decrypted")
+	}
+}
+
+func TestAuthConfirmation(t *testing.T) {
+	v, err := AuthConfirmation(transport.AuthFailed, nil)
+	if err != nil || !bytes.Equal(v, []byte{byte(transport.AuthFailed)}) {
+		t.Errorf("Expected failed handshake to be confirmed by status only, got '%v' and '%v'", v, err)
+	}
+	key := bytes.Repeat([]byte{3}, 32)
+	v, err = AuthConfirmation(transport.AuthSucceeded, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, err := crypto.KeyConfirmation(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v[0] != byte(transport.AuthSucceeded) || !bytes.Equal(v[1:], tag) {
+		t.Errorf("Expected successful handshake to be confirmed with key confirmation tag, got '%v'", v)
+	}
+}
@@ -1,48 +1,147 @@
 package service
 
 import (
-	"bytes"
+	"crypto/rand"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
-	"math/rand"
+	"sync"
 	"time"
 
+	"github.com/toalaah/smart-bottle/pkg/ble/schema"
 	"github.com/toalaah/smart-bottle/pkg/build"
 	"github.com/toalaah/smart-bottle/pkg/build/secrets"
 	"github.com/toalaah/smart-bottle/pkg/crypto"
+	"github.com/toalaah/smart-bottle/pkg/diag"
+	"github.com/toalaah/smart-bottle/pkg/link"
+	"github.com/toalaah/smart-bottle/pkg/ota"
 	"github.com/toalaah/smart-bottle/pkg/transport"
 	"tinygo.org/x/bluetooth"
 )
 
+// peer identifies the transport a client is connected through. Clients are authenticated per transport, so that a client on one transport cannot ride on the session of a client on another.
+type peer uint8
+
+const (
+	peerBluetooth peer = iota
+	peerLink
+	peerCount
+)
+
+func (p peer) String() string {
+	if p == peerLink {
+		return "link"
+	}
+	return "bluetooth"
+}
+
 type GattService struct {
 	service     *bluetooth.Service
 	adapter     *bluetooth.Adapter
 	logger      *slog.Logger
 	advInterval time.Duration
 
-	txHnd, nonceHnd, authRxHnd   bluetooth.Characteristic
-	txBufSize                    uint32
-	authEnabled, didAuthenticate bool
+	txHnd, nonceHnd, authRxHnd bluetooth.Characteristic
+	cmdHnd, diagHnd, logHnd    bluetooth.Characteristic
+	batteryHnd                 bluetooth.Characteristic
+	essFillHnd, essTempHnd     bluetooth.Characteristic
+	timeHnd                    bluetooth.Characteristic
+	otaStatusHnd               bluetooth.Characteristic
+	txBufSize                  uint32
+	authEnabled                bool
+	authenticated              [peerCount]bool
+	batteryEnabled, publicMode bool
+	alertEnabled               bool
+	connected                  bool
+	features                   transport.Feature
 
+	// authNonce is drawn anew after every handshake, so that recorded handshakes cannot be replayed. It is guarded by nonceMu, as handshakes arrive via Bluetooth and the link concurrently.
 	authNonce [build.NonceLen]byte
+	nonceMu   sync.Mutex
+	// sessionKey is the key agreed upon with the client which authenticated last, guarded by keyMu as it is handed out outside of the stack's event handlers.
+	sessionKey []byte
+	keyMu      sync.Mutex
+	deviceID   *transport.DeviceID
+
+	services []bluetooth.Service
+	// Latest values written to the registered characteristics, restored when re-registering services, see restartAdvertisement.
+	values   map[*bluetooth.Characteristic][]byte
+	valuesMu sync.Mutex
+	adv      *bluetooth.Advertisement
+	advOpts  bluetooth.AdvertisementOptions
+
+	broadcastEnabled bool
+	broadcastCipher  *crypto.BroadcastCipher
+	// broadcastCounter is the sequence number of the last broadcast reading, which serves as the nonce, see Broadcast.
+	broadcastCounter uint32
 
-	connectedDevice chan bluetooth.Device
-	keyChan         chan struct{}
+	firmware      *ota.Receiver
+	firmwareReady chan struct{}
+
+	device       bluetooth.Device
+	connParams   [2]bluetooth.ConnectionParams
+	connMode     transport.ConnectionMode
+	modeRequests chan transport.ConnectionMode
+
+	// Declarations of the registered characteristics, used to gate access to them, see characteristic.
+	handles map[*bluetooth.Characteristic]*schema.Characteristic
+	writers map[bluetooth.UUID]func(p peer, value []byte)
+
+	// Serves the same characteristics over a byte stream such as USB serial, see package link.
+	linkRW io.ReadWriter
+	link   *link.Server
+
+	keyChan     chan struct{}
+	commands    chan transport.Message
+	timeUpdates chan time.Time
+	connections chan bool
+	alerts      chan transport.AlertLevel
 }
 
+// ErrBroadcastCounter is returned by Broadcast if the sequence number of a reading would reuse a nonce.
+var ErrBroadcastCounter = errors.New("broadcast sequence number must increase")
+
 func New(opts ...ServiceOption) *GattService {
 	s := &GattService{
-		adapter:         bluetooth.DefaultAdapter,
-		txHnd:           bluetooth.Characteristic{},
-		nonceHnd:        bluetooth.Characteristic{},
-		authRxHnd:       bluetooth.Characteristic{},
-		logger:          nil,
-		advInterval:     1000 * time.Millisecond,
-		txBufSize:       128,
-		authEnabled:     false,
-		didAuthenticate: false,
-		connectedDevice: make(chan bluetooth.Device, 1),
-		keyChan:         make(chan struct{}, 1),
+		adapter:      bluetooth.DefaultAdapter,
+		txHnd:        bluetooth.Characteristic{},
+		nonceHnd:     bluetooth.Characteristic{},
+		authRxHnd:    bluetooth.Characteristic{},
+		cmdHnd:       bluetooth.Characteristic{},
+		diagHnd:      bluetooth.Characteristic{},
+		logHnd:       bluetooth.Characteristic{},
+		batteryHnd:   bluetooth.Characteristic{},
+		essFillHnd:   bluetooth.Characteristic{},
+		essTempHnd:   bluetooth.Characteristic{},
+		timeHnd:      bluetooth.Characteristic{},
+		otaStatusHnd: bluetooth.Characteristic{},
+		logger:       nil,
+		advInterval:  1000 * time.Millisecond,
+		txBufSize:    128,
+		authEnabled:  false,
+		connParams: [2]bluetooth.ConnectionParams{
+			transport.ConnectionSlow: {
+				MinInterval: bluetooth.NewDuration(495 * time.Millisecond),
+				MaxInterval: bluetooth.NewDuration(510 * time.Millisecond),
+				Timeout:     bluetooth.NewDuration(5 * time.Second),
+			},
+			transport.ConnectionFast: {
+				MinInterval: bluetooth.NewDuration(15 * time.Millisecond),
+				MaxInterval: bluetooth.NewDuration(30 * time.Millisecond),
+				Timeout:     bluetooth.NewDuration(4 * time.Second),
+			},
+		},
+		handles:       map[*bluetooth.Characteristic]*schema.Characteristic{},
+		values:        map[*bluetooth.Characteristic][]byte{},
+		writers:       map[bluetooth.UUID]func(p peer, value []byte){},
+		modeRequests:  make(chan transport.ConnectionMode, 1),
+		keyChan:       make(chan struct{}, 1),
+		commands:      make(chan transport.Message, 4),
+		timeUpdates:   make(chan time.Time, 1),
+		connections:   make(chan bool, 1),
+		alerts:        make(chan transport.AlertLevel, 1),
+		firmwareReady: make(chan struct{}, 1),
 	}
 	for _, opt := range opts {
 		opt(s)
@@ -60,153 +159,553 @@ func (s *GattService) Init() error {
 		return err
 	}
 	s.debug("have adapter address", "address", mac)
+	if s.deviceID == nil {
+		// The adapter address is unique per chip, its lower bytes are distinct enough to tell bottles apart.
+		s.deviceID = &transport.DeviceID{}
+		copy(s.deviceID[:], mac.MAC[:])
+	}
+	s.debug("have device ID", "id", s.deviceID)
 
 	s.adapter.SetConnectHandler(func(device bluetooth.Device, connected bool) {
+		s.connected = connected
 		if connected {
 			s.debug("new device connection", "state", connected, "device", device)
-			select {
-			case s.connectedDevice <- device:
-			default:
-			}
+			s.device = device
+			// Pairing follows right away, which benefits from a short interval. Parameters are negotiated per connection, so request them regardless of the previous mode.
+			s.connMode = transport.ConnectionFast
+			s.requestConnectionMode(s.connMode)
+			s.pairUnauthenticated()
 		} else {
-			s.debug("resetting auth")
-			s.didAuthenticate = false
+			s.debug("resetting auth", "transport", peerBluetooth)
+			s.authenticated[peerBluetooth] = false
+		}
+		// Only the latest state is of interest, replace any state which has not been consumed yet.
+		select {
+		case <-s.connections:
+		default:
+		}
+		select {
+		case s.connections <- connected:
+		default:
 		}
 	})
 
+	// Requests are issued outside of the stack's event handlers, which must not block.
 	go func() {
-		for device := range s.connectedDevice {
-			time.Sleep(time.Second * 5)
-			device.RequestConnectionParams(bluetooth.ConnectionParams{
-				MinInterval: bluetooth.NewDuration(495 * time.Millisecond),
-				MaxInterval: bluetooth.NewDuration(510 * time.Millisecond),
-				Timeout:     bluetooth.NewDuration(5 * time.Second),
-			})
+		for mode := range s.modeRequests {
+			if !s.connected {
+				continue
+			}
+			s.debug("requesting connection parameters", "mode", mode)
+			if err := s.device.RequestConnectionParams(s.connParams[mode]); err != nil {
+				s.debug("failed to request connection parameters", "mode", mode, "error", err)
+			}
 		}
 	}()
 
+	caps := s.Capabilities()
+	s.debug("have capabilities", "version", caps.Version, "features", caps.Features)
+
 	services := []bluetooth.Service{
 		// Device/vendor information
-		bluetooth.Service{
-			UUID: bluetooth.ServiceUUIDDeviceInformation,
-			Characteristics: []bluetooth.CharacteristicConfig{
-				{
-					UUID:  bluetooth.CharacteristicUUIDManufacturerNameString,
-					Value: []byte(build.ServiceName),
-					Flags: bluetooth.CharacteristicReadPermission,
-				},
-				{
-					UUID:  bluetooth.CharacteristicUUIDFirmwareRevisionString,
-					Value: []byte(build.ServiceVersion),
-					Flags: bluetooth.CharacteristicReadPermission,
-				},
-			},
-		},
+		newService(schema.DeviceInformation,
+			s.characteristic(schema.ManufacturerName, nil, []byte(build.ServiceName), nil),
+			s.characteristic(schema.FirmwareRevision, nil, []byte(build.ServiceVersion), nil),
+			s.characteristic(schema.ModelNumber, nil, []byte(build.ModelNumber), nil),
+			s.characteristic(schema.HardwareRevision, nil, []byte(build.HardwareRevision), nil),
+			s.characteristic(schema.SerialNumber, nil, []byte(s.deviceID.String()), nil),
+		),
 		// Main transport service
-		bluetooth.Service{
-			UUID: build.ServiceUUID,
-			Characteristics: []bluetooth.CharacteristicConfig{
-				{
-					Handle: &s.txHnd,
-					UUID:   build.CharacteristicUUIDFillLevel,
-					Value:  make([]byte, s.txBufSize),
-					Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicNotifyPermission,
-				},
-			},
-		},
+		newService(schema.Main,
+			s.characteristic(schema.FillLevel, &s.txHnd, make([]byte, s.txBufSize), nil),
+			s.characteristic(schema.Command, &s.cmdHnd, make([]byte, s.txBufSize), func(_ peer, value []byte) {
+				// The stack may reuse the underlying buffer once the handler returns.
+				b := make([]byte, len(value))
+				copy(b, value)
+				msg := transport.Message{}
+				if err := transport.UnmarshalBytes(&msg, b); err != nil || msg.Type != transport.Control {
+					s.debug("received malformed command", "value", fmt.Sprintf("%+v", value))
+					return
+				}
+				select {
+				case s.commands <- msg:
+				default:
+					diag.DroppedMessages.Add(1)
+					s.debug("command queue is full, dropping command")
+				}
+			}),
+			s.characteristic(schema.Diagnostics, &s.diagHnd, nil, nil),
+			s.characteristic(schema.Log, &s.logHnd, nil, nil),
+			s.characteristic(schema.Capabilities, nil, caps.MarshalBytes(), nil),
+		),
 	}
 
+	services = append(services, newService(schema.CurrentTimeService,
+		s.characteristic(schema.CurrentTime, &s.timeHnd, nil, func(_ peer, value []byte) {
+			t, err := transport.UnmarshalCurrentTime(value)
+			if err != nil {
+				s.debug("received malformed time update", "error", err)
+				return
+			}
+			s.debug("received time update", "time", t)
+			select {
+			case s.timeUpdates <- t:
+			default:
+				diag.DroppedMessages.Add(1)
+				s.debug("time update queue is full, dropping update")
+			}
+		}),
+	))
+
 	if s.authEnabled {
-		encNonce, err := crypto.EncryptEphemeralStaticX25519(s.authNonce[:], secrets.UserPublicKey)
+		nonceValue, err := NonceValue(s.authNonce[:])
 		if err != nil {
 			return err
 		}
-		nonce := bluetooth.CharacteristicConfig{
-			Handle: &s.nonceHnd,
-			UUID:   build.CharacteristicUUIDNonce,
-			Value:  append([]byte{uint8(transport.Nonce), uint8(len(encNonce))}, encNonce...),
-			Flags:  bluetooth.CharacteristicReadPermission,
-		}
-		rxAuth := bluetooth.CharacteristicConfig{
-			Handle: &s.authRxHnd,
-			UUID:   build.CharacteristicUUIDAuth,
-			Value:  make([]byte, build.NonceLen),
-			Flags:  bluetooth.CharacteristicWritePermission | bluetooth.CharacteristicWriteWithoutResponsePermission,
-			WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
-				s.debug("received write event", "value", fmt.Sprintf("%+v", value))
-				payload, err := crypto.DecryptEphemeralStaticX25519(value, secrets.BottlePrivateKey)
-				if err != nil {
-					s.debug("got error decrypting resent nonce", "error", err)
-					return
-				}
-				s.debug("decrypted payload", "value", fmt.Sprintf("%+v", payload))
-				if l := len(payload); l != int(build.NonceLen+len(secrets.PairingPin)) {
-					s.debug("auth key has unexpected length", "length", l)
+		nonce := s.characteristic(schema.Nonce, &s.nonceHnd, nonceValue, nil)
+		rxAuth := s.characteristic(schema.Auth, &s.authRxHnd, make([]byte, build.NonceLen), func(p peer, value []byte) {
+			s.debug("received write event", "value", fmt.Sprintf("%+v", value))
+			// Every nonce is good for a single attempt, whether it succeeds or not.
+			s.nonceMu.Lock()
+			key, err := AcceptHandshake(s.authNonce[:], value)
+			if _, rerr := rand.Read(s.authNonce[:]); rerr != nil {
+				s.debug("failed to draw nonce", "error", rerr)
+			}
+			s.nonceMu.Unlock()
+			// Only the client performing the handshake is affected by its outcome, a failed or replayed handshake must not end the session of a client on the other transport.
+			s.authenticated[p] = false
+			if err != nil {
+				diag.AuthFailures.Add(1)
+				s.debug("auth failed", "transport", p, "error", err)
+				go s.confirmAuth(p, transport.AuthFailed, nil)
+				return
+			}
+			s.debug("auth succeeded", "transport", p)
+			s.keyMu.Lock()
+			s.sessionKey = key
+			s.keyMu.Unlock()
+			// Readings are encrypted with the latest key only, a client on the other transport has to authenticate anew in order to decrypt them.
+			s.authenticated[p] = true
+			go s.confirmAuth(p, transport.AuthSucceeded, key)
+			select {
+			case s.keyChan <- struct{}{}:
+			default:
+			}
+		})
+		identity := s.characteristic(schema.Identity, nil, secrets.BottlePublicKey, nil)
+		services[1].Characteristics = append(services[1].Characteristics, nonce, rxAuth, identity)
+	}
+
+	if s.batteryEnabled {
+		services = append(services, newService(schema.Battery,
+			s.characteristic(schema.BatteryLevel, &s.batteryHnd, []byte{100}, nil),
+		))
+	}
+
+	if s.alertEnabled {
+		services = append(services, newService(schema.ImmediateAlert,
+			s.characteristic(schema.AlertLevel, nil, []byte{byte(transport.AlertNone)}, func(_ peer, value []byte) {
+				level := transport.AlertLevel(value[0])
+				s.debug("received alert", "level", level)
+				select {
+				case <-s.alerts:
+				default:
 				}
-				if bytes.Compare(payload, append(s.authNonce[:], secrets.PairingPin[:]...)) == 0 {
-					s.debug("auth succeeded")
-					s.didAuthenticate = true
-					s.keyChan <- struct{}{}
+				select {
+				case s.alerts <- level:
+				default:
 				}
-			},
-		}
-		services[1].Characteristics = append(services[1].Characteristics, nonce, rxAuth)
+			}),
+		))
 	}
 
-	for _, service := range services {
-		s.debug("adding service", "id", service.UUID)
-		if err := s.adapter.AddService(&service); err != nil {
-			return err
-		}
+	if s.firmware != nil {
+		services = append(services, newService(schema.Firmware,
+			s.characteristic(schema.OTAControl, nil, nil, s.handleFirmwareControl),
+			s.characteristic(schema.OTAData, nil, make([]byte, s.txBufSize), s.handleFirmwareData),
+			s.characteristic(schema.OTAStatus, &s.otaStatusHnd, nil, nil),
+		))
+	}
+
+	if s.publicMode {
+		// Unfortunately, the bluetooth package does not support declaring custom descriptors such as the ES Measurement or Characteristic User Description descriptors. We therefore restrict ourselves to characteristics whose semantics are unambiguous without them.
+		services = append(services, newService(schema.EnvironmentalSensing,
+			s.characteristic(schema.Percentage8, &s.essFillHnd, []byte{0xff}, nil),       // Value is not known
+			s.characteristic(schema.Temperature, &s.essTempHnd, []byte{0x00, 0x80}, nil), // Value is not known
+		))
+	}
+
+	s.services = services
+	if err := s.addServices(); err != nil {
+		return err
+	}
+	if s.linkRW != nil {
+		s.serveLink()
 	}
 
-	adv := s.adapter.DefaultAdvertisement()
-	advOpts := bluetooth.AdvertisementOptions{
+	s.adv = s.adapter.DefaultAdvertisement()
+	s.advOpts = bluetooth.AdvertisementOptions{
 		LocalName: build.ServiceName,
 		Interval:  bluetooth.NewDuration(s.advInterval),
 		ServiceUUIDs: []bluetooth.UUID{
-			build.ServiceUUID,
+			schema.Main.UUID,
 			bluetooth.ServiceUUIDDeviceInformation,
 		},
 		ManufacturerData: []bluetooth.ManufacturerDataElement{
 			bluetooth.ManufacturerDataElement{
 				CompanyID: build.ManufacturerUUID,
+				// Lets clients tell bottles apart before connecting. Replaced by broadcasts once they start.
+				Data: transport.MarshalManufacturerData(*s.deviceID, transport.AdvertisementCapabilities, caps.MarshalAdvertisement()),
 			},
 		},
 	}
-	s.debug("configuring advertisement", "name", advOpts.LocalName, "address", mac)
-	if err := adv.Configure(advOpts); err != nil {
+	if s.publicMode {
+		// Advertising both would exceed the maximum advertisement size. Generic tools are more likely to filter for the sensing service.
+		s.advOpts.ServiceUUIDs[1] = bluetooth.ServiceUUIDEnvironmentalSensing
+	}
+	s.debug("configuring advertisement", "name", s.advOpts.LocalName, "address", mac, "id", s.deviceID)
+	if err := s.adv.Configure(s.advOpts); err != nil {
 		return err
 	}
 
-	s.debug("starting advertisement", "name", advOpts.LocalName, "address", mac)
-	if err := adv.Start(); err != nil {
+	s.debug("starting advertisement", "name", s.advOpts.LocalName, "address", mac)
+	if err := s.adv.Start(); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (s *GattService) SendMessage(m *transport.Message) error {
-	if !s.didAuthenticate && s.authEnabled {
-		s.debug("no authentication handshake has taken place, skipping sending message")
+// Capabilities returns the protocol version, features and payload formats advertised to clients. Features of the service itself are derived from its options, others are declared via WithFeatures.
+func (s *GattService) Capabilities() transport.Capabilities {
+	f := s.features
+	if s.authEnabled {
+		f |= transport.FeatureAuth
+	}
+	if s.broadcastEnabled {
+		f |= transport.FeatureBroadcast
+	}
+	if s.batteryEnabled {
+		f |= transport.FeatureBattery
+	}
+	if s.publicMode {
+		f |= transport.FeaturePublicMode
+	}
+	if s.firmware != nil {
+		f |= transport.FeatureFirmwareUpdate
+	}
+	if s.alertEnabled {
+		f |= transport.FeatureAlert
+	}
+	return transport.Capabilities{
+		Version:    transport.ProtocolVersion,
+		MinVersion: transport.MinProtocolVersion,
+		Features:   f,
+		Formats:    transport.Formats,
+	}
+}
+
+// confirmAuth publishes the nonce for the next handshake and notifies the client on the given transport of the outcome of its handshake, see AuthConfirmation, leaving clients on other transports waiting for their own. Clients retrying thus read the new nonce. It must not be called from within the stack's event handlers, which must not block.
+func (s *GattService) confirmAuth(p peer, status transport.AuthStatus, key []byte) {
+	s.publishNonce()
+	v, err := AuthConfirmation(status, key)
+	if err != nil {
+		s.debug("failed to derive key confirmation", "error", err)
+		return
+	}
+	if p == peerLink {
+		err = s.link.Notify(schema.Auth.UUID, v)
+	} else {
+		_, err = s.authRxHnd.Write(v)
+	}
+	if err != nil {
+		s.debug("failed to confirm auth", "transport", p, "status", status, "error", err)
+	}
+}
+
+// publishNonce updates the nonce characteristic with the current nonce.
+func (s *GattService) publishNonce() {
+	s.nonceMu.Lock()
+	defer s.nonceMu.Unlock()
+	v, err := NonceValue(s.authNonce[:])
+	if err == nil {
+		_, err = s.write(&s.nonceHnd, v)
+	}
+	if err != nil {
+		s.debug("failed to publish nonce", "error", err)
+	}
+}
+
+// serveLink serves all characteristics over the configured link in addition to Bluetooth. Values written via write are mirrored to it.
+func (s *GattService) serveLink() {
+	var chars []link.Characteristic
+	for _, svc := range s.services {
+		for _, c := range svc.Characteristics {
+			lc := link.Characteristic{UUID: c.UUID, Value: append([]byte{}, c.Value...)}
+			if write := s.writers[c.UUID]; write != nil {
+				lc.OnWrite = func(value []byte) {
+					write(peerLink, value)
+				}
+			}
+			chars = append(chars, lc)
+		}
+	}
+	s.link = link.NewServer(s.linkRW, chars, func() {
+		// Every session over the link starts unauthenticated, as a new Bluetooth connection would.
+		s.debug("resetting auth", "transport", peerLink)
+		s.authenticated[peerLink] = false
+		s.pairUnauthenticated()
+	})
+	go func() {
+		err := s.link.Serve()
+		s.debug("stopped serving link", "error", err)
+	}()
+}
+
+// write updates the value of the given characteristic, notifying subscribed clients over Bluetooth and the link, if any. Authenticated characteristics are only updated on transports whose client has authenticated.
+func (s *GattService) write(hnd *bluetooth.Characteristic, p []byte) (int, error) {
+	c, ok := s.handles[hnd]
+	if !ok {
+		return 0, fmt.Errorf("characteristic is not registered")
+	}
+	if s.link != nil && (!c.Authenticated || s.authorized(peerLink)) {
+		if err := s.link.Notify(c.UUID, p); err != nil {
+			s.debug("failed to notify link", "error", err)
+		}
+	}
+	if c.Authenticated && !s.authorized(peerBluetooth) {
+		return 0, nil
+	}
+	n, err := hnd.Write(p)
+	if err == nil {
+		s.valuesMu.Lock()
+		s.values[hnd] = append(s.values[hnd][:0], p...)
+		s.valuesMu.Unlock()
+	}
+	return n, err
+}
+
+// authorized reports whether the client on the given transport may access authenticated characteristics, see schema.Characteristic.Authenticated.
+func (s *GattService) authorized(p peer) bool {
+	return !s.authEnabled || s.authenticated[p]
+}
+
+// pairUnauthenticated starts a session right away if authentication is disabled, as there is no handshake to wait for. The session key is all zeros, matching what clients assume for such bottles.
+func (s *GattService) pairUnauthenticated() {
+	if s.authEnabled {
+		return
+	}
+	select {
+	case s.keyChan <- struct{}{}:
+	default:
+	}
+}
+
+// newService declares the given schema service with the given characteristics.
+func newService(svc *schema.Service, chars ...bluetooth.CharacteristicConfig) bluetooth.Service {
+	return bluetooth.Service{UUID: svc.UUID, Characteristics: chars}
+}
+
+// characteristic declares the given schema characteristic. If value is nil, a zeroed value of the characteristic's declared size is allocated. Writes are validated against the declaration and, for authenticated characteristics, dropped unless the client has authenticated, before being passed to onWrite.
+func (s *GattService) characteristic(c *schema.Characteristic, handle *bluetooth.Characteristic, value []byte, onWrite func(p peer, value []byte)) bluetooth.CharacteristicConfig {
+	if value == nil {
+		value = make([]byte, c.Size)
+	}
+	cfg := bluetooth.CharacteristicConfig{
+		Handle: handle,
+		UUID:   c.UUID,
+		Value:  value,
+		Flags:  c.Flags,
+	}
+	if handle != nil {
+		s.handles[handle] = c
+	}
+	if onWrite != nil {
+		write := func(p peer, value []byte) {
+			if c.Authenticated && !s.authorized(p) {
+				s.debug("no authentication handshake has taken place, ignoring write", "transport", p, "characteristic", c.Name)
+				return
+			}
+			if err := c.ValidateValue(value); err != nil {
+				s.debug("ignoring write", "transport", p, "error", err)
+				return
+			}
+			onWrite(p, value)
+		}
+		s.writers[c.UUID] = write
+		cfg.WriteEvent = func(client bluetooth.Connection, offset int, value []byte) {
+			write(peerBluetooth, value)
+		}
+	}
+	return cfg
+}
+
+func (s *GattService) addServices() error {
+	s.valuesMu.Lock()
+	for i := range s.services {
+		for j := range s.services[i].Characteristics {
+			c := &s.services[i].Characteristics[j]
+			if v, ok := s.values[c.Handle]; ok {
+				c.Value = append([]byte(nil), v...)
+			}
+		}
+	}
+	s.valuesMu.Unlock()
+	for i := range s.services {
+		s.debug("adding service", "id", s.services[i].UUID)
+		if err := s.adapter.AddService(&s.services[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restartAdvertisement applies changes to the advertisement options. On the HCI stack used by the bottle, stopping the advertisement also clears the GATT database, so services are re-registered with the values written last before starting over. Otherwise, characteristics such as the nonce would revert to their initial values.
+func (s *GattService) restartAdvertisement() error {
+	if err := s.adv.Stop(); err != nil {
+		return err
+	}
+	if err := s.addServices(); err != nil {
+		return err
+	}
+	if err := s.adv.Configure(s.advOpts); err != nil {
+		return err
+	}
+	return s.adv.Start()
+}
+
+// SetAdvertisementInterval changes the advertisement interval. While a client is connected, the new interval only takes effect once advertising is restarted.
+func (s *GattService) SetAdvertisementInterval(d time.Duration) error {
+	if s.advInterval == d {
+		return nil
+	}
+	s.debug("changing advertisement interval", "interval", d)
+	s.advInterval = d
+	s.advOpts.Interval = bluetooth.NewDuration(d)
+	if s.connected {
+		return nil
+	}
+	return s.restartAdvertisement()
+}
+
+// SetConnectionMode requests the connected client to switch to the connection parameters of the given mode. Requests are issued asynchronously and only if the mode changes, the client may still reject them.
+func (s *GattService) SetConnectionMode(mode transport.ConnectionMode) {
+	if !s.connected || mode == s.connMode {
+		return
+	}
+	s.connMode = mode
+	s.requestConnectionMode(mode)
+}
+
+func (s *GattService) requestConnectionMode(mode transport.ConnectionMode) {
+	select {
+	case <-s.modeRequests:
+	default:
+	}
+	select {
+	case s.modeRequests <- mode:
+	default:
+	}
+}
+
+// Alerts returns a channel of alert levels written by an authenticated client via the Immediate Alert Service. Only the latest level is kept if not consumed in time.
+func (s *GattService) Alerts() <-chan transport.AlertLevel {
+	return s.alerts
+}
+
+// Connections returns a channel of connection state changes. Intermediate states are dropped if not consumed in time.
+func (s *GattService) Connections() <-chan bool {
+	return s.connections
+}
+
+// SetBroadcastKey sets the key used to encrypt broadcast advertisements. It should be derived from the key shared at pairing, see crypto.DeriveKey.
+func (s *GattService) SetBroadcastKey(key []byte) error {
+	c, err := crypto.NewBroadcastCipher(key)
+	if err != nil {
+		return err
+	}
+	s.broadcastCipher = c
+	return nil
+}
+
+// Broadcast rotates the given data into the advertisement, allowing paired clients to receive it without connecting. Nothing is broadcast while a client is connected or before a broadcast key has been set.
+//
+// The sequence number of the reading serves as the nonce, which must never repeat for the same key. As the key of a bottle without authentication is the same on every boot, sequence numbers must thus survive resets, see history.WithStore, and readings which failed to persist must not be broadcast. ErrBroadcastCounter is returned if the sequence number does not exceed the one broadcast last.
+func (s *GattService) Broadcast(b *transport.Broadcast) error {
+	if !s.broadcastEnabled || s.broadcastCipher == nil || s.connected {
 		return nil
 	}
+	if b.Seq <= s.broadcastCounter {
+		return ErrBroadcastCounter
+	}
+	s.broadcastCounter = b.Seq
+	frame := s.broadcastCipher.Seal(s.broadcastCounter, b.MarshalBytes())
+	s.advOpts.ManufacturerData[0].Data = transport.MarshalManufacturerData(*s.deviceID, transport.AdvertisementBroadcast, frame)
+	s.debug("updating broadcast", "counter", s.broadcastCounter, "seq", b.Seq)
+	return s.restartAdvertisement()
+}
+
+func (s *GattService) SendMessage(m *transport.Message) error {
 	s.debug("writing value", "handle", s.txHnd, "length", 2+m.Length)
-	if _, err := s.txHnd.Write(append([]byte{uint8(m.Type), m.Length}, m.Value...)); err != nil {
+	if _, err := s.write(&s.txHnd, append([]byte{uint8(m.Type), m.Length}, m.Value...)); err != nil {
+		diag.DroppedMessages.Add(1)
 		return err
 	}
 	return nil
 }
 
+// SendLog notifies the connected client of an encrypted log entry. Unlike SendMessage, failures are not counted as dropped messages, as the client is able to detect missing lines by their sequence numbers.
+func (s *GattService) SendLog(m *transport.Message) error {
+	_, err := s.write(&s.logHnd, m.MarshalBytes())
+	return err
+}
+
+// SetDiagnostics updates the diagnostics characteristic. The report should be encrypted with the session key, as it is readable by any connected client.
+func (s *GattService) SetDiagnostics(m *transport.Message) error {
+	s.debug("writing diagnostics", "length", 2+m.Length)
+	_, err := s.write(&s.diagHnd, m.MarshalBytes())
+	return err
+}
+
 func (s *GattService) Send(payload []byte) error {
 	s.debug("writing value", "handle", s.txHnd, "length", len(payload))
-	if _, err := s.txHnd.Write(payload); err != nil {
+	if _, err := s.write(&s.txHnd, payload); err != nil {
 		return err
 	}
 	return nil
 }
 
+// SetBatteryLevel updates the battery level characteristic, notifying subscribed clients. The level is given in percent.
+func (s *GattService) SetBatteryLevel(level uint8) error {
+	if !s.batteryEnabled {
+		return nil
+	}
+	s.debug("writing battery level", "level", level)
+	_, err := s.write(&s.batteryHnd, []byte{level})
+	return err
+}
+
+// SetFillLevel updates the public fill level characteristic. The level is given as a ratio in the range [0, 1].
+func (s *GattService) SetFillLevel(ratio float32) error {
+	if !s.publicMode {
+		return nil
+	}
+	// Percentage 8 has a resolution of 0.5%.
+	_, err := s.write(&s.essFillHnd, []byte{uint8(ratio*200 + 0.5)})
+	return err
+}
+
+// SetTemperature updates the public temperature characteristic. The temperature is given in milli-degrees Celsius.
+func (s *GattService) SetTemperature(milliCelsius int32) error {
+	if !s.publicMode {
+		return nil
+	}
+	// Temperature has a resolution of 0.01 degrees Celsius.
+	v := int16(milliCelsius / 10)
+	_, err := s.write(&s.essTempHnd, []byte{uint8(v), uint8(v >> 8)})
+	return err
+}
+
 func (s *GattService) debug(msg string, args ...any) {
 	if s.logger != nil {
 		s.logger.Debug(msg, args...)
@@ -216,7 +715,100 @@ func (s *GattService) debug(msg string, args ...any) {
 func (s *GattService) GetPairingKeyBlocking() []byte {
 	s.debug("waiting for pairing key event")
 	<-s.keyChan
-	return s.authNonce[:]
+	return s.PairingKey()
+}
+
+// Paired returns a channel which receives a value whenever a client successfully authenticates. The corresponding key can be obtained via PairingKey.
+func (s *GattService) Paired() <-chan struct{} {
+	return s.keyChan
+}
+
+// PairingKey returns the session key agreed upon with the client which authenticated last, or all zeros if authentication is disabled.
+func (s *GattService) PairingKey() []byte {
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+	if s.sessionKey == nil {
+		return make([]byte, build.NonceLen)
+	}
+	return s.sessionKey
+}
+
+// DeviceID returns the short identifier advertised by the bottle, which also serves as its serial number. It is only valid after Init.
+func (s *GattService) DeviceID() transport.DeviceID {
+	return *s.deviceID
+}
+
+// TimeUpdates returns a channel of wall clock times written by an authenticated client via the Current Time Service.
+func (s *GattService) TimeUpdates() <-chan time.Time {
+	return s.timeUpdates
+}
+
+// SetCurrentTime updates the Current Time characteristic, notifying subscribed clients.
+func (s *GattService) SetCurrentTime(t time.Time) error {
+	_, err := s.write(&s.timeHnd, transport.MarshalCurrentTime(t))
+	return err
+}
+
+// FirmwareReady returns a channel which receives a value once a firmware image has been received and verified. The caller is responsible for applying it.
+func (s *GattService) FirmwareReady() <-chan struct{} {
+	return s.firmwareReady
+}
+
+// handleFirmwareControl handles firmware update operations. Images are verified by their signature, still only authenticated clients may send them, see schema.OTAControl, so that nobody else can hog the connection with bogus images.
+func (s *GattService) handleFirmwareControl(_ peer, value []byte) {
+	var err error
+	switch ota.Op(value[0]) {
+	case ota.OpBegin:
+		h := ota.Header{}
+		if err = ota.UnmarshalHeader(&h, value[1:]); err == nil {
+			err = s.firmware.Begin(h)
+		}
+		if err == nil {
+			s.SetConnectionMode(transport.ConnectionFast)
+		}
+	case ota.OpFinish:
+		s.SetConnectionMode(transport.ConnectionSlow)
+		if err = s.firmware.Finish(); err == nil {
+			select {
+			case s.firmwareReady <- struct{}{}:
+			default:
+			}
+		}
+	case ota.OpAbort:
+		s.firmware.Abort()
+		s.SetConnectionMode(transport.ConnectionSlow)
+	default:
+		err = fmt.Errorf("unknown operation %d", value[0])
+	}
+	if err != nil {
+		s.debug("firmware update failed", "op", value[0], "error", err)
+	}
+	s.publishFirmwareStatus()
+}
+
+func (s *GattService) handleFirmwareData(_ peer, value []byte) {
+	off, chunk, err := ota.UnmarshalChunk(value)
+	if err == nil {
+		err = s.firmware.Write(off, chunk)
+	}
+	if err != nil {
+		// The sender resumes at the offset reported in the status.
+		s.debug("dropping firmware chunk", "offset", off, "error", err)
+	}
+	// Clients poll the status rather than subscribing to it, so this does not cause additional traffic.
+	s.publishFirmwareStatus()
+}
+
+func (s *GattService) publishFirmwareStatus() {
+	st := s.firmware.Status()
+	if _, err := s.write(&s.otaStatusHnd, st.MarshalBytes()); err != nil {
+		s.debug("failed to publish firmware status", "error", err)
+	}
+}
+
+// Commands returns a channel of (still encrypted) control messages written by an authenticated client.
+func (s *GattService) Commands() <-chan transport.Message {
+	return s.commands
 }
 
 type ServiceOption func(*GattService)
@@ -239,9 +831,14 @@ func WithTXBufferSize(n uint32) ServiceOption {
 	}
 }
 
+// WithAuth requires clients to authenticate before accessing authenticated characteristics. Without authentication, every client starts a session on connecting, whose key is all zeros.
 func WithAuth(enable bool) ServiceOption {
 	return func(s *GattService) {
 		s.authEnabled = enable
+		s.authNonce = [build.NonceLen]byte{}
+		if !enable {
+			return
+		}
 		if _, err := rand.Read(s.authNonce[:]); err != nil {
 			panic(err)
 		} else {
@@ -249,3 +846,67 @@ func WithAuth(enable bool) ServiceOption {
 		}
 	}
 }
+
+// WithBattery exposes the standard Battery Service. Levels are published via SetBatteryLevel.
+func WithBattery(enable bool) ServiceOption {
+	return func(s *GattService) {
+		s.batteryEnabled = enable
+	}
+}
+
+// WithPublicMode additionally exposes unencrypted readings via the standard Environmental Sensing Service. This allows generic GATT tools to read the bottle without pairing, so only enable it if readings are not considered sensitive. Lacking ES Measurement descriptors, see schema.EnvironmentalSensing, it does not make the bottle recognizable to Environmental Sensing Profile collectors or Home Assistant.
+func WithPublicMode(enable bool) ServiceOption {
+	return func(s *GattService) {
+		s.publicMode = enable
+	}
+}
+
+// WithImmediateAlert exposes the standard Immediate Alert Service, allowing clients to locate the bottle. Alerts are delivered via Alerts.
+func WithImmediateAlert(enable bool) ServiceOption {
+	return func(s *GattService) {
+		s.alertEnabled = enable
+	}
+}
+
+// WithFirmwareUpdate exposes a service for receiving firmware updates over the air, which are written and verified by the given receiver.
+func WithFirmwareUpdate(r *ota.Receiver) ServiceOption {
+	return func(s *GattService) {
+		s.firmware = r
+	}
+}
+
+// WithBroadcast enables broadcasting readings in the advertisement's manufacturer data, see Broadcast.
+func WithBroadcast(enable bool) ServiceOption {
+	return func(s *GattService) {
+		s.broadcastEnabled = enable
+	}
+}
+
+// WithDeviceID overrides the device ID, which is otherwise derived from the adapter address.
+func WithDeviceID(id transport.DeviceID) ServiceOption {
+	return func(s *GattService) {
+		s.deviceID = &id
+	}
+}
+
+// WithFeatures declares features implemented on top of the service, such as handling commands or replaying buffered readings, which are advertised to clients via Capabilities.
+func WithFeatures(f transport.Feature) ServiceOption {
+	return func(s *GattService) {
+		s.features |= f
+	}
+}
+
+// WithLink additionally serves the bottle's characteristics over the given byte stream, such as USB serial, allowing clients without a working Bluetooth connection to pair and receive readings.
+func WithLink(rw io.ReadWriter) ServiceOption {
+	return func(s *GattService) {
+		s.linkRW = rw
+	}
+}
+
+// WithConnectionParams sets the connection parameters requested in fast and slow mode, see SetConnectionMode.
+func WithConnectionParams(fast, slow bluetooth.ConnectionParams) ServiceOption {
+	return func(s *GattService) {
+		s.connParams[transport.ConnectionFast] = fast
+		s.connParams[transport.ConnectionSlow] = slow
+	}
+}
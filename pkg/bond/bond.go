@@ -0,0 +1,272 @@
+// Package bond persists the bottles a client has paired with, allowing it to reconnect to them after restarting without rediscovering them or asking for their pin again.
+package bond
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/toalaah/smart-bottle/pkg/build"
+	"github.com/toalaah/smart-bottle/pkg/crypto"
+	"github.com/toalaah/smart-bottle/pkg/transport"
+)
+
+var (
+	ErrUnknownBond = errors.New("bottle is not paired")
+	// ErrCorrupt is returned if the store cannot be decrypted, e.g. because it was written using another key.
+	ErrCorrupt = errors.New("bond store is corrupt or was encrypted using another key")
+	// ErrIdentityMismatch is returned if a paired bottle presents another public key than when it was first paired with.
+	ErrIdentityMismatch = errors.New("bottle presented another identity than when paired")
+)
+
+const (
+	// fileVersion is incremented whenever the layout of stored bonds changes incompatibly.
+	fileVersion = 1
+	// keyLen is the length of the key generated by LoadKey.
+	keyLen = 32
+)
+
+// Bond records what a client learned about a bottle while pairing with it.
+type Bond struct {
+	ID transport.DeviceID `json:"id"`
+	// Address is the bottle's Bluetooth address as returned by bluetooth.Address.String.
+	Address string `json:"address"`
+	// Pin is the pairing pin the bottle accepted, which is used to authenticate again after reconnecting.
+	Pin []byte `json:"pin"`
+	// PublicKey is the bottle's static X25519 public key.
+	PublicKey   []byte            `json:"public_key"`
+	Calibration build.Calibration `json:"calibration"`
+	PairedAt    time.Time         `json:"paired_at"`
+}
+
+// file is the on-disk format of the store. Bonds hold secrets and are therefore only stored encrypted.
+type file struct {
+	Version int    `json:"version"`
+	Bonds   []byte `json:"bonds"`
+}
+
+// Store is a set of bonds backed by a JSON file, which is rewritten on every change.
+type Store struct {
+	path  string
+	gcm   cipher.AEAD
+	mu    sync.Mutex
+	bonds map[transport.DeviceID]Bond
+}
+
+// DefaultPath returns the location of the store within the user's configuration directory.
+func DefaultPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "smart-bottle", "bonds.json"), nil
+}
+
+// OpenDefault opens the store at DefaultPath, encrypted using the key at KeyPath, which is generated on first use. Stores written before keys were generated per installation cannot be decrypted and are set aside with the suffix .bak, so that bottles have to be paired again.
+func OpenDefault() (*Store, error) {
+	path, err := DefaultPath()
+	if err != nil {
+		return nil, err
+	}
+	key, created, err := LoadKey(KeyPath(path))
+	if err != nil {
+		return nil, err
+	}
+	s, err := Open(path, key)
+	if created && errors.Is(err, ErrCorrupt) {
+		if err := os.Rename(path, path+".bak"); err != nil {
+			return nil, err
+		}
+		return Open(path, key)
+	}
+	return s, err
+}
+
+// KeyPath returns the location of the key encrypting the store at the given path.
+func KeyPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "bonds.key")
+}
+
+// LoadKey reads the key at the given path, generating a random one if there is none yet, in which case created is true. The key is only accessible by the current user, as is the directory holding it.
+func LoadKey(path string) (key []byte, created bool, err error) {
+	key, err = os.ReadFile(path)
+	if err == nil {
+		if len(key) != keyLen {
+			return nil, false, fmt.Errorf("expected bond store key of length %d, got %d", keyLen, len(key))
+		}
+		return key, false, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, false, err
+	}
+	key = make([]byte, keyLen)
+	if _, err := rand.Read(key); err != nil {
+		return nil, false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, false, err
+	}
+	// Never overwrite a key written concurrently by another client, which would render the store unreadable.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if errors.Is(err, os.ErrExist) {
+		return LoadKey(path)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if _, err := f.Write(key); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, false, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return nil, false, err
+	}
+	return key, true, nil
+}
+
+// Open loads the store at the given path, decrypting it using a cipher derived from key. A missing file yields an empty store, which is created once the first bond is added.
+func Open(path string, key []byte) (*Store, error) {
+	gcm, err := crypto.NewGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{path: path, gcm: gcm, bonds: map[transport.DeviceID]Bond{}}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	f := file{}
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCorrupt, err)
+	}
+	if f.Version != fileVersion {
+		return nil, fmt.Errorf("unsupported bond store version %d", f.Version)
+	}
+	if len(f.Bonds) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, fmt.Errorf("%w: payload is too short", ErrCorrupt)
+	}
+	plain := make([]byte, len(f.Bonds)-gcm.NonceSize()-gcm.Overhead())
+	if err := crypto.DecryptAES(gcm, f.Bonds, plain); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCorrupt, err)
+	}
+	if err := json.Unmarshal(plain, &s.bonds); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCorrupt, err)
+	}
+	return s, nil
+}
+
+// Get returns the bond with the given bottle.
+func (s *Store) Get(id transport.DeviceID) (Bond, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.bonds[id]
+	return b, ok
+}
+
+// Verify checks the public key presented by the given bottle against the key pinned when first pairing with it. Bottles which have not been paired with yet, or were paired with before keys were pinned, are trusted on first use.
+func (s *Store) Verify(id transport.DeviceID, key []byte) error {
+	b, ok := s.Get(id)
+	if !ok || len(b.PublicKey) == 0 || bytes.Equal(b.PublicKey, key) {
+		return nil
+	}
+	return fmt.Errorf("%w: bottle %s presented key %x, expected %x", ErrIdentityMismatch, id, key, b.PublicKey)
+}
+
+// Len returns the number of bonds.
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.bonds)
+}
+
+// List returns all bonds ordered by device ID.
+func (s *Store) List() []Bond {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bonds := make([]Bond, 0, len(s.bonds))
+	for _, b := range s.bonds {
+		bonds = append(bonds, b)
+	}
+	sort.Slice(bonds, func(i, j int) bool {
+		return bonds[i].ID.String() < bonds[j].ID.String()
+	})
+	return bonds
+}
+
+// Put adds or replaces the bond with b.ID and saves the store.
+func (s *Store) Put(b Bond) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, existed := s.bonds[b.ID]
+	s.bonds[b.ID] = b
+	if err := s.save(); err != nil {
+		if existed {
+			s.bonds[b.ID] = prev
+		} else {
+			delete(s.bonds, b.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+// Forget removes the bond with the given bottle and saves the store, returning ErrUnknownBond if there is none.
+func (s *Store) Forget(id transport.DeviceID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, ok := s.bonds[id]
+	if !ok {
+		return ErrUnknownBond
+	}
+	delete(s.bonds, id)
+	if err := s.save(); err != nil {
+		s.bonds[id] = prev
+		return err
+	}
+	return nil
+}
+
+// save encrypts and writes the store. The file is replaced atomically, so that a crash never leaves a truncated store behind.
+func (s *Store) save() error {
+	plain, err := json.Marshal(s.bonds)
+	if err != nil {
+		return err
+	}
+	f := file{Version: fileVersion, Bonds: make([]byte, s.gcm.NonceSize()+len(plain)+s.gcm.Overhead())}
+	if err := crypto.EncryptAES(s.gcm, plain, f.Bonds); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".bonds-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,152 @@
+package bond
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/toalaah/smart-bottle/pkg/build"
+	"github.com/toalaah/smart-bottle/pkg/transport"
+)
+
+var key = []byte("0123456789abcdef0123456789abcdef")
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bonds.json")
+	s, err := Open(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.List()); n != 0 {
+		t.Errorf("Expected new store to hold '%v' bonds, got '%v'", 0, n)
+	}
+
+	b := Bond{
+		ID:          transport.DeviceID{0xc0, 0xff, 0xee, 0x42},
+		Address:     "AA:BB:CC:DD:EE:FF",
+		Pin:         []byte{1, 3, 3, 7},
+		PublicKey:   bytes.Repeat([]byte{7}, 32),
+		Calibration: build.DefaultCalibration,
+		PairedAt:    time.Unix(1735689600, 0).UTC(),
+	}
+	if err := s.Put(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(Bond{ID: transport.DeviceID{0x01}}); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte(b.Address)) {
+		t.Error("Expected bonds to be encrypted at rest")
+	}
+
+	s, err = Open(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := s.Get(b.ID)
+	if !ok {
+		t.Fatalf("Expected bond with '%s' to be persisted", b.ID)
+	}
+	if got.Address != b.Address || !bytes.Equal(got.Pin, b.Pin) || !bytes.Equal(got.PublicKey, b.PublicKey) || got.Calibration != b.Calibration || !got.PairedAt.Equal(b.PairedAt) {
+		t.Errorf("Expected bond to be '%+v', got '%+v'", b, got)
+	}
+	if list := s.List(); len(list) != 2 || list[0].ID != (transport.DeviceID{0x01}) {
+		t.Errorf("Expected bonds to be ordered by ID, got '%+v'", list)
+	}
+
+	if err := s.Forget(b.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Forget(b.ID); !errors.Is(err, ErrUnknownBond) {
+		t.Errorf("Expected forgetting twice to return '%v', got '%v'", ErrUnknownBond, err)
+	}
+	s, err = Open(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Get(b.ID); ok {
+		t.Error("Expected forgotten bond to be removed from disk")
+	}
+}
+
+func TestStoreWrongKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bonds.json")
+	s, err := Open(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(Bond{ID: transport.DeviceID{0x01}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, []byte("another key")); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected opening with another key to return '%v', got '%v'", ErrCorrupt, err)
+	}
+}
+
+func TestStoreVerify(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "bonds.json"), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := transport.DeviceID{0x01}
+	pinned, other := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	if err := s.Verify(id, other); err != nil {
+		t.Errorf("Expected unknown bottle to be trusted on first use, got '%v'", err)
+	}
+	if err := s.Put(Bond{ID: id}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Verify(id, other); err != nil {
+		t.Errorf("Expected bottle without pinned key to be trusted, got '%v'", err)
+	}
+	if err := s.Put(Bond{ID: id, PublicKey: pinned}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Verify(id, pinned); err != nil {
+		t.Errorf("Expected pinned key to verify, got '%v'", err)
+	}
+	if err := s.Verify(id, other); !errors.Is(err, ErrIdentityMismatch) {
+		t.Errorf("Expected other key to return '%v', got '%v'", ErrIdentityMismatch, err)
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	path := KeyPath(filepath.Join(t.TempDir(), "smart-bottle", "bonds.json"))
+	k, created, err := LoadKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created || len(k) != keyLen {
+		t.Errorf("Expected new key of length '%v' to be created, got '%v' (created %v)", keyLen, len(k), created)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("Expected key permissions to be '%v', got '%v'", os.FileMode(0o600), perm)
+	}
+
+	again, created, err := LoadKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created || !bytes.Equal(k, again) {
+		t.Error("Expected existing key to be loaded rather than replaced")
+	}
+
+	if err := os.WriteFile(path, []byte("short"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := LoadKey(path); err == nil {
+		t.Error("Expected error loading key of wrong length")
+	}
+}
@@ -0,0 +1,25 @@
+package build
+
+// Calibration maps depth sensor readings to fill levels. Depths are measured from the sensor to the water surface in centimeters.
+type Calibration struct {
+	DepthEmpty float32
+	DepthFull  float32
+}
+
+// DefaultCalibration matches the example construction. Change according to height of water bottle.
+var DefaultCalibration = Calibration{
+	DepthEmpty: 13.6,
+	DepthFull:  5.11,
+}
+
+// FillRatio returns the fill level in the range [0, 1] for a given depth.
+func (c Calibration) FillRatio(d float32) float32 {
+	if d >= c.DepthEmpty {
+		return 0
+	}
+	if d <= c.DepthFull {
+		return 1
+	}
+	// For the sake of simplicity we assume a linear relationship, that is that the bottle is a perfect cylinder
+	return (c.DepthEmpty - d) / (c.DepthEmpty - c.DepthFull)
+}
@@ -2,3 +2,4 @@ package secrets
 
 //go:generate ./gen25519.sh bottle-
 //go:generate ./gen25519.sh user-
+//go:generate ./gen25519.sh firmware- ed25519
@@ -1,6 +1,7 @@
 package secrets
 
 import (
+	"crypto/ed25519"
 	_ "embed"
 	"encoding/pem"
 
@@ -17,6 +18,12 @@ var userPrivateKeyPEM []byte
 var UserPrivateKey []byte
 var UserPublicKey []byte
 
+// The bottle verifies updates using this key. The private key signing them is only read by cmd/sign at runtime, so that it never ends up in a firmware image or client.
+//
+//go:embed firmware-public.pem
+var firmwarePublicKeyPEM []byte
+var FirmwarePublicKey ed25519.PublicKey
+
 var PairingPin = [4]byte{1, 3, 3, 7}
 
 func init() {
@@ -34,6 +41,9 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
+
+	block, _ = pem.Decode(firmwarePublicKeyPEM)
+	FirmwarePublicKey = block.Bytes[len(block.Bytes)-ed25519.PublicKeySize:]
 }
 
 const BackendUsername = "testuser"
@@ -1,20 +1,24 @@
 package build
 
-import (
-	"tinygo.org/x/bluetooth"
-)
-
 const (
 	ServiceName    = "Smart Flask"
 	ServiceVersion = "0.1"
-	BackendAddr    = "http://localhost:8000"
-	NonceLen       = 32
+	ModelNumber    = "SF-1"
+	// HardwareRevision identifies the board the firmware was built for.
+	HardwareRevision = "pico2w"
+	BackendAddr      = "http://localhost:8000"
+	NonceLen         = 32
+	// Battery level in percent below which clients warn the user.
+	LowBatteryLevel = 20
+	// PublicMode additionally exposes unencrypted readings via the standard Environmental Sensing Service, allowing generic GATT tools to read the bottle. Home Assistant and other consumers requiring ES Measurement descriptors are not supported.
+	PublicMode = false
+	// BroadcastMode additionally encrypts readings into the advertisement, allowing paired clients to receive them without connecting.
+	BroadcastMode = false
+	// SerialLink additionally serves the bottle's characteristics over USB CDC, see package link. Debug logs are not written to the port then, stream them over the link instead, see the client's logs command.
+	SerialLink = false
+	// SensorPowerActiveLow switches on the depth sensor's supply by driving its power pin low, as required by a P-channel MOSFET on the high side. Load switches with an active-high enable input require it to be false.
+	SensorPowerActiveLow = false
 )
 
-var (
-	ServiceUUID                 = bluetooth.New32BitUUID(0xdeadbeef)
-	CharacteristicUUIDFillLevel = bluetooth.New32BitUUID(0xcafebabe)
-	CharacteristicUUIDAuth      = bluetooth.New32BitUUID(0xfefefefe)
-	CharacteristicUUIDNonce     = bluetooth.New32BitUUID(0xf00dbabe)
-	ManufacturerUUID            = uint16(0xc001)
-)
+// ManufacturerUUID is the company identifier under which the bottle advertises its manufacturer data. GATT services and characteristics are declared in package schema.
+var ManufacturerUUID = uint16(0xc001)
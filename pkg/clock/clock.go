@@ -0,0 +1,35 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// The bottle has no battery-backed RTC, its system time therefore starts at the Unix epoch on every boot. The clock keeps track of the offset to the wall clock time last set by a client.
+var (
+	mu     sync.Mutex
+	offset time.Duration
+	synced bool
+)
+
+// Set adjusts the clock to the given wall clock time.
+func Set(t time.Time) {
+	mu.Lock()
+	defer mu.Unlock()
+	offset = t.Sub(time.Now())
+	synced = true
+}
+
+// Now returns the current wall clock time, or the time since boot relative to the Unix epoch if the clock has not been set yet.
+func Now() time.Time {
+	mu.Lock()
+	defer mu.Unlock()
+	return time.Now().Add(offset)
+}
+
+// Synced reports whether the clock has been set since boot.
+func Synced() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return synced
+}
@@ -0,0 +1,104 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	broadcastCounterLen = 4
+	// Advertisements are limited to 31 bytes, we therefore truncate authentication tags. While this does not offer the same guarantees as a full-size tag, it is sufficient to make forging readings impractical over the air.
+	broadcastTagLen = 4
+	// BroadcastOverhead is the number of bytes added to a plaintext when sealing it.
+	BroadcastOverhead = broadcastCounterLen + broadcastTagLen
+	// BroadcastKeyLabel identifies the broadcast key when deriving it from the pairing key.
+	BroadcastKeyLabel = "broadcast"
+	// SessionKeyLabel identifies the session key when deriving it from the bottle's nonce and the client's secret.
+	SessionKeyLabel = "session"
+	// ConfirmationLabel identifies the tag by which the bottle proves having derived the session key, see KeyConfirmation.
+	ConfirmationLabel = "key confirmation"
+	// ConfirmationLen is the length of the tag returned by KeyConfirmation.
+	ConfirmationLen = 16
+)
+
+// DeriveKey derives a key for a specific purpose, identified by the label, from a shared secret.
+func DeriveKey(secret []byte, label string) ([]byte, error) {
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte(label)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// KeyConfirmation returns a tag derived from the session key, by which the bottle proves that it was able to decrypt the client's handshake, and thus holds the private key to the public key it presented.
+func KeyConfirmation(key []byte) ([]byte, error) {
+	tag, err := DeriveKey(key, ConfirmationLabel)
+	if err != nil {
+		return nil, err
+	}
+	return tag[:ConfirmationLen], nil
+}
+
+// BroadcastCipher encrypts and authenticates small payloads for inclusion in advertisements. As there is no room for a random nonce, frames are encrypted using AES-CTR with a counter that must never repeat for the same key.
+type BroadcastCipher struct {
+	block  cipher.Block
+	macKey []byte
+}
+
+func NewBroadcastCipher(key []byte) (*BroadcastCipher, error) {
+	encKey, err := DeriveKey(key, "broadcast encryption")
+	if err != nil {
+		return nil, err
+	}
+	macKey, err := DeriveKey(key, "broadcast authentication")
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	return &BroadcastCipher{block: block, macKey: macKey}, nil
+}
+
+// Seal encrypts the plaintext, returning a frame consisting of the counter, the ciphertext and a truncated tag.
+func (c *BroadcastCipher) Seal(counter uint32, plaintext []byte) []byte {
+	frame := make([]byte, broadcastCounterLen+len(plaintext), len(plaintext)+BroadcastOverhead)
+	binary.LittleEndian.PutUint32(frame, counter)
+	cipher.NewCTR(c.block, c.iv(counter)).XORKeyStream(frame[broadcastCounterLen:], plaintext)
+	return append(frame, c.tag(frame)...)
+}
+
+// Open authenticates and decrypts a frame, returning the counter and plaintext. Callers should reject counters which they have already seen in order to prevent replays.
+func (c *BroadcastCipher) Open(frame []byte) (uint32, []byte, error) {
+	if len(frame) < BroadcastOverhead {
+		return 0, nil, errors.New("unexpected payload size")
+	}
+	body, tag := frame[:len(frame)-broadcastTagLen], frame[len(frame)-broadcastTagLen:]
+	if !hmac.Equal(tag, c.tag(body)) {
+		return 0, nil, errors.New("message authentication failed")
+	}
+	counter := binary.LittleEndian.Uint32(body)
+	plaintext := make([]byte, len(body)-broadcastCounterLen)
+	cipher.NewCTR(c.block, c.iv(counter)).XORKeyStream(plaintext, body[broadcastCounterLen:])
+	return counter, plaintext, nil
+}
+
+func (c *BroadcastCipher) iv(counter uint32) []byte {
+	iv := make([]byte, aes.BlockSize)
+	binary.LittleEndian.PutUint32(iv, counter)
+	return iv
+}
+
+func (c *BroadcastCipher) tag(body []byte) []byte {
+	mac := hmac.New(sha256.New, c.macKey)
+	mac.Write(body)
+	return mac.Sum(nil)[:broadcastTagLen]
+}
@@ -0,0 +1,45 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBroadcast(t *testing.T) {
+	key := []byte("randomkeymaterialfromdhkex")
+	msg := []byte("hello")
+
+	c, err := NewBroadcastCipher(key)
+	if err != nil {
+		t.Fatalf("Expected nil error during cipher init, got %s", err)
+	}
+	frame := c.Seal(42, msg)
+	if len(frame) != len(msg)+BroadcastOverhead {
+		t.Fatalf("Expected frame of length %d, got %d", len(msg)+BroadcastOverhead, len(frame))
+	}
+
+	counter, recovered, err := c.Open(frame)
+	if err != nil {
+		t.Fatalf("Expected nil error while opening, got %s", err)
+	}
+	if counter != 42 {
+		t.Errorf("Expected counter to be %d, got %d", 42, counter)
+	}
+	if bytes.Compare(msg, recovered) != 0 {
+		t.Errorf("Expected decrypted plaintext to be '%s', got '%s'", string(msg), string(recovered))
+	}
+
+	// Tampering with the counter must be detected.
+	frame[0] ^= 1
+	if _, _, err := c.Open(frame); err == nil {
+		t.Error("Expected error opening tampered frame")
+	}
+
+	other, err := NewBroadcastCipher([]byte("someotherkeymaterial"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := other.Open(c.Seal(1, msg)); err == nil {
+		t.Error("Expected error opening frame sealed with a different key")
+	}
+}
@@ -56,6 +56,9 @@ func EncryptEphemeralStaticX25519(msg, publicKey []byte) ([]byte, error) {
 }
 
 func DecryptEphemeralStaticX25519(payload, privateKey []byte) ([]byte, error) {
+	if len(payload) < chacha20poly1305.NonceSize+chacha20poly1305.Overhead+curve25519.ScalarSize {
+		return nil, errors.New("unexpected payload size")
+	}
 	// Separate payload into cipher and ephemeral key.
 	offset := len(payload) - curve25519.ScalarSize
 	encryptedMessage, ephemeralKey := payload[:offset], payload[offset:]
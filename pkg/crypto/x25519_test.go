@@ -33,3 +33,12 @@ func TestEncryptionDecryption(t *testing.T) {
 		t.Errorf("Expected decrypted plaintext to be '%s', got '%s'", string(msg), string(recovered))
 	}
 }
+
+func TestDecryptionShortPayload(t *testing.T) {
+	private := make([]byte, curve25519.ScalarSize)
+	for _, payload := range [][]byte{nil, []byte("garbage"), make([]byte, curve25519.ScalarSize)} {
+		if _, err := DecryptEphemeralStaticX25519(payload, private); err == nil {
+			t.Errorf("Expected error decrypting payload of length %d", len(payload))
+		}
+	}
+}
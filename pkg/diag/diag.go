@@ -0,0 +1,44 @@
+package diag
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/toalaah/smart-bottle/pkg/build"
+	"github.com/toalaah/smart-bottle/pkg/transport"
+)
+
+// Counters of noteworthy events since boot, incremented by the packages observing them.
+var (
+	SensorFailures  atomic.Uint32
+	ChecksumErrors  atomic.Uint32
+	AuthFailures    atomic.Uint32
+	DroppedMessages atomic.Uint32
+)
+
+var (
+	boot        = time.Now()
+	resetReason atomic.Uint32
+)
+
+// SetResetReason records what caused the bottle to boot. It should be called once early on.
+func SetResetReason(r transport.ResetReason) {
+	resetReason.Store(uint32(r))
+}
+
+// Snapshot returns the current diagnostics report.
+func Snapshot() transport.Diagnostics {
+	ms := runtime.MemStats{}
+	runtime.ReadMemStats(&ms)
+	return transport.Diagnostics{
+		Uptime:          uint32(time.Since(boot) / time.Second),
+		ResetReason:     transport.ResetReason(resetReason.Load()),
+		Version:         build.ServiceVersion,
+		SensorFailures:  SensorFailures.Load(),
+		ChecksumErrors:  ChecksumErrors.Load(),
+		AuthFailures:    AuthFailures.Load(),
+		DroppedMessages: DroppedMessages.Load(),
+		FreeHeap:        uint32(ms.HeapSys - ms.HeapInuse),
+	}
+}
@@ -0,0 +1,371 @@
+// Package gateway maintains connections to several paired bottles at once, multiplexing their readings into a single stream.
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/toalaah/smart-bottle/pkg/ble/client"
+	"github.com/toalaah/smart-bottle/pkg/transport"
+	"tinygo.org/x/bluetooth"
+)
+
+// State describes the state of the gateway's session with a bottle.
+type State uint8
+
+const (
+	// StateSearching bottles have not been found yet, or their last connection attempt failed.
+	StateSearching State = iota
+	StateConnecting
+	StateConnected
+	// StateReconnecting bottles lost their connection, which their client attempts to restore.
+	StateReconnecting
+)
+
+func (s State) String() string {
+	switch s {
+	case StateSearching:
+		return "searching"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(s))
+	}
+}
+
+// Reading is a decrypted reading tagged with the bottle it originates from.
+type Reading = client.Reading
+
+// Status is a snapshot of the gateway's session with a bottle.
+type Status struct {
+	Device  transport.DeviceID
+	Address bluetooth.Address
+	State   State
+	// Battery level in percent, -1 if unknown.
+	Battery int
+	// LastSeq is the sequence number of the latest reading received, which is replayed from after reconnecting.
+	LastSeq  uint32
+	LastSeen time.Time
+	// Notifications dropped due to backpressure or found malformed, see client.DeliveryStats.
+	Dropped, Malformed uint64
+	// Err is the error which caused the latest connection loss or failed connection attempt.
+	Err error
+}
+
+// session holds the state of a single bottle. Fields are guarded by the manager's mutex.
+type session struct {
+	pin     []byte
+	client  *client.GattClient
+	session *client.Session
+	status  Status
+}
+
+// Manager maintains connections to the paired bottles added to it. Every bottle gets its own client, session key and reconnect loop, while bottles which have not been found yet are searched for periodically.
+type Manager struct {
+	logger       *slog.Logger
+	scanDuration time.Duration
+	scanInterval time.Duration
+	clientOpts   []client.ClientOption
+
+	mu       sync.Mutex
+	sessions map[transport.DeviceID]*session
+	readings chan Reading
+}
+
+func New(opts ...ManagerOption) *Manager {
+	m := &Manager{
+		logger:       nil,
+		scanDuration: 10 * time.Second,
+		scanInterval: 20 * time.Second,
+		sessions:     map[transport.DeviceID]*session{},
+		readings:     make(chan Reading, 16),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Add registers a paired bottle along with its pairing pin. It is connected to once found by Run.
+func (m *Manager) Add(id transport.DeviceID, pin []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.sessions[id]; ok {
+		return
+	}
+	m.sessions[id] = &session{pin: append([]byte{}, pin...), status: Status{Device: id, Battery: -1}}
+}
+
+// Readings returns the readings of all bottles, as they arrive.
+func (m *Manager) Readings() <-chan Reading {
+	return m.readings
+}
+
+// Status returns a snapshot of all sessions, ordered by device ID.
+func (m *Manager) Status() []Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	statuses := make([]Status, 0, len(m.sessions))
+	for _, sess := range m.sessions {
+		status := sess.status
+		if sess.client != nil {
+			stats := sess.client.Stats()
+			status.Dropped, status.Malformed = stats.Dropped, stats.Malformed
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Device.String() < statuses[j].Device.String()
+	})
+	return statuses
+}
+
+// Run searches for bottles which are not connected yet and connects to them, until ctx is canceled. All bottles are disconnected before returning.
+func (m *Manager) Run(ctx context.Context) error {
+	defer m.disconnectAll()
+	for {
+		if pending := m.pending(); len(pending) > 0 {
+			for id, address := range m.discover(ctx, pending) {
+				go m.connect(ctx, id, address)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(m.scanInterval):
+		}
+	}
+}
+
+// pending returns the IDs of bottles which are still searched for.
+func (m *Manager) pending() map[transport.DeviceID]bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pending := map[transport.DeviceID]bool{}
+	for id, sess := range m.sessions {
+		if sess.status.State == StateSearching {
+			pending[id] = true
+		}
+	}
+	return pending
+}
+
+// discover scans for the given bottles, returning the addresses of those found. Scanning stops early once all of them have been found.
+func (m *Manager) discover(ctx context.Context, pending map[transport.DeviceID]bool) map[transport.DeviceID]bluetooth.Address {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	m.debug("searching for bottles", "count", len(pending))
+	found := map[transport.DeviceID]bluetooth.Address{}
+	bottles, err := client.New(client.WithLogger(m.logger)).Scan(ctx, m.scanDuration)
+	if err != nil {
+		m.debug("failed to scan for bottles", "error", err)
+		return found
+	}
+	for b := range bottles {
+		if !pending[b.ID] {
+			continue
+		}
+		if _, ok := found[b.ID]; !ok {
+			m.debug("found bottle", "id", b.ID, "address", b.Address.String(), "rssi", b.RSSI)
+		}
+		found[b.ID] = b.Address
+		if len(found) == len(pending) {
+			cancel()
+		}
+	}
+	return found
+}
+
+// connect establishes a session with the given bottle and pumps its readings until ctx is canceled. If connecting or authenticating fails, the bottle is searched for again.
+func (m *Manager) connect(ctx context.Context, id transport.DeviceID, address bluetooth.Address) {
+	var logger *slog.Logger
+	if m.logger != nil {
+		logger = m.logger.With("device", id.String())
+	}
+	opts := append([]client.ClientOption{client.WithLogger(logger)}, m.clientOpts...)
+	c := client.New(append(opts, client.WithDeviceID(id))...)
+
+	m.mu.Lock()
+	sess := m.sessions[id]
+	sess.status.Address = address
+	sess.status.State = StateConnecting
+	m.mu.Unlock()
+
+	cs, err := m.pair(ctx, c, sess)
+	if err != nil {
+		m.debug("failed to connect to bottle", "id", id, "error", err)
+		_ = c.Disconnect(context.Background())
+		m.update(id, func(s *session) {
+			s.status.State = StateSearching
+			s.status.Err = err
+		})
+		return
+	}
+	m.update(id, func(s *session) {
+		s.client = c
+		s.session = cs
+		s.status.State = StateConnected
+		s.status.Err = nil
+	})
+	m.sync(id)
+
+	go m.watchBattery(ctx, id, c.Battery())
+	go m.watchErrors(ctx, id, c, cs)
+	go m.watchEvents(ctx, id, c.Events())
+	m.pump(ctx, id, cs.Readings())
+}
+
+// pair connects and authenticates, returning the resulting session.
+func (m *Manager) pair(ctx context.Context, c *client.GattClient, sess *session) (*client.Session, error) {
+	if err := c.Connect(ctx, sess.status.Address); err != nil {
+		return nil, err
+	}
+	return c.NewSession(ctx, sess.pin)
+}
+
+// sync requests readings missed while the bottle was disconnected, if it buffers them.
+func (m *Manager) sync(id transport.DeviceID) {
+	m.mu.Lock()
+	c, cs, since := m.sessions[id].client, m.sessions[id].session, m.sessions[id].status.LastSeq
+	m.mu.Unlock()
+	if !c.Capabilities().Features.Has(transport.FeatureBatching) {
+		return
+	}
+	m.debug("requesting buffered readings", "id", id, "since", since)
+	if err := cs.Sync(since); err != nil {
+		m.debug("failed to request buffered readings", "id", id, "error", err)
+	}
+}
+
+// pump forwards the readings of a bottle to the multiplexed stream.
+func (m *Manager) pump(ctx context.Context, id transport.DeviceID, readings <-chan Reading) {
+	for {
+		var (
+			r  Reading
+			ok bool
+		)
+		select {
+		case <-ctx.Done():
+			return
+		case r, ok = <-readings:
+			if !ok {
+				return
+			}
+		}
+		m.update(id, func(s *session) {
+			if r.Seq > s.status.LastSeq {
+				s.status.LastSeq = r.Seq
+			}
+			s.status.LastSeen = time.Now()
+		})
+		select {
+		case <-ctx.Done():
+			return
+		case m.readings <- r:
+		}
+	}
+}
+
+// watchEvents tracks the connection state of a bottle. After reconnecting, its session requests missed readings on its own.
+func (m *Manager) watchEvents(ctx context.Context, id transport.DeviceID, events <-chan client.ConnectionEvent) {
+	for {
+		var e client.ConnectionEvent
+		select {
+		case <-ctx.Done():
+			return
+		case e = <-events:
+		}
+		m.update(id, func(s *session) {
+			s.status.State = StateReconnecting
+			if e.State == client.StateConnected {
+				s.status.State = StateConnected
+			}
+			if e.Err != nil {
+				s.status.Err = e.Err
+			}
+		})
+	}
+}
+
+func (m *Manager) watchBattery(ctx context.Context, id transport.DeviceID, levels <-chan uint8) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case level := <-levels:
+			m.update(id, func(s *session) {
+				s.status.Battery = int(level)
+			})
+		}
+	}
+}
+
+func (m *Manager) watchErrors(ctx context.Context, id transport.DeviceID, c *client.GattClient, cs *client.Session) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-c.Errors():
+			m.debug("failed to handle notification", "id", id, "error", err)
+		case err := <-cs.Errors():
+			m.debug("discarded reading", "id", id, "error", err)
+		}
+	}
+}
+
+func (m *Manager) update(id transport.DeviceID, fn func(s *session)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fn(m.sessions[id])
+}
+
+func (m *Manager) disconnectAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, sess := range m.sessions {
+		if sess.client == nil {
+			continue
+		}
+		m.debug("disconnecting bottle", "id", id)
+		if err := sess.client.Disconnect(context.Background()); err != nil {
+			m.debug("failed to disconnect bottle", "id", id, "error", err)
+		}
+	}
+}
+
+func (m *Manager) debug(msg string, args ...any) {
+	if m.logger != nil {
+		m.logger.Debug(msg, args...)
+	}
+}
+
+type ManagerOption func(*Manager)
+
+func WithLogger(l *slog.Logger) ManagerOption {
+	return func(m *Manager) {
+		m.logger = l.With("service", "gateway")
+	}
+}
+
+// WithScan sets how long to scan for bottles which have not been found yet, and how long to wait in between.
+func WithScan(duration, interval time.Duration) ManagerOption {
+	return func(m *Manager) {
+		m.scanDuration = duration
+		m.scanInterval = interval
+	}
+}
+
+// WithClientOptions applies the given options to the clients of all bottles, e.g. to tune timeouts or backoff.
+func WithClientOptions(opts ...client.ClientOption) ManagerOption {
+	return func(m *Manager) {
+		m.clientOpts = append(m.clientOpts, opts...)
+	}
+}
@@ -0,0 +1,133 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/toalaah/smart-bottle/pkg/ble/client"
+	"github.com/toalaah/smart-bottle/pkg/transport"
+)
+
+var (
+	first  = transport.DeviceID{0x01}
+	second = transport.DeviceID{0x02}
+)
+
+// await polls the status of the given bottle until cond holds, failing the test after a second.
+func await(t *testing.T, m *Manager, id transport.DeviceID, cond func(s Status) bool) Status {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		for _, s := range m.Status() {
+			if s.Device == id && cond(s) {
+				return s
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected status of '%s' to change, got '%+v'", id, m.Status())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	m := New()
+	m.Add(second, []byte{2})
+	m.Add(first, []byte{1})
+	// Adding a bottle twice keeps its session.
+	m.update(first, func(s *session) {
+		s.status.State = StateConnected
+		s.client = client.New()
+	})
+	m.Add(first, []byte{3})
+
+	statuses := m.Status()
+	if len(statuses) != 2 {
+		t.Fatalf("Expected '%v' statuses, got '%v'", 2, len(statuses))
+	}
+	if statuses[0].Device != first || statuses[1].Device != second {
+		t.Errorf("Expected statuses to be ordered by device ID, got '%+v'", statuses)
+	}
+	if statuses[0].State != StateConnected {
+		t.Errorf("Expected state of re-added bottle to be '%v', got '%v'", StateConnected, statuses[0].State)
+	}
+	if pin := m.sessions[first].pin; len(pin) != 1 || pin[0] != 1 {
+		t.Errorf("Expected pin of re-added bottle to be '%v', got '%v'", []byte{1}, pin)
+	}
+	if statuses[1].State != StateSearching || statuses[1].Battery != -1 {
+		t.Errorf("Expected new bottle to be searched for with unknown battery level, got '%+v'", statuses[1])
+	}
+	if statuses[0].Dropped != 0 || statuses[0].Malformed != 0 {
+		t.Errorf("Expected delivery counters of connected bottle to be '%v', got '%v' and '%v'", 0, statuses[0].Dropped, statuses[0].Malformed)
+	}
+
+	pending := m.pending()
+	if len(pending) != 1 || !pending[second] {
+		t.Errorf("Expected only '%s' to be pending, got '%v'", second, pending)
+	}
+}
+
+func TestWatchEvents(t *testing.T) {
+	m := New()
+	m.Add(first, nil)
+	m.update(first, func(s *session) { s.status.State = StateConnected })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan client.ConnectionEvent)
+	go m.watchEvents(ctx, first, events)
+
+	lost := errors.New("connection lost")
+	events <- client.ConnectionEvent{State: client.StateDisconnected, Err: lost}
+	s := await(t, m, first, func(s Status) bool { return s.State == StateReconnecting })
+	if s.Err != lost {
+		t.Errorf("Expected error to be '%v', got '%v'", lost, s.Err)
+	}
+
+	events <- client.ConnectionEvent{State: client.StateReconnecting, Attempt: 1}
+	events <- client.ConnectionEvent{State: client.StateConnected, Attempt: 1}
+	s = await(t, m, first, func(s Status) bool { return s.State == StateConnected })
+	if s.Err != lost {
+		t.Errorf("Expected error of latest connection loss to be kept as '%v', got '%v'", lost, s.Err)
+	}
+	if pending := m.pending(); len(pending) != 0 {
+		t.Errorf("Expected reconnecting bottles not to be searched for, got '%v'", pending)
+	}
+}
+
+func TestPumpAndBattery(t *testing.T) {
+	m := New()
+	m.Add(first, nil)
+	m.Add(second, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	readings := make(chan Reading, 2)
+	levels := make(chan uint8, 1)
+	go m.pump(ctx, first, readings)
+	go m.watchBattery(ctx, first, levels)
+
+	readings <- Reading{Device: first, Reading: transport.Reading{Seq: 7}}
+	// Replayed readings arriving out of order must not move the sequence number back.
+	readings <- Reading{Device: first, Historic: true, Reading: transport.Reading{Seq: 3}}
+	for _, seq := range []uint32{7, 3} {
+		select {
+		case r := <-m.Readings():
+			if r.Seq != seq {
+				t.Errorf("Expected reading with seq '%v', got '%v'", seq, r.Seq)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected reading to be forwarded")
+		}
+	}
+	s := await(t, m, first, func(s Status) bool { return !s.LastSeen.IsZero() })
+	if s.LastSeq != 7 {
+		t.Errorf("Expected last seq to be '%v', got '%v'", 7, s.LastSeq)
+	}
+
+	levels <- 42
+	await(t, m, first, func(s Status) bool { return s.Battery == 42 })
+	if s := m.Status()[1]; s.LastSeq != 0 || s.Battery != -1 {
+		t.Errorf("Expected other bottle to be unaffected, got '%+v'", s)
+	}
+}
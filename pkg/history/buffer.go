@@ -0,0 +1,189 @@
+package history
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"log/slog"
+
+	"github.com/toalaah/smart-bottle/pkg/storage"
+	"github.com/toalaah/smart-bottle/pkg/transport"
+)
+
+// recordLen is the size of a persisted reading: the marshaled reading followed by a CRC32 checksum.
+const recordLen = transport.ReadingLen + 4
+
+// Buffer is a bounded ring buffer of readings. Once full, the oldest readings are overwritten. If a store is configured, every reading is additionally appended to a circular log on the block device so that the buffer survives resets and brownouts.
+type Buffer struct {
+	logger   *slog.Logger
+	capacity uint32
+	records  []transport.Reading
+	last     uint32
+
+	store storage.BlockDevice
+	// Next free record slot in the store.
+	slot int64
+	// In-memory copy of the write block containing slot. NOR flash can only be programmed block-wise, so the whole block is rewritten on every append.
+	block []byte
+}
+
+func New(opts ...BufferOption) *Buffer {
+	b := &Buffer{
+		logger:   nil,
+		capacity: 1024,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	b.records = make([]transport.Reading, b.capacity)
+	return b
+}
+
+// Load restores buffered readings from the configured store. It must be called once before the first call to Append.
+func (b *Buffer) Load() error {
+	if b.store == nil {
+		return nil
+	}
+	if b.store.WriteBlockSize()%recordLen != 0 || b.store.EraseBlockSize()%b.store.WriteBlockSize() != 0 {
+		return errors.New("unsupported store geometry")
+	}
+	if b.store.Size()/b.store.EraseBlockSize() < 2 {
+		return errors.New("store must span at least two erase blocks")
+	}
+	b.block = make([]byte, b.store.WriteBlockSize())
+
+	var (
+		r       transport.Reading
+		rec     = make([]byte, recordLen)
+		lastPos = int64(-1)
+	)
+	for i := int64(0); i < b.slots(); i++ {
+		if ok, err := b.readSlot(i, rec, &r); err != nil {
+			return err
+		} else if ok && r.Seq > b.last {
+			b.last, lastPos = r.Seq, i
+		}
+	}
+	for i := int64(0); i < b.slots(); i++ {
+		if ok, err := b.readSlot(i, rec, &r); err != nil {
+			return err
+		} else if ok && r.Seq+b.capacity > b.last {
+			b.records[r.Seq%b.capacity] = r
+		}
+	}
+	b.debug("restored history", "last", b.last, "slot", lastPos)
+
+	b.slot = (lastPos + 1) % b.slots()
+	if b.slot%b.slotsPerBlock() != 0 {
+		blockOff := b.slot / b.slotsPerBlock() * b.store.WriteBlockSize()
+		if _, err := b.store.ReadAt(b.block, blockOff); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Append assigns the next sequence number to a reading, buffers it and persists it if a store is configured.
+func (b *Buffer) Append(timestamp uint32, value float32) (transport.Reading, error) {
+	b.last++
+	r := transport.Reading{Seq: b.last, Timestamp: timestamp, Value: value}
+	b.records[r.Seq%b.capacity] = r
+	if b.store == nil {
+		return r, nil
+	}
+	return r, b.persist(&r)
+}
+
+// Since calls fn for every buffered reading with a sequence number greater than seq in ascending order. A sequence number ahead of the most recent reading indicates that the bottle's history was wiped, in which case all buffered readings are returned.
+func (b *Buffer) Since(seq uint32, fn func(r transport.Reading) error) error {
+	if seq > b.last {
+		seq = 0
+	}
+	first := seq + 1
+	if b.last >= b.capacity && first <= b.last-b.capacity {
+		first = b.last - b.capacity + 1
+	}
+	for s := first; s <= b.last && s != 0; s++ {
+		r := b.records[s%b.capacity]
+		if r.Seq != s {
+			continue
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Last returns the sequence number of the most recent reading, or zero if no reading has been recorded yet.
+func (b *Buffer) Last() uint32 {
+	return b.last
+}
+
+func (b *Buffer) persist(r *transport.Reading) error {
+	perBlock := b.slotsPerBlock()
+	if b.slot%(b.store.EraseBlockSize()/recordLen) == 0 {
+		if err := b.store.EraseBlocks(b.slot*recordLen/b.store.EraseBlockSize(), 1); err != nil {
+			return err
+		}
+	}
+	if b.slot%perBlock == 0 {
+		for i := range b.block {
+			b.block[i] = 0xff
+		}
+	}
+	rec := b.block[(b.slot%perBlock)*recordLen:][:recordLen]
+	copy(rec, r.MarshalBytes())
+	binary.LittleEndian.PutUint32(rec[transport.ReadingLen:], crc32.ChecksumIEEE(rec[:transport.ReadingLen]))
+	if _, err := b.store.WriteAt(b.block, b.slot/perBlock*b.store.WriteBlockSize()); err != nil {
+		return err
+	}
+	b.slot = (b.slot + 1) % b.slots()
+	return nil
+}
+
+func (b *Buffer) readSlot(i int64, rec []byte, r *transport.Reading) (bool, error) {
+	if _, err := b.store.ReadAt(rec, i*recordLen); err != nil {
+		return false, err
+	}
+	if binary.LittleEndian.Uint32(rec[transport.ReadingLen:]) != crc32.ChecksumIEEE(rec[:transport.ReadingLen]) {
+		return false, nil
+	}
+	return true, transport.UnmarshalReading(r, rec)
+}
+
+func (b *Buffer) slots() int64 {
+	return b.store.Size() / recordLen
+}
+
+func (b *Buffer) slotsPerBlock() int64 {
+	return b.store.WriteBlockSize() / recordLen
+}
+
+func (b *Buffer) debug(msg string, args ...any) {
+	if b.logger != nil {
+		b.logger.Debug(msg, args...)
+	}
+}
+
+type BufferOption func(*Buffer)
+
+// WithCapacity sets the number of readings kept in memory.
+func WithCapacity(n uint32) BufferOption {
+	return func(b *Buffer) {
+		b.capacity = n
+	}
+}
+
+// WithStore persists readings to the given block device. The device should be large enough to hold at least the configured capacity plus one erase block, as the oldest erase block is discarded whenever the log wraps around.
+func WithStore(s storage.BlockDevice) BufferOption {
+	return func(b *Buffer) {
+		b.store = s
+	}
+}
+
+func WithLogger(l *slog.Logger) BufferOption {
+	return func(b *Buffer) {
+		b.logger = l.With("service", "history")
+	}
+}
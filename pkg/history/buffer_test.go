@@ -0,0 +1,93 @@
+package history
+
+import (
+	"testing"
+
+	"github.com/toalaah/smart-bottle/pkg/storage"
+	"github.com/toalaah/smart-bottle/pkg/transport"
+)
+
+func collect(t *testing.T, b *Buffer, since uint32) []transport.Reading {
+	var out []transport.Reading
+	if err := b.Since(since, func(r transport.Reading) error {
+		out = append(out, r)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestBufferSince(t *testing.T) {
+	b := New(WithCapacity(4))
+	if err := b.Load(); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 6 {
+		if _, err := b.Append(uint32(i), float32(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := collect(t, b, 0)
+	if len(got) != 4 || got[0].Seq != 3 || got[3].Seq != 6 {
+		t.Errorf("Expected the 4 most recent readings, got '%+v'", got)
+	}
+	got = collect(t, b, 5)
+	if len(got) != 1 || got[0].Seq != 6 {
+		t.Errorf("Expected only reading 6, got '%+v'", got)
+	}
+	if got := collect(t, b, 6); len(got) != 0 {
+		t.Errorf("Expected no readings, got '%+v'", got)
+	}
+	if got := collect(t, b, 100); len(got) != 4 {
+		t.Errorf("Expected all readings for sequence number ahead of buffer, got '%+v'", got)
+	}
+}
+
+func TestBufferPersistence(t *testing.T) {
+	// 4 records per write block, 8 per erase block, 32 in total.
+	store := storage.NewMemory(512, 64, 128)
+
+	b := New(WithCapacity(16), WithStore(store))
+	if err := b.Load(); err != nil {
+		t.Fatal(err)
+	}
+	// Wrap around the log at least once.
+	for i := range 45 {
+		if _, err := b.Append(uint32(i), float32(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	restored := New(WithCapacity(16), WithStore(store))
+	if err := restored.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Last() != 45 {
+		t.Fatalf("Expected last sequence number to be %d, got %d", 45, restored.Last())
+	}
+	got := collect(t, restored, 0)
+	if len(got) != 16 || got[0].Seq != 30 || got[15].Seq != 45 {
+		t.Fatalf("Expected readings 30 to 45, got '%+v'", got)
+	}
+	for _, r := range got {
+		if r.Value != float32(r.Seq-1) {
+			t.Errorf("Expected reading %d to have value %f, got %f", r.Seq, float32(r.Seq-1), r.Value)
+		}
+	}
+
+	// Appending after a restore must continue both the sequence and the log.
+	if r, err := restored.Append(45, 45); err != nil {
+		t.Fatal(err)
+	} else if r.Seq != 46 {
+		t.Errorf("Expected next sequence number to be %d, got %d", 46, r.Seq)
+	}
+	again := New(WithCapacity(16), WithStore(store))
+	if err := again.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if again.Last() != 46 {
+		t.Errorf("Expected last sequence number to be %d, got %d", 46, again.Last())
+	}
+}
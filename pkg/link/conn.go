@@ -0,0 +1,224 @@
+package link
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+var (
+	ErrClosed  = errors.New("link is closed")
+	ErrTimeout = errors.New("bottle did not respond in time")
+)
+
+// Conn is the client end of a link. Requests are issued one at a time, as the bottle answers them in order.
+type Conn struct {
+	rwc     io.ReadWriteCloser
+	timeout time.Duration
+
+	wmu       sync.Mutex
+	reqMu     sync.Mutex
+	responses chan Frame
+
+	mu       sync.Mutex
+	handlers map[bluetooth.UUID]func([]byte)
+	done     chan struct{}
+	err      error
+}
+
+// NewConn starts a session with the bottle on the other end of rwc. Requests fail with ErrTimeout if the bottle does not answer within the given duration.
+func NewConn(rwc io.ReadWriteCloser, timeout time.Duration) (*Conn, error) {
+	c := &Conn{
+		rwc:       rwc,
+		timeout:   timeout,
+		responses: make(chan Frame, 1),
+		handlers:  map[bluetooth.UUID]func([]byte){},
+		done:      make(chan struct{}),
+	}
+	go c.readLoop()
+	if err := c.send(Frame{Op: OpHello}); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Discover returns the UUIDs of all characteristics served by the bottle.
+func (c *Conn) Discover() ([]bluetooth.UUID, error) {
+	f, err := c.request(Frame{Op: OpDiscover})
+	if err != nil {
+		return nil, err
+	}
+	if len(f.Payload)%16 != 0 {
+		return nil, fmt.Errorf("expected multiple of 16 bytes, got %d", len(f.Payload))
+	}
+	uuids := make([]bluetooth.UUID, 0, len(f.Payload)/16)
+	for i := 0; i < len(f.Payload); i += 16 {
+		uuids = append(uuids, uuidFromBytes(f.Payload[i:]))
+	}
+	return uuids, nil
+}
+
+// Read returns the current value of the given characteristic.
+func (c *Conn) Read(uuid bluetooth.UUID) ([]byte, error) {
+	f, err := c.request(Frame{Op: OpRead, UUID: uuid})
+	if err != nil {
+		return nil, err
+	}
+	return f.Payload, nil
+}
+
+// Write writes to the given characteristic without waiting for a response, as writes without response over Bluetooth do.
+func (c *Conn) Write(uuid bluetooth.UUID, p []byte) error {
+	return c.send(Frame{Op: OpWrite, UUID: uuid, Payload: p})
+}
+
+// Subscribe invokes fn with every value the bottle notifies on the given characteristic.
+func (c *Conn) Subscribe(uuid bluetooth.UUID, fn func([]byte)) error {
+	c.mu.Lock()
+	c.handlers[uuid] = fn
+	c.mu.Unlock()
+	return c.send(Frame{Op: OpSubscribe, UUID: uuid})
+}
+
+// Characteristic returns a handle to the given characteristic, which offers the same methods as a bluetooth.DeviceCharacteristic.
+func (c *Conn) Characteristic(uuid bluetooth.UUID) *RemoteCharacteristic {
+	return &RemoteCharacteristic{conn: c, uuid: uuid}
+}
+
+// Done is closed once the link fails or is closed, see Err.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the error which caused the link to fail.
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *Conn) Close() error {
+	err := c.rwc.Close()
+	c.fail(ErrClosed)
+	return err
+}
+
+func (c *Conn) request(f Frame) (Frame, error) {
+	c.reqMu.Lock()
+	defer c.reqMu.Unlock()
+	// Discard a response to a previous request which timed out.
+	select {
+	case <-c.responses:
+	default:
+	}
+	if err := c.send(f); err != nil {
+		return Frame{}, err
+	}
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case resp := <-c.responses:
+			if resp.UUID != f.UUID {
+				continue
+			}
+			if resp.Op == OpError {
+				return Frame{}, fmt.Errorf("%s %s: %s", f.Op, f.UUID.String(), resp.Payload)
+			}
+			return resp, nil
+		case <-timer.C:
+			return Frame{}, ErrTimeout
+		case <-c.done:
+			return Frame{}, c.Err()
+		}
+	}
+}
+
+func (c *Conn) send(f Frame) error {
+	select {
+	case <-c.done:
+		return c.Err()
+	default:
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := WriteFrame(c.rwc, f); err != nil {
+		c.fail(err)
+		return err
+	}
+	return nil
+}
+
+func (c *Conn) readLoop() {
+	r := NewReader(c.rwc)
+	for {
+		f, err := r.ReadFrame()
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		switch f.Op {
+		case OpNotify:
+			c.mu.Lock()
+			fn := c.handlers[f.UUID]
+			c.mu.Unlock()
+			if fn != nil {
+				fn(f.Payload)
+			}
+		case OpValue, OpError:
+			select {
+			case c.responses <- f:
+			default:
+			}
+		}
+	}
+}
+
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+}
+
+// RemoteCharacteristic is a characteristic reached over a link.
+type RemoteCharacteristic struct {
+	conn *Conn
+	uuid bluetooth.UUID
+}
+
+func (c *RemoteCharacteristic) UUID() bluetooth.UUID {
+	return c.uuid
+}
+
+// Read copies the characteristic's current value into p.
+func (c *RemoteCharacteristic) Read(p []byte) (int, error) {
+	v, err := c.conn.Read(c.uuid)
+	if err != nil {
+		return 0, err
+	}
+	return copy(p, v), nil
+}
+
+func (c *RemoteCharacteristic) WriteWithoutResponse(p []byte) (int, error) {
+	if err := c.conn.Write(c.uuid, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *RemoteCharacteristic) EnableNotifications(fn func(p []byte)) error {
+	return c.conn.Subscribe(c.uuid, fn)
+}
+
+func (c *RemoteCharacteristic) GetMTU() (uint16, error) {
+	return DefaultMTU, nil
+}
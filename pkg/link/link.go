@@ -0,0 +1,179 @@
+// Package link carries the bottle's GATT characteristics over byte streams such as USB serial or network connections to a bridge, for setups in which Bluetooth is unavailable or unreliable. Every frame addresses a characteristic by its UUID, so that both ends speak the exact same protocol as over Bluetooth, including authentication and encryption.
+package link
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// Op is the kind of a frame.
+type Op uint8
+
+const (
+	// OpHello is sent by clients to start a session, which resets the bottle's authentication state as a new Bluetooth connection would.
+	OpHello Op = iota + 1
+	// OpDiscover requests the UUIDs of all characteristics, which are returned as a single value frame.
+	OpDiscover
+	OpRead
+	OpWrite
+	OpSubscribe
+	// OpValue answers OpRead and OpDiscover.
+	OpValue
+	OpNotify
+	// OpError answers requests for characteristics which do not exist or do not support the requested operation. Its payload is a human readable reason.
+	OpError
+)
+
+func (o Op) String() string {
+	switch o {
+	case OpHello:
+		return "hello"
+	case OpDiscover:
+		return "discover"
+	case OpRead:
+		return "read"
+	case OpWrite:
+		return "write"
+	case OpSubscribe:
+		return "subscribe"
+	case OpValue:
+		return "value"
+	case OpNotify:
+		return "notify"
+	case OpError:
+		return "error"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(o))
+	}
+}
+
+const (
+	// MaxPayload is the maximum size of a frame's payload in bytes.
+	MaxPayload = 512
+	// DefaultMTU is reported as the MTU of characteristics reached over a link. It matches Bluetooth's default, so that payloads sized by the MTU fit the bottle's buffers.
+	DefaultMTU = 23
+
+	// Magic, op, UUID and payload length.
+	headerLen = 2 + 1 + 16 + 2
+	crcLen    = 2
+)
+
+// magic marks the start of a frame. Bytes which merely look like it, such as within a payload or garbage on the line, are told apart by the checksum, upon which the reader resynchronizes on the byte following the false magic, see Reader.ReadFrame.
+var magic = [2]byte{0xb0, 0x77}
+
+var ErrPayloadTooLarge = errors.New("payload exceeds maximum frame size")
+
+// Frame is a single request, response or notification.
+type Frame struct {
+	Op      Op
+	UUID    bluetooth.UUID
+	Payload []byte
+}
+
+// MarshalBytes encodes the frame, followed by a CRC-16 over everything but the magic bytes.
+func (f *Frame) MarshalBytes() ([]byte, error) {
+	if len(f.Payload) > MaxPayload {
+		return nil, ErrPayloadTooLarge
+	}
+	b := make([]byte, headerLen+len(f.Payload)+crcLen)
+	copy(b, magic[:])
+	b[2] = byte(f.Op)
+	uuid := f.UUID.Bytes()
+	copy(b[3:], uuid[:])
+	binary.LittleEndian.PutUint16(b[19:], uint16(len(f.Payload)))
+	copy(b[headerLen:], f.Payload)
+	binary.LittleEndian.PutUint16(b[headerLen+len(f.Payload):], crc16(b[2:headerLen+len(f.Payload)]))
+	return b, nil
+}
+
+// WriteFrame writes the frame using a single call to w, so that concurrent writers serialized by the caller never interleave.
+func WriteFrame(w io.Writer, f Frame) error {
+	b, err := f.MarshalBytes()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// Reader reads frames from a byte stream, skipping anything which is not a valid frame.
+type Reader struct {
+	r *bufio.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReaderSize(r, headerLen+MaxPayload+crcLen)}
+}
+
+// ReadFrame returns the next valid frame. Bytes preceding it, such as log output or frames with a bad checksum, are discarded. Frames are only consumed once valid, so that a frame following bytes which merely look like a header is not lost.
+func (r *Reader) ReadFrame() (Frame, error) {
+	for {
+		b, err := r.r.Peek(len(magic))
+		if err != nil {
+			return Frame{}, err
+		}
+		if b[0] != magic[0] || b[1] != magic[1] {
+			r.r.Discard(1)
+			continue
+		}
+		if b, err = r.r.Peek(headerLen); err != nil {
+			return Frame{}, err
+		}
+		n := int(binary.LittleEndian.Uint16(b[19:]))
+		if n > MaxPayload {
+			r.r.Discard(1)
+			continue
+		}
+		if b, err = r.r.Peek(headerLen + n + crcLen); err != nil {
+			return Frame{}, err
+		}
+		if binary.LittleEndian.Uint16(b[headerLen+n:]) != crc16(b[2:headerLen+n]) {
+			// Resynchronize right after the false magic, as the actual frame may start within the bytes peeked.
+			r.r.Discard(1)
+			continue
+		}
+		buf := make([]byte, headerLen+n+crcLen)
+		copy(buf, b)
+		r.r.Discard(len(buf))
+		return Frame{Op: Op(buf[2]), UUID: uuidFromBytes(buf[3:19]), Payload: buf[headerLen : headerLen+n]}, nil
+	}
+}
+
+// uuidFromBytes decodes a UUID in Bluetooth's little endian wire order, as returned by bluetooth.UUID.Bytes.
+func uuidFromBytes(b []byte) bluetooth.UUID {
+	var be [16]byte
+	for i := range be {
+		be[i] = b[15-i]
+	}
+	return bluetooth.NewUUID(be)
+}
+
+// crc16 computes the CRC-16/CCITT-FALSE checksum of b.
+func crc16(b []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, v := range b {
+		crc ^= uint16(v) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// SplitAddress splits the address of a bridge into the network and address accepted by net.Dial and net.Listen. Addresses of the form unix:/path denote Unix sockets, all others TCP.
+func SplitAddress(s string) (network, address string) {
+	if path, ok := strings.CutPrefix(s, "unix:"); ok {
+		return "unix", path
+	}
+	return "tcp", s
+}
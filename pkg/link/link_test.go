@@ -0,0 +1,165 @@
+package link
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+func TestFrameMarshaling(t *testing.T) {
+	f := Frame{Op: OpNotify, UUID: bluetooth.CharacteristicUUIDBatteryLevel, Payload: []byte{42}}
+	b, err := f.MarshalBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := append([]byte{}, b...)
+	corrupt[len(corrupt)-3] ^= 0xff
+
+	// Frames are found in between log output, frames with bad checksums are skipped.
+	stream := bytes.NewBuffer(nil)
+	stream.WriteString("time=12:00:00 level=DEBUG msg=\"writing value\"\n")
+	stream.Write(magic[:1])
+	stream.Write(corrupt)
+	stream.Write(b)
+	got, err := NewReader(stream).ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Op != f.Op || got.UUID != f.UUID || !bytes.Equal(got.Payload, f.Payload) {
+		t.Errorf("Expected frame to be '%+v', got '%+v'", f, got)
+	}
+
+	// A false header claiming a payload spanning the actual frame must not swallow it.
+	stream.Reset()
+	stream.Write(magic[:])
+	stream.Write(make([]byte, 17))
+	stream.Write([]byte{byte(len(b)), 0})
+	stream.Write(b)
+	stream.WriteString("\n\n")
+	got, err = NewReader(stream).ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Op != f.Op || got.UUID != f.UUID || !bytes.Equal(got.Payload, f.Payload) {
+		t.Errorf("Expected frame following a false header to be '%+v', got '%+v'", f, got)
+	}
+
+	f.Payload = make([]byte, MaxPayload+1)
+	if _, err := f.MarshalBytes(); err != ErrPayloadTooLarge {
+		t.Errorf("Expected marshaling oversized frame to return '%v', got '%v'", ErrPayloadTooLarge, err)
+	}
+}
+
+func TestConn(t *testing.T) {
+	var (
+		level   = bluetooth.CharacteristicUUIDBatteryLevel
+		command = bluetooth.CharacteristicUUIDAlertLevel
+		unknown = bluetooth.CharacteristicUUIDCurrentTime
+		hellos  = make(chan struct{}, 1)
+		writes  = make(chan []byte, 1)
+	)
+	bottle, host := net.Pipe()
+	srv := NewServer(bottle, []Characteristic{
+		{UUID: level, Value: []byte{100}},
+		{UUID: command, Value: []byte{0}, OnWrite: func(v []byte) { writes <- v }},
+	}, func() { hellos <- struct{}{} })
+	go srv.Serve()
+
+	c, err := NewConn(host, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	<-hellos
+
+	uuids, err := c.Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uuids) != 2 || uuids[0] != level || uuids[1] != command {
+		t.Errorf("Expected discovered characteristics to be '%v', got '%v'", []bluetooth.UUID{level, command}, uuids)
+	}
+
+	buf := make([]byte, 8)
+	if n, err := c.Characteristic(level).Read(buf); err != nil || n != 1 || buf[0] != 100 {
+		t.Errorf("Expected to read '%v', got '%v' (%v)", []byte{100}, buf[:n], err)
+	}
+	if _, err := c.Read(unknown); err == nil {
+		t.Error("Expected error reading unknown characteristic")
+	}
+
+	if _, err := c.Characteristic(command).WriteWithoutResponse([]byte{2}); err != nil {
+		t.Fatal(err)
+	}
+	if v := <-writes; !bytes.Equal(v, []byte{2}) {
+		t.Errorf("Expected written value to be '%v', got '%v'", []byte{2}, v)
+	}
+
+	notifications := make(chan []byte, 1)
+	if err := c.Characteristic(level).EnableNotifications(func(p []byte) { notifications <- p }); err != nil {
+		t.Fatal(err)
+	}
+	// Subscribing is not acknowledged, wait for the server to process it by issuing a request.
+	if _, err := c.Read(level); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Notify(level, []byte{99}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case v := <-notifications:
+		if !bytes.Equal(v, []byte{99}) {
+			t.Errorf("Expected notified value to be '%v', got '%v'", []byte{99}, v)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected notification to be delivered")
+	}
+
+	c.Close()
+	if _, err := c.Read(level); err == nil {
+		t.Error("Expected error reading from closed link")
+	}
+}
+
+func TestSplitAddress(t *testing.T) {
+	for _, tc := range []struct{ s, network, address string }{
+		{"localhost:7107", "tcp", "localhost:7107"},
+		{":7107", "tcp", ":7107"},
+		{"unix:/run/bottle.sock", "unix", "/run/bottle.sock"},
+	} {
+		if network, address := SplitAddress(tc.s); network != tc.network || address != tc.address {
+			t.Errorf("Expected '%s' to split into '%s' '%s', got '%s' '%s'", tc.s, tc.network, tc.address, network, address)
+		}
+	}
+}
+
+func TestServerOnRead(t *testing.T) {
+	level := bluetooth.CharacteristicUUIDBatteryLevel
+	reads := 0
+	bottle, host := net.Pipe()
+	srv := NewServer(bottle, []Characteristic{
+		{UUID: level, OnRead: func() ([]byte, error) {
+			if reads++; reads > 1 {
+				return nil, errors.New("bottle disconnected")
+			}
+			return []byte{42}, nil
+		}},
+	}, nil)
+	go srv.Serve()
+
+	c, err := NewConn(host, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if v, err := c.Read(level); err != nil || !bytes.Equal(v, []byte{42}) {
+		t.Errorf("Expected to read '%v', got '%v' (%v)", []byte{42}, v, err)
+	}
+	if _, err := c.Read(level); err == nil {
+		t.Error("Expected failing read to return an error")
+	}
+}
@@ -0,0 +1,139 @@
+package link
+
+import (
+	"io"
+	"sync"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// Characteristic is a characteristic served over a link.
+type Characteristic struct {
+	UUID  bluetooth.UUID
+	Value []byte
+	// OnWrite is invoked with values written by the client. Characteristics without it are read-only.
+	OnWrite func(value []byte)
+	// OnRead, if set, is invoked on reads instead of returning Value, e.g. to relay reads to a bottle elsewhere.
+	OnRead func() ([]byte, error)
+}
+
+// Server serves characteristics to a single client on the other end of a byte stream. Unlike Bluetooth, the stream has no notion of connecting, so clients announce new sessions via OpHello.
+type Server struct {
+	rw         io.ReadWriter
+	mu         sync.Mutex
+	wmu        sync.Mutex
+	chars      map[bluetooth.UUID]*Characteristic
+	order      []bluetooth.UUID
+	subscribed map[bluetooth.UUID]bool
+	onHello    func()
+}
+
+// NewServer serves the given characteristics over rw. The optional onHello callback is invoked whenever a client starts a session.
+func NewServer(rw io.ReadWriter, chars []Characteristic, onHello func()) *Server {
+	s := &Server{
+		rw:         rw,
+		chars:      make(map[bluetooth.UUID]*Characteristic, len(chars)),
+		subscribed: map[bluetooth.UUID]bool{},
+		onHello:    onHello,
+	}
+	for i := range chars {
+		c := chars[i]
+		s.chars[c.UUID] = &c
+		s.order = append(s.order, c.UUID)
+	}
+	return s
+}
+
+// Serve handles requests until reading from the stream fails.
+func (s *Server) Serve() error {
+	r := NewReader(s.rw)
+	for {
+		f, err := r.ReadFrame()
+		if err != nil {
+			return err
+		}
+		if err := s.handle(f); err != nil {
+			return err
+		}
+	}
+}
+
+// Notify updates the value of the given characteristic, sending it to the client if it subscribed to it.
+func (s *Server) Notify(uuid bluetooth.UUID, value []byte) error {
+	s.mu.Lock()
+	c, ok := s.chars[uuid]
+	if ok {
+		c.Value = append(c.Value[:0], value...)
+	}
+	subscribed := s.subscribed[uuid]
+	s.mu.Unlock()
+	if !subscribed {
+		return nil
+	}
+	return s.send(Frame{Op: OpNotify, UUID: uuid, Payload: value})
+}
+
+func (s *Server) handle(f Frame) error {
+	switch f.Op {
+	case OpHello:
+		s.mu.Lock()
+		s.subscribed = map[bluetooth.UUID]bool{}
+		s.mu.Unlock()
+		if s.onHello != nil {
+			s.onHello()
+		}
+		return nil
+	case OpDiscover:
+		payload := make([]byte, 0, 16*len(s.order))
+		for _, uuid := range s.order {
+			b := uuid.Bytes()
+			payload = append(payload, b[:]...)
+		}
+		return s.send(Frame{Op: OpValue, Payload: payload})
+	}
+
+	s.mu.Lock()
+	c, ok := s.chars[f.UUID]
+	if !ok {
+		s.mu.Unlock()
+		return s.send(Frame{Op: OpError, UUID: f.UUID, Payload: []byte("unknown characteristic")})
+	}
+	switch f.Op {
+	case OpRead:
+		onRead := c.OnRead
+		value := append([]byte{}, c.Value...)
+		s.mu.Unlock()
+		if onRead != nil {
+			v, err := onRead()
+			if err != nil {
+				return s.send(Frame{Op: OpError, UUID: f.UUID, Payload: []byte(err.Error())})
+			}
+			value = v
+		}
+		return s.send(Frame{Op: OpValue, UUID: f.UUID, Payload: value})
+	case OpWrite:
+		onWrite := c.OnWrite
+		if onWrite != nil {
+			c.Value = append(c.Value[:0], f.Payload...)
+		}
+		s.mu.Unlock()
+		if onWrite == nil {
+			return s.send(Frame{Op: OpError, UUID: f.UUID, Payload: []byte("characteristic is not writable")})
+		}
+		onWrite(f.Payload)
+		return nil
+	case OpSubscribe:
+		s.subscribed[f.UUID] = true
+		s.mu.Unlock()
+		return nil
+	default:
+		s.mu.Unlock()
+		return s.send(Frame{Op: OpError, UUID: f.UUID, Payload: []byte("unsupported operation")})
+	}
+}
+
+func (s *Server) send(f Frame) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	return WriteFrame(s.rw, f)
+}
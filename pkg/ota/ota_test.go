@@ -0,0 +1,135 @@
+package ota
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"github.com/toalaah/smart-bottle/pkg/storage"
+)
+
+// target wraps a receiver, adapting it to the Target interface.
+type target struct {
+	*Receiver
+	// Chunks with the given offset are dropped once, simulating packet loss.
+	drop map[uint32]bool
+}
+
+func (t *target) Status() (Status, error) {
+	return t.Receiver.Status(), nil
+}
+
+func (t *target) Write(offset uint32, chunk []byte) error {
+	if t.drop[offset] {
+		delete(t.drop, offset)
+		return nil
+	}
+	if err := t.Receiver.Write(offset, chunk); err != ErrUnexpectedOffset {
+		return err
+	}
+	return nil
+}
+
+func setup(t *testing.T, size int) (ed25519.PrivateKey, *Receiver, []byte) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := make([]byte, size)
+	if _, err := rand.Read(image); err != nil {
+		t.Fatal(err)
+	}
+	return priv, NewReceiver(storage.NewMemory(4096, 256, 1024), pub), image
+}
+
+func TestSendAndVerify(t *testing.T) {
+	priv, r, image := setup(t, 3000)
+	tgt := &target{Receiver: r, drop: map[uint32]bool{100: true, 2900: true}}
+	if err := Send(tgt, image, NewHeader(image, priv), 20, nil); err != nil {
+		t.Fatal(err)
+	}
+	if st := r.Status(); st.State != StateVerified {
+		t.Errorf("Expected state to be %s, got %s", StateVerified, st.State)
+	}
+}
+
+func TestResume(t *testing.T) {
+	priv, r, image := setup(t, 3000)
+	h := NewHeader(image, priv)
+	if err := r.Begin(h); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Write(0, image[:1000]); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := -1
+	if err := Send(&target{Receiver: r}, image, h, 20, func(n, total int) {
+		if sent < 0 {
+			sent = n
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if sent != 1000 {
+		t.Errorf("Expected transfer to resume at offset %d, got %d", 1000, sent)
+	}
+}
+
+func TestRejectsInvalidImages(t *testing.T) {
+	priv, r, image := setup(t, 3000)
+	h := NewHeader(image, priv)
+
+	// Signed by someone else.
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	if err := r.Begin(NewHeader(image, other)); err != ErrBadSignature {
+		t.Errorf("Expected error '%s', got '%v'", ErrBadSignature, err)
+	}
+
+	// Too large for the slot.
+	large := make([]byte, 5000)
+	if err := r.Begin(NewHeader(large, priv)); err != ErrImageTooLarge {
+		t.Errorf("Expected error '%s', got '%v'", ErrImageTooLarge, err)
+	}
+
+	// Tampered with in transit.
+	if err := r.Begin(h); err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte{}, image...)
+	tampered[42] ^= 0xff
+	if err := r.Write(0, tampered); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Finish(); err != ErrHashMismatch {
+		t.Errorf("Expected error '%s', got '%v'", ErrHashMismatch, err)
+	}
+
+	// Incomplete.
+	r.Abort()
+	if err := r.Begin(h); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Write(0, image[:100]); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Finish(); err != ErrIncomplete {
+		t.Errorf("Expected error '%s', got '%v'", ErrIncomplete, err)
+	}
+}
+
+func TestHeaderMatches(t *testing.T) {
+	priv, _, image := setup(t, 3000)
+	h := NewHeader(image, priv)
+	if !h.Matches(image) {
+		t.Error("Expected header to match the image it was created for")
+	}
+	if h.Matches(image[:2999]) {
+		t.Error("Expected header not to match a truncated image")
+	}
+	tampered := append([]byte{}, image...)
+	tampered[42] ^= 0xff
+	if h.Matches(tampered) {
+		t.Error("Expected header not to match a tampered image")
+	}
+}
@@ -0,0 +1,133 @@
+package ota
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	HeaderLen = 4 + sha256.Size + ed25519.SignatureSize
+	StatusLen = 5
+	// ChunkOverhead is the number of bytes preceding the payload of a data chunk.
+	ChunkOverhead = 4
+)
+
+// Op is an operation written to the control characteristic of the firmware update service.
+type Op uint8
+
+const (
+	// OpBegin starts a new update, followed by the image header. Beginning an update with the header of the one currently in progress resumes it instead.
+	OpBegin Op = iota + 1
+	// OpFinish verifies the received image and, if valid, marks it for installation.
+	OpFinish
+	// OpAbort discards the update in progress.
+	OpAbort
+)
+
+type State uint8
+
+const (
+	StateIdle State = iota
+	StateReceiving
+	StateVerified
+	StateFailed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateReceiving:
+		return "receiving"
+	case StateVerified:
+		return "verified"
+	case StateFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// Header describes a signed firmware image.
+type Header struct {
+	Size      uint32
+	Hash      [sha256.Size]byte
+	Signature [ed25519.SignatureSize]byte
+}
+
+// NewHeader hashes and signs a firmware image.
+func NewHeader(image []byte, key ed25519.PrivateKey) Header {
+	h := Header{Size: uint32(len(image)), Hash: sha256.Sum256(image)}
+	copy(h.Signature[:], ed25519.Sign(key, h.signedBytes()))
+	return h
+}
+
+// Matches reports whether the header describes the given image. It does not check the signature.
+func (h *Header) Matches(image []byte) bool {
+	return h.Size == uint32(len(image)) && h.Hash == sha256.Sum256(image)
+}
+
+// Verify checks the header's signature. It does not check the image itself.
+func (h *Header) Verify(key ed25519.PublicKey) bool {
+	return ed25519.Verify(key, h.signedBytes(), h.Signature[:])
+}
+
+// signedBytes returns the portion of the header covered by the signature.
+func (h *Header) signedBytes() []byte {
+	return h.MarshalBytes()[:4+sha256.Size]
+}
+
+func (h *Header) MarshalBytes() []byte {
+	b := make([]byte, HeaderLen)
+	binary.LittleEndian.PutUint32(b, h.Size)
+	copy(b[4:], h.Hash[:])
+	copy(b[4+sha256.Size:], h.Signature[:])
+	return b
+}
+
+func UnmarshalHeader(h *Header, b []byte) error {
+	if len(b) < HeaderLen {
+		return fmt.Errorf("expected header of at least length %d, got %d", HeaderLen, len(b))
+	}
+	h.Size = binary.LittleEndian.Uint32(b)
+	copy(h.Hash[:], b[4:])
+	copy(h.Signature[:], b[4+sha256.Size:])
+	return nil
+}
+
+// Status reports the progress of an update. Offset is the number of contiguous image bytes received so far, i.e. the offset at which the sender should continue.
+type Status struct {
+	State  State
+	Offset uint32
+}
+
+func (s *Status) MarshalBytes() []byte {
+	b := make([]byte, StatusLen)
+	b[0] = byte(s.State)
+	binary.LittleEndian.PutUint32(b[1:], s.Offset)
+	return b
+}
+
+func UnmarshalStatus(s *Status, b []byte) error {
+	if len(b) < StatusLen {
+		return fmt.Errorf("expected status of at least length %d, got %d", StatusLen, len(b))
+	}
+	s.State = State(b[0])
+	s.Offset = binary.LittleEndian.Uint32(b[1:])
+	return nil
+}
+
+func MarshalChunk(offset uint32, data []byte) []byte {
+	b := make([]byte, ChunkOverhead, ChunkOverhead+len(data))
+	binary.LittleEndian.PutUint32(b, offset)
+	return append(b, data...)
+}
+
+func UnmarshalChunk(b []byte) (uint32, []byte, error) {
+	if len(b) < ChunkOverhead {
+		return 0, nil, fmt.Errorf("expected chunk of at least length %d, got %d", ChunkOverhead, len(b))
+	}
+	return binary.LittleEndian.Uint32(b), b[ChunkOverhead:], nil
+}
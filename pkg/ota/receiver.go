@@ -0,0 +1,185 @@
+package ota
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"log/slog"
+
+	"github.com/toalaah/smart-bottle/pkg/storage"
+)
+
+var (
+	ErrNotReceiving     = errors.New("no update in progress")
+	ErrImageTooLarge    = errors.New("image exceeds slot size")
+	ErrUnexpectedOffset = errors.New("chunk does not continue at current offset")
+	ErrIncomplete       = errors.New("image is incomplete")
+	ErrHashMismatch     = errors.New("image hash does not match header")
+	ErrBadSignature     = errors.New("image signature is invalid")
+)
+
+// Receiver writes a firmware image received in chunks to a flash slot and verifies it once complete. Chunks must arrive in order; a sender may query the current offset via Status in order to resume an interrupted transfer. The offset is kept in RAM only, so transfers interrupted by a reboot start over.
+type Receiver struct {
+	logger    *slog.Logger
+	slot      storage.BlockDevice
+	publicKey ed25519.PublicKey
+
+	status Status
+	header Header
+	// Pending data which does not yet fill an entire write block.
+	block []byte
+	// Number of bytes flushed to the slot, always a multiple of the write block size.
+	flushed uint32
+}
+
+func NewReceiver(slot storage.BlockDevice, publicKey ed25519.PublicKey, opts ...ReceiverOption) *Receiver {
+	r := &Receiver{
+		logger:    nil,
+		slot:      slot,
+		publicKey: publicKey,
+		block:     make([]byte, 0, slot.WriteBlockSize()),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Begin starts receiving the image described by the header. If the same image is already being received, the transfer is resumed at the current offset.
+func (r *Receiver) Begin(h Header) error {
+	if r.status.State == StateReceiving && r.header == h {
+		r.debug("resuming update", "offset", r.status.Offset)
+		return nil
+	}
+	if int64(h.Size) > r.slot.Size() {
+		r.status = Status{State: StateFailed}
+		return ErrImageTooLarge
+	}
+	// Reject images not signed by us early, saving the sender from transferring them in their entirety.
+	if !h.Verify(r.publicKey) {
+		r.status = Status{State: StateFailed}
+		return ErrBadSignature
+	}
+	r.debug("beginning update", "size", h.Size)
+	r.header = h
+	r.status = Status{State: StateReceiving}
+	r.block = r.block[:0]
+	r.flushed = 0
+	return nil
+}
+
+// Write appends a chunk at the given offset. Chunks which were already received are ignored, allowing senders to safely retransmit.
+func (r *Receiver) Write(offset uint32, chunk []byte) error {
+	if r.status.State != StateReceiving {
+		return ErrNotReceiving
+	}
+	end := offset + uint32(len(chunk))
+	if end <= r.status.Offset {
+		return nil
+	}
+	if offset > r.status.Offset {
+		return ErrUnexpectedOffset
+	}
+	if end > r.header.Size {
+		return ErrImageTooLarge
+	}
+	chunk = chunk[r.status.Offset-offset:]
+	for len(chunk) > 0 {
+		n := min(cap(r.block)-len(r.block), len(chunk))
+		r.block = append(r.block, chunk[:n]...)
+		chunk = chunk[n:]
+		r.status.Offset += uint32(n)
+		if len(r.block) == cap(r.block) {
+			if err := r.flush(); err != nil {
+				r.status.State = StateFailed
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Finish verifies the received image against the header. The image is read back from the slot, ensuring that it was persisted correctly.
+func (r *Receiver) Finish() error {
+	if r.status.State != StateReceiving {
+		return ErrNotReceiving
+	}
+	if r.status.Offset != r.header.Size {
+		return ErrIncomplete
+	}
+	if err := r.flush(); err != nil {
+		r.status.State = StateFailed
+		return err
+	}
+
+	hash := sha256.New()
+	buf := make([]byte, r.slot.WriteBlockSize())
+	for off := uint32(0); off < r.header.Size; off += uint32(len(buf)) {
+		n := min(uint32(len(buf)), r.header.Size-off)
+		if _, err := r.slot.ReadAt(buf[:n], int64(off)); err != nil {
+			r.status.State = StateFailed
+			return err
+		}
+		hash.Write(buf[:n])
+	}
+	if !bytes.Equal(hash.Sum(nil), r.header.Hash[:]) {
+		r.status.State = StateFailed
+		return ErrHashMismatch
+	}
+	if !r.header.Verify(r.publicKey) {
+		r.status.State = StateFailed
+		return ErrBadSignature
+	}
+	r.debug("verified update", "size", r.header.Size)
+	r.status.State = StateVerified
+	return nil
+}
+
+// Abort discards the update in progress.
+func (r *Receiver) Abort() {
+	r.debug("aborting update", "offset", r.status.Offset)
+	r.status = Status{State: StateIdle}
+}
+
+func (r *Receiver) Status() Status {
+	return r.status
+}
+
+// flush writes the pending block to the slot, erasing erase blocks as they are entered.
+func (r *Receiver) flush() error {
+	if len(r.block) == 0 {
+		return nil
+	}
+	eraseSize := r.slot.EraseBlockSize()
+	if int64(r.flushed)%eraseSize == 0 {
+		if err := r.slot.EraseBlocks(int64(r.flushed)/eraseSize, 1); err != nil {
+			return err
+		}
+	}
+	// Pad the final block with the erased value.
+	n := len(r.block)
+	for len(r.block) < cap(r.block) {
+		r.block = append(r.block, 0xff)
+	}
+	if _, err := r.slot.WriteAt(r.block, int64(r.flushed)); err != nil {
+		return err
+	}
+	r.flushed += uint32(n)
+	r.block = r.block[:0]
+	return nil
+}
+
+func (r *Receiver) debug(msg string, args ...any) {
+	if r.logger != nil {
+		r.logger.Debug(msg, args...)
+	}
+}
+
+type ReceiverOption func(*Receiver)
+
+func WithLogger(l *slog.Logger) ReceiverOption {
+	return func(r *Receiver) {
+		r.logger = l.With("service", "ota")
+	}
+}
@@ -0,0 +1,77 @@
+package ota
+
+import (
+	"fmt"
+)
+
+// Target is the receiving end of a firmware update as seen by a sender. Receiver implements it directly, remote targets relay each call to the bottle.
+type Target interface {
+	Begin(h Header) error
+	Write(offset uint32, chunk []byte) error
+	Finish() error
+	Status() (Status, error)
+}
+
+// statusInterval is the number of chunks after which the sender checks that the target is still in sync.
+const statusInterval = 32
+
+// maxRetries bounds the number of times a sender rewinds to the target's offset before giving up.
+const maxRetries = 8
+
+// Send transfers an image to the target in chunks of at most chunkSize bytes. If the target already holds part of the image, e.g. from an interrupted transfer, sending resumes at the target's offset. The optional progress callback is invoked with the number of bytes acknowledged by the target.
+func Send(t Target, image []byte, h Header, chunkSize int, progress func(sent, total int)) error {
+	if int(h.Size) != len(image) {
+		return fmt.Errorf("image size %d does not match header size %d", len(image), h.Size)
+	}
+	if chunkSize <= 0 {
+		return fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	if err := t.Begin(h); err != nil {
+		return err
+	}
+
+	retries, expected := 0, -1
+	for {
+		st, err := t.Status()
+		if err != nil {
+			return err
+		}
+		if st.State != StateReceiving {
+			return fmt.Errorf("target is in unexpected state %s", st.State)
+		}
+		if progress != nil {
+			progress(int(st.Offset), len(image))
+		}
+		if st.Offset == h.Size {
+			break
+		}
+		if expected >= 0 && int(st.Offset) != expected {
+			if retries++; retries > maxRetries {
+				return fmt.Errorf("target did not make progress after %d retries", maxRetries)
+			}
+		}
+
+		// Continue at the target's offset, chunks may have been lost in transit.
+		off := int(st.Offset)
+		for i := 0; i < statusInterval && off < len(image); i++ {
+			end := min(off+chunkSize, len(image))
+			if err := t.Write(uint32(off), image[off:end]); err != nil {
+				return err
+			}
+			off = end
+		}
+		expected = off
+	}
+
+	if err := t.Finish(); err != nil {
+		return err
+	}
+	st, err := t.Status()
+	if err != nil {
+		return err
+	}
+	if st.State != StateVerified {
+		return fmt.Errorf("target failed to verify image, state is %s", st.State)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package power
+
+import "time"
+
+// Budget models the bottle's power consumption. Currents are given in mA and capacities in mAh.
+type Budget struct {
+	Capacity float64
+	// Current drawn while the MCU waits for the next event with the radio idle.
+	SleepCurrent float64
+	// Additional current drawn while the MCU is busy reading and publishing a measurement.
+	ActiveCurrent float64
+	// Time the MCU is busy per sample, which also bounds the time the sensor is powered after warming up.
+	ActiveTime time.Duration
+	// Additional current drawn while the sensor is powered.
+	SensorCurrent float64
+	// Additional current drawn by the radio during a single advertising event, and its duration.
+	AdvertisingCurrent float64
+	AdvertisingEvent   time.Duration
+	// Additional average current drawn by the radio while a client is connected.
+	ConnectedCurrent float64
+	// Fraction of time a client is connected.
+	ConnectedRatio float64
+}
+
+// DefaultBudget roughly matches a Pico 2W with an A02YYUW sensor and a 1000mAh LiPo cell. The figures are ballpark values taken from the respective datasheets.
+var DefaultBudget = Budget{
+	Capacity: 1000,
+	// The MCU merely waits for interrupts in between samples, see Manager.
+	SleepCurrent:       12,
+	ActiveCurrent:      25,
+	ActiveTime:         100 * time.Millisecond,
+	SensorCurrent:      8,
+	AdvertisingCurrent: 20,
+	AdvertisingEvent:   3 * time.Millisecond,
+	ConnectedCurrent:   2,
+	ConnectedRatio:     0.05,
+}
+
+type Estimate struct {
+	// Average current in mA.
+	AverageCurrent float64
+	// Fraction of time the sensor is powered.
+	DutyCycle float64
+	Lifetime  time.Duration
+}
+
+// Estimate predicts the battery life under the given duty cycle. The fast advertisement window is only used briefly after disconnecting and is therefore neglected.
+func (b Budget) Estimate(c Config) Estimate {
+	duty := c.DutyCycle(b.ActiveTime)
+	current := b.SleepCurrent +
+		b.ActiveCurrent*min(float64(b.ActiveTime)/float64(c.SampleInterval), 1) +
+		b.SensorCurrent*duty +
+		(1-b.ConnectedRatio)*b.AdvertisingCurrent*min(float64(b.AdvertisingEvent)/float64(c.SlowAdvertisementInterval), 1) +
+		b.ConnectedRatio*b.ConnectedCurrent
+	return Estimate{
+		AverageCurrent: current,
+		DutyCycle:      duty,
+		Lifetime:       time.Duration(b.Capacity / current * float64(time.Hour)),
+	}
+}
@@ -0,0 +1,33 @@
+package power
+
+import "time"
+
+// Config describes the bottle's duty cycle. It is shared by the firmware and the budget estimator, so that predictions match what is flashed.
+type Config struct {
+	// Interval between two readings of the depth sensor.
+	SampleInterval time.Duration
+	// Time the sensor needs after being powered on before it outputs valid measurements.
+	SensorWarmup time.Duration
+	// Interval between two battery readings.
+	BatteryInterval time.Duration
+	// Advertisement interval used right after booting or a client disconnecting, allowing it to quickly reconnect.
+	FastAdvertisementInterval time.Duration
+	// Duration for which the fast advertisement interval is used before falling back to the slow one.
+	FastAdvertisementDuration time.Duration
+	// Advertisement interval used while idle.
+	SlowAdvertisementInterval time.Duration
+}
+
+var DefaultConfig = Config{
+	SampleInterval:            10 * time.Second,
+	SensorWarmup:              300 * time.Millisecond,
+	BatteryInterval:           time.Minute,
+	FastAdvertisementInterval: 100 * time.Millisecond,
+	FastAdvertisementDuration: 30 * time.Second,
+	SlowAdvertisementInterval: 2 * time.Second,
+}
+
+// DutyCycle returns the fraction of time the sensor is powered, given the time it takes to read a measurement once warmed up.
+func (c Config) DutyCycle(readTime time.Duration) float64 {
+	return min(float64(c.SensorWarmup+readTime)/float64(c.SampleInterval), 1)
+}
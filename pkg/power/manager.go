@@ -0,0 +1,104 @@
+package power
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Peripheral is a device which can be powered down between samples.
+type Peripheral interface {
+	PowerOn() error
+	PowerOff() error
+}
+
+// Manager applies the configured duty cycle. Peripherals are only powered while sampling, and the advertisement interval is adapted to the connection state. In between, the main loop blocks and TinyGo's scheduler waits for the next interrupt (WFI) with the clocks running. The MCU's dormant state is not used, as it stops the clocks driving the radio's SPI bus and USB, and the radio's host wake-up line is not wired up to end it.
+type Manager struct {
+	logger      *slog.Logger
+	config      Config
+	peripherals []Peripheral
+
+	connected      bool
+	lastDisconnect time.Time
+}
+
+func NewManager(c Config, opts ...ManagerOption) *Manager {
+	m := &Manager{
+		logger: nil,
+		config: c,
+		// Advertise quickly after booting, a client is likely waiting.
+		lastDisconnect: time.Now(),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+func (m *Manager) Config() Config {
+	return m.config
+}
+
+// PowerOn powers on all peripherals ahead of sampling. They need Config().SensorWarmup to warm up, which callers should wait for using a timer rather than blocking, so that other events can be handled meanwhile. Should a peripheral fail to power on, all of them are powered off again.
+func (m *Manager) PowerOn() error {
+	m.debug("powering on peripherals")
+	for _, p := range m.peripherals {
+		if err := p.PowerOn(); err != nil {
+			m.PowerOff()
+			return err
+		}
+	}
+	return nil
+}
+
+// PowerOff powers off all peripherals once sampled, returning the first error encountered.
+func (m *Manager) PowerOff() error {
+	m.debug("powering off peripherals")
+	var err error
+	for _, p := range m.peripherals {
+		if perr := p.PowerOff(); perr != nil && err == nil {
+			err = perr
+		}
+	}
+	return err
+}
+
+// SetConnected records a change of the connection state.
+func (m *Manager) SetConnected(connected bool, now time.Time) {
+	m.debug("connection state changed", "connected", connected)
+	if m.connected && !connected {
+		m.lastDisconnect = now
+	}
+	m.connected = connected
+}
+
+// AdvertisementInterval returns the advertisement interval appropriate for the current connection state, and the duration after which it should be queried again. A zero duration means the interval does not change on its own.
+func (m *Manager) AdvertisementInterval(now time.Time) (time.Duration, time.Duration) {
+	if m.connected {
+		return m.config.SlowAdvertisementInterval, 0
+	}
+	if remaining := m.config.FastAdvertisementDuration - now.Sub(m.lastDisconnect); remaining > 0 {
+		return m.config.FastAdvertisementInterval, remaining
+	}
+	return m.config.SlowAdvertisementInterval, 0
+}
+
+func (m *Manager) debug(msg string, args ...any) {
+	if m.logger != nil {
+		m.logger.Debug(msg, args...)
+	}
+}
+
+type ManagerOption func(*Manager)
+
+// WithPeripheral adds a peripheral which is only powered while sampling.
+func WithPeripheral(p Peripheral) ManagerOption {
+	return func(m *Manager) {
+		m.peripherals = append(m.peripherals, p)
+	}
+}
+
+func WithLogger(l *slog.Logger) ManagerOption {
+	return func(m *Manager) {
+		m.logger = l.With("service", "power")
+	}
+}
@@ -0,0 +1,111 @@
+package power
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+type fakePeripheral struct {
+	on      bool
+	cycles  int
+	failOff bool
+}
+
+func (p *fakePeripheral) PowerOn() error {
+	p.on = true
+	p.cycles++
+	return nil
+}
+
+func (p *fakePeripheral) PowerOff() error {
+	p.on = false
+	if p.failOff {
+		return errors.New("failed to power off")
+	}
+	return nil
+}
+
+func TestManagerPower(t *testing.T) {
+	p, q := &fakePeripheral{}, &fakePeripheral{}
+	m := NewManager(Config{}, WithPeripheral(p), WithPeripheral(q))
+	if err := m.PowerOn(); err != nil {
+		t.Fatal(err)
+	}
+	if !p.on || !q.on {
+		t.Error("Expected peripherals to be powered while sampling")
+	}
+	if err := m.PowerOff(); err != nil {
+		t.Fatal(err)
+	}
+	if p.on || q.on || p.cycles != 1 {
+		t.Errorf("Expected peripherals to be powered off after a single cycle, got on '%v' after '%d' cycles", p.on || q.on, p.cycles)
+	}
+
+	// Later peripherals are powered off regardless of earlier ones failing.
+	p.failOff = true
+	m.PowerOn()
+	if err := m.PowerOff(); err == nil {
+		t.Error("Expected error powering off peripheral")
+	}
+	if q.on {
+		t.Error("Expected remaining peripherals to be powered off")
+	}
+}
+
+func TestManagerAdvertisementInterval(t *testing.T) {
+	c := DefaultConfig
+	m := NewManager(c)
+	now := time.Now()
+
+	if d, next := m.AdvertisementInterval(now); d != c.FastAdvertisementInterval || next <= 0 {
+		t.Errorf("Expected fast interval after boot, got '%s' for '%s'", d, next)
+	}
+	m.SetConnected(true, now)
+	if d, next := m.AdvertisementInterval(now); d != c.SlowAdvertisementInterval || next != 0 {
+		t.Errorf("Expected slow interval while connected, got '%s' for '%s'", d, next)
+	}
+	now = now.Add(time.Hour)
+	m.SetConnected(false, now)
+	if d, next := m.AdvertisementInterval(now.Add(time.Second)); d != c.FastAdvertisementInterval || next != c.FastAdvertisementDuration-time.Second {
+		t.Errorf("Expected fast interval after disconnecting, got '%s' for '%s'", d, next)
+	}
+	if d, _ := m.AdvertisementInterval(now.Add(c.FastAdvertisementDuration)); d != c.SlowAdvertisementInterval {
+		t.Errorf("Expected slow interval once idle, got '%s'", d)
+	}
+}
+
+func TestBudgetEstimate(t *testing.T) {
+	b := Budget{
+		Capacity:           1000,
+		SleepCurrent:       1,
+		ActiveCurrent:      10,
+		ActiveTime:         time.Second,
+		SensorCurrent:      5,
+		AdvertisingCurrent: 20,
+		AdvertisingEvent:   10 * time.Millisecond,
+		ConnectedCurrent:   4,
+		ConnectedRatio:     0.5,
+	}
+	c := Config{
+		SampleInterval:            10 * time.Second,
+		SensorWarmup:              time.Second,
+		SlowAdvertisementInterval: time.Second,
+	}
+	e := b.Estimate(c)
+	// 1 + 10*0.1 + 5*0.2 + 0.5*20*0.01 + 0.5*4
+	if expected := 5.1; math.Abs(e.AverageCurrent-expected) > 1e-9 {
+		t.Errorf("Expected average current to be '%v', got '%v'", expected, e.AverageCurrent)
+	}
+	if e.DutyCycle != 0.2 {
+		t.Errorf("Expected duty cycle to be '%v', got '%v'", 0.2, e.DutyCycle)
+	}
+	if expected := 1000 / 5.1; math.Abs(e.Lifetime.Hours()-expected) > 1e-6 {
+		t.Errorf("Expected lifetime to be '%vh', got '%s'", expected, e.Lifetime)
+	}
+
+	if faster := b.Estimate(Config{SampleInterval: time.Second, SensorWarmup: time.Second, SlowAdvertisementInterval: time.Second}); faster.Lifetime >= e.Lifetime {
+		t.Errorf("Expected sampling more often to shorten lifetime, got '%s' and '%s'", faster.Lifetime, e.Lifetime)
+	}
+}
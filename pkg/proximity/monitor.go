@@ -0,0 +1,151 @@
+package proximity
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type State uint8
+
+const (
+	StateUnknown State = iota
+	StateInRange
+	StateOutOfRange
+)
+
+func (s State) String() string {
+	switch s {
+	case StateUnknown:
+		return "unknown"
+	case StateInRange:
+		return "in range"
+	case StateOutOfRange:
+		return "out of range"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(s))
+	}
+}
+
+// Event reports a change of the bottle's proximity. RSSI is the smoothed signal strength in dBm, or zero if the bottle has not been heard from yet.
+type Event struct {
+	State State
+	RSSI  float64
+	Time  time.Time
+}
+
+// Monitor estimates whether a bottle is within range from the signal strength of its advertisements and the state of the connection to it. Signal strength fluctuates heavily, so it is smoothed using an exponential moving average, and separate thresholds for entering and leaving range prevent flapping at the boundary. It is safe for concurrent use.
+type Monitor struct {
+	mu sync.Mutex
+
+	alpha     float64
+	near, far float64
+	timeout   time.Duration
+
+	rssi      float64
+	hasRSSI   bool
+	lastSeen  time.Time
+	connected bool
+	state     State
+}
+
+func New(opts ...MonitorOption) *Monitor {
+	m := &Monitor{
+		alpha:   0.3,
+		near:    -75,
+		far:     -85,
+		timeout: 30 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Update records the signal strength of a received advertisement.
+func (m *Monitor) Update(rssi int16, now time.Time) (Event, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.hasRSSI {
+		m.rssi += m.alpha * (float64(rssi) - m.rssi)
+	} else {
+		m.rssi, m.hasRSSI = float64(rssi), true
+	}
+	m.lastSeen = now
+
+	switch {
+	case m.state == StateUnknown:
+		// Without history, the midpoint between both thresholds is the best guess.
+		if m.rssi >= (m.near+m.far)/2 {
+			return m.transition(StateInRange, now)
+		}
+		return m.transition(StateOutOfRange, now)
+	case m.state != StateInRange && m.rssi >= m.near:
+		return m.transition(StateInRange, now)
+	case m.state != StateOutOfRange && m.rssi < m.far:
+		return m.transition(StateOutOfRange, now)
+	}
+	return Event{}, false
+}
+
+// SetConnected records a change of the connection state. An established connection implies that the bottle is in range. Once disconnected, the bottle is given the usual timeout to be heard from again, as the connection may well have been closed on purpose.
+func (m *Monitor) SetConnected(connected bool, now time.Time) (Event, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connected = connected
+	m.lastSeen = now
+	if connected && m.state != StateInRange {
+		return m.transition(StateInRange, now)
+	}
+	return Event{}, false
+}
+
+// Tick reports the bottle as out of range if it has neither been connected nor heard from within the timeout. It should be called periodically.
+func (m *Monitor) Tick(now time.Time) (Event, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.connected || m.state != StateInRange || now.Sub(m.lastSeen) < m.timeout {
+		return Event{}, false
+	}
+	// Start over once the bottle is heard from again, stale readings would only delay detection.
+	m.hasRSSI = false
+	return m.transition(StateOutOfRange, now)
+}
+
+func (m *Monitor) State() State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+func (m *Monitor) transition(s State, now time.Time) (Event, bool) {
+	m.state = s
+	e := Event{State: s, Time: now}
+	if m.hasRSSI {
+		e.RSSI = m.rssi
+	}
+	return e, true
+}
+
+type MonitorOption func(*Monitor)
+
+// WithThresholds sets the smoothed signal strength in dBm above which the bottle is considered in range again, and below which it is considered out of range. near must be greater than far.
+func WithThresholds(near, far float64) MonitorOption {
+	return func(m *Monitor) {
+		m.near, m.far = near, far
+	}
+}
+
+// WithSmoothing sets the weight of new samples in the range (0, 1]. Lower values smooth more, but react slower.
+func WithSmoothing(alpha float64) MonitorOption {
+	return func(m *Monitor) {
+		m.alpha = alpha
+	}
+}
+
+// WithTimeout sets the duration after which a bottle which has not been heard from is considered out of range.
+func WithTimeout(d time.Duration) MonitorOption {
+	return func(m *Monitor) {
+		m.timeout = d
+	}
+}
@@ -0,0 +1,63 @@
+package proximity
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMonitorHysteresis(t *testing.T) {
+	m := New(WithThresholds(-70, -80), WithSmoothing(1))
+	now := time.Now()
+
+	if e, ok := m.Update(-60, now); !ok || e.State != StateInRange {
+		t.Errorf("Expected first strong sample to report in range, got '%+v'", e)
+	}
+	// Between both thresholds, the state is kept.
+	if e, ok := m.Update(-75, now); ok {
+		t.Errorf("Expected no event between thresholds, got '%+v'", e)
+	}
+	if e, ok := m.Update(-85, now); !ok || e.State != StateOutOfRange || e.RSSI != -85 {
+		t.Errorf("Expected weak sample to report out of range, got '%+v'", e)
+	}
+	if e, ok := m.Update(-75, now); ok {
+		t.Errorf("Expected no event between thresholds, got '%+v'", e)
+	}
+	if e, ok := m.Update(-65, now); !ok || e.State != StateInRange {
+		t.Errorf("Expected strong sample to report in range again, got '%+v'", e)
+	}
+}
+
+func TestMonitorSmoothing(t *testing.T) {
+	m := New(WithThresholds(-70, -80), WithSmoothing(0.5))
+	now := time.Now()
+	m.Update(-60, now)
+	// A single outlier must not be mistaken for the bottle leaving.
+	if e, ok := m.Update(-95, now); ok {
+		t.Errorf("Expected single outlier to be smoothed, got '%+v'", e)
+	}
+	if e, ok := m.Update(-95, now); !ok || e.State != StateOutOfRange {
+		t.Errorf("Expected repeated weak samples to report out of range, got '%+v'", e)
+	}
+}
+
+func TestMonitorTimeout(t *testing.T) {
+	m := New(WithTimeout(10 * time.Second))
+	now := time.Now()
+
+	if e, ok := m.SetConnected(true, now); !ok || e.State != StateInRange {
+		t.Errorf("Expected connection to report in range, got '%+v'", e)
+	}
+	if e, ok := m.Tick(now.Add(time.Minute)); ok {
+		t.Errorf("Expected no timeout while connected, got '%+v'", e)
+	}
+	m.SetConnected(false, now.Add(time.Minute))
+	if e, ok := m.Tick(now.Add(time.Minute + 5*time.Second)); ok {
+		t.Errorf("Expected no timeout within grace period, got '%+v'", e)
+	}
+	if e, ok := m.Tick(now.Add(time.Minute + 10*time.Second)); !ok || e.State != StateOutOfRange {
+		t.Errorf("Expected timeout to report out of range, got '%+v'", e)
+	}
+	if m.State() != StateOutOfRange {
+		t.Errorf("Expected state to be '%s', got '%s'", StateOutOfRange, m.State())
+	}
+}
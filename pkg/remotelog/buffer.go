@@ -0,0 +1,96 @@
+package remotelog
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
+
+// MaxLineLen is the maximum length of a buffered log line. Longer lines are truncated so that every line fits into a single encrypted notification.
+const MaxLineLen = 96
+
+type line struct {
+	seq uint32
+	n   int
+	buf [MaxLineLen]byte
+}
+
+// Buffer is a bounded ring buffer of formatted log lines, allowing recent logs to be retrieved by a client after the fact. Once full, the oldest lines are overwritten.
+type Buffer struct {
+	mu    sync.Mutex
+	lines []line
+	last  uint32
+	level slog.LevelVar
+}
+
+// quietKey marks contexts whose records are not buffered, see Since.
+type quietKey struct{}
+
+// quiet reports whether records logged with the given context are not to be buffered.
+func quiet(ctx context.Context) bool {
+	q, _ := ctx.Value(quietKey{}).(bool)
+	return q
+}
+
+func NewBuffer(capacity int) *Buffer {
+	b := &Buffer{
+		lines: make([]line, capacity),
+	}
+	b.level.Set(slog.LevelInfo)
+	return b
+}
+
+// Write appends a single line, trailing newlines are stripped. It implements io.Writer so that the buffer can be used with the standard slog handlers, which write every record in a single call.
+func (b *Buffer) Write(p []byte) (int, error) {
+	n := len(p)
+	for n > 0 && p[n-1] == '\n' {
+		n--
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.last++
+	l := &b.lines[b.last%uint32(len(b.lines))]
+	l.seq = b.last
+	l.n = copy(l.buf[:], p[:n])
+	return len(p), nil
+}
+
+// Since calls fn for every buffered line with a sequence number greater than seq in ascending order. Records logged by fn with the context it is passed are not buffered, preventing streaming logs from producing logs about streaming logs, whereas lines logged meanwhile by other goroutines are kept.
+func (b *Buffer) Since(seq uint32, fn func(ctx context.Context, seq uint32, line []byte) error) error {
+	b.mu.Lock()
+	var pending []line
+	first := seq + 1
+	if capacity := uint32(len(b.lines)); b.last >= capacity && first <= b.last-capacity {
+		first = b.last - capacity + 1
+	}
+	for s := first; s <= b.last && s != 0; s++ {
+		if l := b.lines[s%uint32(len(b.lines))]; l.seq == s {
+			pending = append(pending, l)
+		}
+	}
+	b.mu.Unlock()
+
+	ctx := context.WithValue(context.Background(), quietKey{}, true)
+	for i := range pending {
+		if err := fn(ctx, pending[i].seq, pending[i].buf[:pending[i].n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Last returns the sequence number of the most recent line, or zero if nothing has been logged yet.
+func (b *Buffer) Last() uint32 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.last
+}
+
+// SetLevel sets the minimum level of records kept by the buffer.
+func (b *Buffer) SetLevel(l slog.Level) {
+	b.level.Set(l)
+}
+
+func (b *Buffer) Level() slog.Level {
+	return b.level.Level()
+}
@@ -0,0 +1,66 @@
+package remotelog
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Handler is a slog.Handler which formats records into a Buffer. Records may additionally be passed on to another handler, e.g. one writing to USB CDC, which filters records independently of the buffer's level.
+type Handler struct {
+	buf  *Buffer
+	text slog.Handler
+	next slog.Handler
+}
+
+// NewHandler returns a handler writing to the given buffer. The next handler is optional.
+func NewHandler(b *Buffer, next slog.Handler) *Handler {
+	return &Handler{
+		buf: b,
+		text: slog.NewTextHandler(b, &slog.HandlerOptions{
+			// The buffer filters by level itself, so that it may be changed at runtime.
+			Level: slog.LevelDebug,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				// The bottle's clock is usually not synced when logging, clients know better when they received a line.
+				if len(groups) == 0 && a.Key == slog.TimeKey {
+					return slog.Attr{}
+				}
+				return a
+			},
+		}),
+		next: next,
+	}
+}
+
+func (h *Handler) Enabled(ctx context.Context, l slog.Level) bool {
+	return l >= h.buf.Level() || (h.next != nil && h.next.Enabled(ctx, l))
+}
+
+func (h *Handler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= h.buf.Level() && !quiet(ctx) {
+		if err := h.text.Handle(ctx, r); err != nil {
+			return err
+		}
+	}
+	if h.next != nil && h.next.Enabled(ctx, r.Level) {
+		return h.next.Handle(ctx, r)
+	}
+	return nil
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.text = h.text.WithAttrs(attrs)
+	if h.next != nil {
+		c.next = h.next.WithAttrs(attrs)
+	}
+	return &c
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	c := *h
+	c.text = h.text.WithGroup(name)
+	if h.next != nil {
+		c.next = h.next.WithGroup(name)
+	}
+	return &c
+}
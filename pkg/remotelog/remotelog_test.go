@@ -0,0 +1,80 @@
+package remotelog
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func collect(t *testing.T, b *Buffer, since uint32) []string {
+	var out []string
+	if err := b.Since(since, func(_ context.Context, seq uint32, line []byte) error {
+		out = append(out, string(line))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestBufferSince(t *testing.T) {
+	b := NewBuffer(3)
+	for _, s := range []string{"a\n", "b\n", "c\n", "d\n"} {
+		b.Write([]byte(s))
+	}
+	if got := collect(t, b, 0); strings.Join(got, ",") != "b,c,d" {
+		t.Errorf("Expected the 3 most recent lines, got '%v'", got)
+	}
+	if got := collect(t, b, 3); strings.Join(got, ",") != "d" {
+		t.Errorf("Expected only line 4, got '%v'", got)
+	}
+	if b.Last() != 4 {
+		t.Errorf("Expected last sequence number to be '%d', got '%d'", 4, b.Last())
+	}
+
+	b.Write(bytes.Repeat([]byte{'x'}, 2*MaxLineLen))
+	if got := collect(t, b, 4); len(got) != 1 || len(got[0]) != MaxLineLen {
+		t.Errorf("Expected a single line truncated to %d bytes, got '%v'", MaxLineLen, got)
+	}
+}
+
+func TestBufferSinceQuietsLogging(t *testing.T) {
+	b := NewBuffer(8)
+	l := slog.New(NewHandler(b, nil))
+	l.Info("a")
+	if err := b.Since(0, func(ctx context.Context, seq uint32, line []byte) error {
+		l.InfoContext(ctx, "sent", "line", string(line))
+		// Lines logged by other goroutines meanwhile do not carry the context.
+		l.Info("b")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got := collect(t, b, 1); len(got) != 1 || got[0] != "level=INFO msg=b" {
+		t.Errorf("Expected only the line logged without the streaming context to be kept, got '%v'", got)
+	}
+}
+
+func TestHandlerLevels(t *testing.T) {
+	b := NewBuffer(8)
+	next := &bytes.Buffer{}
+	l := slog.New(NewHandler(b, slog.NewTextHandler(next, &slog.HandlerOptions{Level: slog.LevelDebug}))).With("service", "test")
+
+	l.Debug("hidden")
+	l.Info("shown", "key", 42)
+	got := collect(t, b, 0)
+	if len(got) != 1 || got[0] != "level=INFO msg=shown service=test key=42" {
+		t.Errorf("Expected only the info line, got '%v'", got)
+	}
+	if !strings.Contains(next.String(), "hidden") {
+		t.Error("Expected debug line to be passed on to the next handler")
+	}
+
+	b.SetLevel(slog.LevelDebug)
+	l.Debug("now shown")
+	if got := collect(t, b, 1); len(got) != 1 || !strings.Contains(got[0], "now shown") {
+		t.Errorf("Expected the debug line after lowering the level, got '%v'", got)
+	}
+}
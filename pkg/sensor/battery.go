@@ -0,0 +1,107 @@
+package sensor
+
+import (
+	"log/slog"
+	"machine"
+	"time"
+)
+
+// BatteryService estimates the remaining battery charge from the system supply voltage. On the Pico 2W, VSYS is exposed via a 1:3 voltage divider on ADC3 (GPIO29).
+//
+// Note that GPIO29 doubles as the clock line of the wireless chip's SPI bus, meaning readings may be skewed by ongoing radio traffic. Averaging over multiple samples mitigates this to some extent.
+type BatteryService struct {
+	logger        *slog.Logger
+	adc           machine.ADC
+	samples       int
+	d             time.Duration
+	vEmpty, vFull float32
+	divider, vRef float32
+}
+
+func NewBatteryService(opts ...BatteryServiceOption) *BatteryService {
+	s := &BatteryService{
+		logger:  nil,
+		adc:     machine.ADC{Pin: machine.ADC3},
+		samples: 8,
+		d:       time.Millisecond,
+		// Typical discharge range of a single LiPo cell.
+		vEmpty:  3.3,
+		vFull:   4.2,
+		divider: 3,
+		vRef:    3.3,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+func (s *BatteryService) Init() error {
+	s.debug("init battery monitor", "pin", s.adc.Pin)
+	machine.InitADC()
+	return s.adc.Configure(machine.ADCConfig{})
+}
+
+// Voltage returns the averaged system supply voltage.
+func (s *BatteryService) Voltage() float32 {
+	var sum uint32
+	for i := 0; i < s.samples; i++ {
+		sum += uint32(s.adc.Get())
+		time.Sleep(s.d)
+	}
+	// ADC readings are scaled to 16 bits regardless of the hardware resolution.
+	return float32(sum) / float32(s.samples) / 0xffff * s.vRef * s.divider
+}
+
+// Read returns the estimated remaining battery charge in percent. For simplicity, a linear discharge curve is assumed.
+func (s *BatteryService) Read() uint8 {
+	v := s.Voltage()
+	level := chargeLevel(v, s.vEmpty, s.vFull)
+	s.debug("read battery level", "voltage", v, "level", level)
+	return level
+}
+
+// chargeLevel maps the voltage linearly onto the given range in percent, clamping voltages outside of it.
+func chargeLevel(v, vEmpty, vFull float32) uint8 {
+	switch {
+	case v >= vFull:
+		return 100
+	case v > vEmpty:
+		return uint8((v - vEmpty) / (vFull - vEmpty) * 100)
+	}
+	return 0
+}
+
+func (s *BatteryService) debug(msg string, args ...any) {
+	if s.logger != nil {
+		s.logger.Debug(msg, args...)
+	}
+}
+
+type BatteryServiceOption func(*BatteryService)
+
+func WithADCPin(p machine.Pin) BatteryServiceOption {
+	return func(s *BatteryService) {
+		s.adc = machine.ADC{Pin: p}
+	}
+}
+
+// WithVoltageRange sets the supply voltages corresponding to an empty and full battery respectively.
+func WithVoltageRange(empty, full float32) BatteryServiceOption {
+	return func(s *BatteryService) {
+		s.vEmpty = empty
+		s.vFull = full
+	}
+}
+
+func WithSamples(n int) BatteryServiceOption {
+	return func(s *BatteryService) {
+		s.samples = n
+	}
+}
+
+func WithBatteryLogger(logger *slog.Logger) BatteryServiceOption {
+	return func(s *BatteryService) {
+		s.logger = logger.With("service", "battery")
+	}
+}
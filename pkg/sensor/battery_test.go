@@ -0,0 +1,41 @@
+package sensor
+
+import "testing"
+
+func TestChargeLevel(t *testing.T) {
+	tests := []struct {
+		v     float32
+		level uint8
+	}{
+		{0, 0},
+		{2.5, 0},
+		{3, 0},
+		{3.25, 25},
+		{3.5, 50},
+		{3.75, 75},
+		{4, 100},
+		{5, 100},
+	}
+	for _, tt := range tests {
+		if got := chargeLevel(tt.v, 3, 4); got != tt.level {
+			t.Errorf("Expected level at %vV to be '%v', got '%v'", tt.v, tt.level, got)
+		}
+	}
+}
+
+func TestChargeLevelDefaultRange(t *testing.T) {
+	s := NewBatteryService()
+	tests := []struct {
+		v        float32
+		min, max uint8
+	}{
+		{3.3, 0, 0},
+		{3.75, 49, 50},
+		{4.2, 100, 100},
+	}
+	for _, tt := range tests {
+		if got := chargeLevel(tt.v, s.vEmpty, s.vFull); got < tt.min || got > tt.max {
+			t.Errorf("Expected level at %vV to be within '%v' and '%v', got '%v'", tt.v, tt.min, tt.max, got)
+		}
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"log/slog"
 	"machine"
 	"time"
+
+	"github.com/toalaah/smart-bottle/pkg/diag"
 )
 
 type DepthSensorService struct {
@@ -13,6 +15,10 @@ type DepthSensorService struct {
 	d               time.Duration
 	buf             []byte
 	maxReadAttempts int
+	// Optional pin switching the sensor's supply, allowing it to be powered down between readings.
+	powerPin machine.Pin
+	// Whether the supply is switched on by driving powerPin low rather than high.
+	powerActiveLow bool
 }
 
 func NewDepthSensorService(opts ...DepthSensorServiceOption) *DepthSensorService {
@@ -22,6 +28,7 @@ func NewDepthSensorService(opts ...DepthSensorServiceOption) *DepthSensorService
 		d:               time.Millisecond * 100,
 		buf:             make([]byte, 4),
 		maxReadAttempts: -1,
+		powerPin:        machine.NoPin,
 	}
 	for _, opt := range opts {
 		opt(s)
@@ -32,9 +39,38 @@ func NewDepthSensorService(opts ...DepthSensorServiceOption) *DepthSensorService
 func (s *DepthSensorService) Init() error {
 	s.debug("init depth sensor")
 	s.u.Configure(machine.UARTConfig{BaudRate: 9600})
+	if s.powerPin != machine.NoPin {
+		s.powerPin.Configure(machine.PinConfig{Mode: machine.PinOutput})
+		s.setPower(false)
+	}
+	return nil
+}
+
+// PowerOn switches on the sensor's supply. Any output buffered before is discarded, so that subsequent reads only return fresh measurements.
+func (s *DepthSensorService) PowerOn() error {
+	if s.powerPin != machine.NoPin {
+		s.debug("powering on depth sensor")
+		s.setPower(true)
+	}
+	for s.u.Buffered() > 0 {
+		s.u.ReadByte()
+	}
+	return nil
+}
+
+// PowerOff switches off the sensor's supply. Without a power pin, the sensor keeps measuring and PowerOff is a no-op.
+func (s *DepthSensorService) PowerOff() error {
+	if s.powerPin != machine.NoPin {
+		s.debug("powering off depth sensor")
+		s.setPower(false)
+	}
 	return nil
 }
 
+func (s *DepthSensorService) setPower(on bool) {
+	s.powerPin.Set(on != s.powerActiveLow)
+}
+
 func (s *DepthSensorService) Read() (float32, error) {
 	i := s.maxReadAttempts
 	s.debug("reading from sensor")
@@ -50,12 +86,15 @@ func (s *DepthSensorService) Read() (float32, error) {
 	}
 
 	if i == 0 {
+		diag.SensorFailures.Add(1)
 		return 0, fmt.Errorf("too many failed attempts reading")
 	}
 
 	s.debug("read packet", "value", s.buf)
 	sum := (s.buf[0] + s.buf[1] + s.buf[2]) & 0xff
 	if sum != s.buf[3] {
+		diag.SensorFailures.Add(1)
+		diag.ChecksumErrors.Add(1)
 		return 0, fmt.Errorf("incorrect checksum")
 	}
 
@@ -89,6 +128,20 @@ func WithMaxReadAttempts(i int) DepthSensorServiceOption {
 	}
 }
 
+// WithPowerPin sets the pin driving the sensor's supply switch, see PowerOn and PowerOff.
+func WithPowerPin(p machine.Pin) DepthSensorServiceOption {
+	return func(s *DepthSensorService) {
+		s.powerPin = p
+	}
+}
+
+// WithPowerActiveLow sets whether the power pin switches on the sensor's supply when driven low, as a P-channel MOSFET on the high side does. By default, the supply is switched on by driving the pin high, as the enable input of most load switches does.
+func WithPowerActiveLow(activeLow bool) DepthSensorServiceOption {
+	return func(s *DepthSensorService) {
+		s.powerActiveLow = activeLow
+	}
+}
+
 func WithLogger(logger *slog.Logger) DepthSensorServiceOption {
 	return func(s *DepthSensorService) {
 		s.logger = logger.With("service", "sensor")
@@ -0,0 +1,62 @@
+package storage
+
+// Memory is a RAM-backed block device mimicking NOR flash semantics: erasing sets all bits, programming may only clear them. It is used in host-side tests and simulators.
+type Memory struct {
+	data                   []byte
+	writeBlock, eraseBlock int64
+}
+
+func NewMemory(size, writeBlockSize, eraseBlockSize int64) *Memory {
+	m := &Memory{
+		data:       make([]byte, size),
+		writeBlock: writeBlockSize,
+		eraseBlock: eraseBlockSize,
+	}
+	for i := range m.data {
+		m.data[i] = 0xff
+	}
+	return m
+}
+
+func (m *Memory) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > m.Size() {
+		return 0, ErrOutOfBounds
+	}
+	return copy(p, m.data[off:]), nil
+}
+
+func (m *Memory) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > m.Size() {
+		return 0, ErrOutOfBounds
+	}
+	if off%m.writeBlock != 0 {
+		return 0, ErrUnaligned
+	}
+	for i, b := range p {
+		m.data[off+int64(i)] &= b
+	}
+	return len(p), nil
+}
+
+func (m *Memory) Size() int64 {
+	return int64(len(m.data))
+}
+
+func (m *Memory) WriteBlockSize() int64 {
+	return m.writeBlock
+}
+
+func (m *Memory) EraseBlockSize() int64 {
+	return m.eraseBlock
+}
+
+func (m *Memory) EraseBlocks(start, n int64) error {
+	from, to := start*m.eraseBlock, (start+n)*m.eraseBlock
+	if start < 0 || to > m.Size() {
+		return ErrOutOfBounds
+	}
+	for i := from; i < to; i++ {
+		m.data[i] = 0xff
+	}
+	return nil
+}
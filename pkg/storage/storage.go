@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"errors"
+)
+
+var (
+	ErrOutOfBounds = errors.New("access out of bounds")
+	ErrUnaligned   = errors.New("access is not block aligned")
+)
+
+// BlockDevice is the subset of TinyGo's machine.BlockDevice required for persisting data. On the bottle this is implemented by machine.Flash, on the host by Memory.
+type BlockDevice interface {
+	ReadAt(p []byte, off int64) (int, error)
+	WriteAt(p []byte, off int64) (int, error)
+	Size() int64
+	WriteBlockSize() int64
+	EraseBlockSize() int64
+	EraseBlocks(start, len int64) error
+}
+
+// Partition restricts a block device to a window starting at offset and spanning size bytes. Both values must be multiples of the device's erase block size.
+type Partition struct {
+	dev          BlockDevice
+	offset, size int64
+}
+
+func NewPartition(dev BlockDevice, offset, size int64) (*Partition, error) {
+	bs := dev.EraseBlockSize()
+	if offset%bs != 0 || size%bs != 0 {
+		return nil, ErrUnaligned
+	}
+	if offset < 0 || size <= 0 || offset+size > dev.Size() {
+		return nil, ErrOutOfBounds
+	}
+	return &Partition{dev: dev, offset: offset, size: size}, nil
+}
+
+func (p *Partition) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(b)) > p.size {
+		return 0, ErrOutOfBounds
+	}
+	return p.dev.ReadAt(b, p.offset+off)
+}
+
+func (p *Partition) WriteAt(b []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(b)) > p.size {
+		return 0, ErrOutOfBounds
+	}
+	return p.dev.WriteAt(b, p.offset+off)
+}
+
+func (p *Partition) Size() int64 {
+	return p.size
+}
+
+func (p *Partition) WriteBlockSize() int64 {
+	return p.dev.WriteBlockSize()
+}
+
+func (p *Partition) EraseBlockSize() int64 {
+	return p.dev.EraseBlockSize()
+}
+
+func (p *Partition) EraseBlocks(start, n int64) error {
+	if start < 0 || (start+n)*p.EraseBlockSize() > p.size {
+		return ErrOutOfBounds
+	}
+	return p.dev.EraseBlocks(p.offset/p.EraseBlockSize()+start, n)
+}
@@ -0,0 +1,108 @@
+package transport
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+)
+
+// AdvertisementType follows the device ID in the manufacturer data advertised by the bottle, determining how the remainder is to be interpreted.
+type AdvertisementType uint8
+
+const (
+	// AdvertisementBroadcast is followed by an encrypted broadcast frame, see crypto.BroadcastCipher.
+	AdvertisementBroadcast AdvertisementType = iota + 1
+	// AdvertisementCapabilities is followed by the bottle's protocol version and features, see Capabilities.MarshalAdvertisement.
+	AdvertisementCapabilities
+)
+
+// BroadcastLen is the size of a marshaled broadcast in bytes.
+const BroadcastLen = 9
+
+// Broadcast is the plaintext of a broadcast advertisement, allowing clients to receive readings without connecting.
+type Broadcast struct {
+	Seq     uint32
+	Level   float32
+	Battery uint8
+}
+
+func (b *Broadcast) MarshalBytes() []byte {
+	buf := make([]byte, BroadcastLen)
+	binary.LittleEndian.PutUint32(buf[0:], b.Seq)
+	binary.LittleEndian.PutUint32(buf[4:], math.Float32bits(b.Level))
+	buf[8] = b.Battery
+	return buf
+}
+
+func UnmarshalBroadcast(b *Broadcast, buf []byte) error {
+	if len(buf) < BroadcastLen {
+		return fmt.Errorf("expected broadcast of at least length %d, got %d", BroadcastLen, len(buf))
+	}
+	b.Seq = binary.LittleEndian.Uint32(buf[0:])
+	b.Level = math.Float32frombits(binary.LittleEndian.Uint32(buf[4:]))
+	b.Battery = buf[8]
+	return nil
+}
+
+// DeviceIDLen is the size of a device ID in bytes.
+const DeviceIDLen = 4
+
+// DeviceID is a short identifier unique to each bottle. It is advertised at the start of the manufacturer data and doubles as the bottle's serial number, allowing clients to target a specific bottle before connecting.
+type DeviceID [DeviceIDLen]byte
+
+func (id DeviceID) String() string {
+	return fmt.Sprintf("%X", id[:])
+}
+
+// ParseDeviceID parses a device ID in the format returned by String.
+func ParseDeviceID(s string) (DeviceID, error) {
+	id := DeviceID{}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return id, err
+	}
+	if len(b) != DeviceIDLen {
+		return id, fmt.Errorf("expected device ID of length %d, got %d", DeviceIDLen, len(b))
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+// MarshalText encodes the device ID as returned by String, e.g. for use as a JSON object key.
+func (id DeviceID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+func (id *DeviceID) UnmarshalText(b []byte) error {
+	parsed, err := ParseDeviceID(string(b))
+	if err != nil {
+		return err
+	}
+	*id = parsed
+	return nil
+}
+
+// MarshalManufacturerData returns the manufacturer data advertised by a bottle: its device ID, optionally followed by the advertisement type and payload.
+func MarshalManufacturerData(id DeviceID, t AdvertisementType, payload []byte) []byte {
+	buf := make([]byte, 0, DeviceIDLen+1+len(payload))
+	buf = append(buf, id[:]...)
+	if t == 0 {
+		return buf
+	}
+	buf = append(buf, byte(t))
+	return append(buf, payload...)
+}
+
+// UnmarshalManufacturerData splits advertised manufacturer data into its parts, see MarshalManufacturerData. The returned type is zero if the bottle advertises no payload.
+func UnmarshalManufacturerData(buf []byte) (DeviceID, AdvertisementType, []byte, error) {
+	id := DeviceID{}
+	if len(buf) < DeviceIDLen {
+		return id, 0, nil, fmt.Errorf("expected manufacturer data of at least length %d, got %d", DeviceIDLen, len(buf))
+	}
+	copy(id[:], buf)
+	if len(buf) == DeviceIDLen {
+		return id, 0, nil, nil
+	}
+	return id, AdvertisementType(buf[DeviceIDLen]), buf[DeviceIDLen+1:], nil
+}
@@ -0,0 +1,25 @@
+package transport
+
+import "fmt"
+
+// AlertLevel is the value of the Immediate Alert Service's alert level characteristic.
+type AlertLevel uint8
+
+const (
+	AlertNone AlertLevel = iota
+	AlertMild
+	AlertHigh
+)
+
+func (a AlertLevel) String() string {
+	switch a {
+	case AlertNone:
+		return "none"
+	case AlertMild:
+		return "mild"
+	case AlertHigh:
+		return "high"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(a))
+	}
+}
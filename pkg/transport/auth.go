@@ -0,0 +1,30 @@
+package transport
+
+// AuthStatus is notified by the bottle on the auth characteristic once it has checked a client's handshake. Only bottles speaking protocol version 2 or newer confirm handshakes.
+type AuthStatus uint8
+
+const (
+	AuthPending AuthStatus = iota
+	AuthSucceeded
+	AuthFailed
+)
+
+func (s AuthStatus) String() string {
+	switch s {
+	case AuthPending:
+		return "pending"
+	case AuthSucceeded:
+		return "succeeded"
+	case AuthFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	// AuthConfirmationVersion is the first protocol version in which bottles confirm handshakes.
+	AuthConfirmationVersion = 2
+	// KeyAgreementVersion is the first protocol version in which clients contribute a secret to the session key, which the bottle proves having derived when confirming the handshake, see crypto.KeyConfirmation.
+	KeyAgreementVersion = 3
+)
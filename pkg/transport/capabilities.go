@@ -0,0 +1,135 @@
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// ProtocolVersion is the version of the protocol spoken by this build. It is bumped whenever a change would break peers built against an older version.
+	ProtocolVersion = 3
+	// MinProtocolVersion is the oldest protocol version this build still interoperates with.
+	MinProtocolVersion = 1
+)
+
+// ErrIncompatible is returned if the protocol versions or payload formats of bottle and client do not overlap.
+var ErrIncompatible = errors.New("incompatible protocol")
+
+// Feature is a bitmask of optional features enabled on a bottle.
+type Feature uint16
+
+const (
+	FeatureAuth Feature = 1 << iota
+	FeatureCommands
+	// FeatureBatching indicates that the bottle buffers readings while disconnected and replays them on request, see NewSyncCommand.
+	FeatureBatching
+	FeatureBroadcast
+	FeatureBattery
+	FeaturePublicMode
+	FeatureFirmwareUpdate
+	FeatureAlert
+	FeatureLogs
+	FeatureDiagnostics
+)
+
+var featureNames = []string{"auth", "commands", "batching", "broadcast", "battery", "public-mode", "firmware-update", "alert", "logs", "diagnostics"}
+
+// Has reports whether all of the given features are enabled.
+func (f Feature) Has(features Feature) bool {
+	return f&features == features
+}
+
+func (f Feature) String() string {
+	var names []string
+	for i, name := range featureNames {
+		if f&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	if unknown := f &^ (1<<len(featureNames) - 1); unknown != 0 {
+		names = append(names, fmt.Sprintf("unknown(%#x)", uint16(unknown)))
+	}
+	return strings.Join(names, "|")
+}
+
+// Format is a bitmask of payload formats a bottle encodes its messages in. Formats are versioned individually, so that a bottle may offer a new encoding alongside an old one while clients migrate.
+type Format uint8
+
+const (
+	// FormatReadingV1 encodes readings as sequence number, timestamp and fill level, see Reading.
+	FormatReadingV1 Format = 1 << iota
+	// FormatDiagnosticsV1 encodes health reports as described by Diagnostics.
+	FormatDiagnosticsV1
+	// FormatLogV1 encodes log lines as described by LogEntry.
+	FormatLogV1
+)
+
+// Formats lists the payload formats understood by this build.
+const Formats = FormatReadingV1 | FormatDiagnosticsV1 | FormatLogV1
+
+// CapabilitiesLen is the size of marshaled capabilities in bytes. Peers ignore trailing bytes, allowing future versions to append fields.
+const CapabilitiesLen = 5
+
+// Capabilities describe the protocol version, features and payload formats of a bottle. They are readable before authenticating, allowing clients to adapt or bail out early.
+type Capabilities struct {
+	Version    uint8
+	MinVersion uint8
+	Features   Feature
+	Formats    Format
+}
+
+func (c *Capabilities) MarshalBytes() []byte {
+	b := make([]byte, CapabilitiesLen)
+	b[0] = c.Version
+	b[1] = c.MinVersion
+	binary.LittleEndian.PutUint16(b[2:], uint16(c.Features))
+	b[4] = byte(c.Formats)
+	return b
+}
+
+func UnmarshalCapabilities(c *Capabilities, b []byte) error {
+	if len(b) < CapabilitiesLen {
+		return fmt.Errorf("expected capabilities of at least length %d, got %d", CapabilitiesLen, len(b))
+	}
+	c.Version = b[0]
+	c.MinVersion = b[1]
+	c.Features = Feature(binary.LittleEndian.Uint16(b[2:]))
+	c.Formats = Format(b[4])
+	return nil
+}
+
+// AdvertisedCapabilitiesLen is the size of capabilities marshaled for advertisements in bytes.
+const AdvertisedCapabilitiesLen = 4
+
+// MarshalAdvertisement returns the capabilities in the compact form advertised by the bottle, which omits the payload formats in order to fit into the advertisement.
+func (c *Capabilities) MarshalAdvertisement() []byte {
+	return c.MarshalBytes()[:AdvertisedCapabilitiesLen]
+}
+
+// UnmarshalAdvertisedCapabilities parses capabilities marshaled by MarshalAdvertisement. Payload formats are left empty.
+func UnmarshalAdvertisedCapabilities(c *Capabilities, b []byte) error {
+	if len(b) < AdvertisedCapabilitiesLen {
+		return fmt.Errorf("expected advertised capabilities of at least length %d, got %d", AdvertisedCapabilitiesLen, len(b))
+	}
+	c.Version = b[0]
+	c.MinVersion = b[1]
+	c.Features = Feature(binary.LittleEndian.Uint16(b[2:]))
+	c.Formats = 0
+	return nil
+}
+
+// Compatible checks whether a peer with the given capabilities can talk to this build, returning an error wrapping ErrIncompatible which tells which side needs to be updated otherwise.
+func (c *Capabilities) Compatible() error {
+	if ProtocolVersion < c.MinVersion {
+		return fmt.Errorf("%w: bottle requires protocol version %d or newer, but this client speaks version %d, please update the client", ErrIncompatible, c.MinVersion, ProtocolVersion)
+	}
+	if c.Version < MinProtocolVersion {
+		return fmt.Errorf("%w: bottle speaks protocol version %d, but this client requires version %d or newer, please update the bottle's firmware", ErrIncompatible, c.Version, MinProtocolVersion)
+	}
+	if c.Formats&FormatReadingV1 == 0 {
+		return fmt.Errorf("%w: bottle does not offer a reading format known to this client, please update the client", ErrIncompatible)
+	}
+	return nil
+}
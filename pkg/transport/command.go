@@ -0,0 +1,104 @@
+package transport
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+)
+
+type CommandCode uint8
+
+const (
+	// CommandSync requests all buffered readings following the given sequence number. The argument doubles as an acknowledgement of all readings up to and including it.
+	CommandSync CommandCode = iota + 1
+	// CommandLog starts or stops streaming log lines at or above the given level.
+	CommandLog
+	// CommandConnectionMode requests the bottle to switch to the given connection mode.
+	CommandConnectionMode
+)
+
+// ConnectionMode selects between the connection parameters used by the bottle.
+type ConnectionMode uint8
+
+const (
+	// ConnectionSlow trades latency for power while idly monitoring.
+	ConnectionSlow ConnectionMode = iota
+	// ConnectionFast speeds up transfers such as pairing, syncing and firmware updates.
+	ConnectionFast
+)
+
+func (m ConnectionMode) String() string {
+	switch m {
+	case ConnectionSlow:
+		return "slow"
+	case ConnectionFast:
+		return "fast"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(m))
+	}
+}
+
+// Command is a request issued by the client to the bottle. Commands are encrypted with the session key and carried in a message of type Control.
+type Command struct {
+	Code CommandCode
+	Args []byte
+}
+
+func NewSyncCommand(since uint32) *Command {
+	args := make([]byte, 4)
+	binary.LittleEndian.PutUint32(args, since)
+	return &Command{Code: CommandSync, Args: args}
+}
+
+func (c *Command) MarshalBytes() []byte {
+	return append([]byte{byte(c.Code)}, c.Args...)
+}
+
+func UnmarshalCommand(c *Command, b []byte) error {
+	if len(b) < 1 {
+		return fmt.Errorf("expected command of at least length 1")
+	}
+	c.Code = CommandCode(b[0])
+	c.Args = b[1:]
+	return nil
+}
+
+// SyncSince returns the sequence number argument of a sync command.
+func (c *Command) SyncSince() (uint32, error) {
+	if c.Code != CommandSync || len(c.Args) < 4 {
+		return 0, fmt.Errorf("not a valid sync command")
+	}
+	return binary.LittleEndian.Uint32(c.Args), nil
+}
+
+func NewLogCommand(enable bool, level slog.Level) *Command {
+	args := []byte{0, byte(int8(level))}
+	if enable {
+		args[0] = 1
+	}
+	return &Command{Code: CommandLog, Args: args}
+}
+
+// LogLevel returns whether a log command enables streaming and the minimum level of streamed lines.
+func (c *Command) LogLevel() (bool, slog.Level, error) {
+	if c.Code != CommandLog || len(c.Args) < 2 {
+		return false, 0, fmt.Errorf("not a valid log command")
+	}
+	return c.Args[0] != 0, slog.Level(int8(c.Args[1])), nil
+}
+
+func NewConnectionModeCommand(mode ConnectionMode) *Command {
+	return &Command{Code: CommandConnectionMode, Args: []byte{byte(mode)}}
+}
+
+// ConnectionMode returns the mode requested by a connection mode command.
+func (c *Command) ConnectionMode() (ConnectionMode, error) {
+	if c.Code != CommandConnectionMode || len(c.Args) < 1 {
+		return 0, fmt.Errorf("not a valid connection mode command")
+	}
+	mode := ConnectionMode(c.Args[0])
+	if mode != ConnectionSlow && mode != ConnectionFast {
+		return 0, fmt.Errorf("unknown connection mode %d", mode)
+	}
+	return mode, nil
+}
@@ -0,0 +1,81 @@
+package transport
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ResetReason describes what caused the bottle to last boot.
+type ResetReason uint8
+
+const (
+	// ResetPowerOn covers power-on, the reset pin, debugger resets and software resets via machine.CPUReset, none of which are recorded by the watchdog.
+	ResetPowerOn ResetReason = iota
+	// ResetWatchdog indicates that the watchdog timed out, i.e. the firmware hung.
+	ResetWatchdog
+	// ResetForced indicates that the chip was reset by triggering the watchdog. The firmware itself never does so.
+	ResetForced
+)
+
+func (r ResetReason) String() string {
+	switch r {
+	case ResetPowerOn:
+		return "power-on"
+	case ResetWatchdog:
+		return "watchdog"
+	case ResetForced:
+		return "forced"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(r))
+	}
+}
+
+// diagnosticsFixedLen is the size of a marshaled diagnostics report excluding the firmware version.
+const diagnosticsFixedLen = 26
+
+// Diagnostics is a health report of the bottle, allowing misbehaving bottles to be inspected in the field. Counters are reset on boot.
+type Diagnostics struct {
+	// Uptime in seconds.
+	Uptime      uint32
+	ResetReason ResetReason
+	Version     string
+
+	SensorFailures  uint32
+	ChecksumErrors  uint32
+	AuthFailures    uint32
+	DroppedMessages uint32
+	// Free heap in bytes.
+	FreeHeap uint32
+}
+
+func (d *Diagnostics) MarshalBytes() []byte {
+	buf := make([]byte, diagnosticsFixedLen, diagnosticsFixedLen+len(d.Version))
+	binary.LittleEndian.PutUint32(buf[0:], d.Uptime)
+	buf[4] = byte(d.ResetReason)
+	binary.LittleEndian.PutUint32(buf[5:], d.SensorFailures)
+	binary.LittleEndian.PutUint32(buf[9:], d.ChecksumErrors)
+	binary.LittleEndian.PutUint32(buf[13:], d.AuthFailures)
+	binary.LittleEndian.PutUint32(buf[17:], d.DroppedMessages)
+	binary.LittleEndian.PutUint32(buf[21:], d.FreeHeap)
+	buf[25] = byte(len(d.Version))
+	return append(buf, d.Version...)
+}
+
+func UnmarshalDiagnostics(d *Diagnostics, buf []byte) error {
+	if len(buf) < diagnosticsFixedLen {
+		return fmt.Errorf("expected diagnostics of at least length %d, got %d", diagnosticsFixedLen, len(buf))
+	}
+	n := int(buf[25])
+	if len(buf) < diagnosticsFixedLen+n {
+		return fmt.Errorf("expected diagnostics of length %d, got %d", diagnosticsFixedLen+n, len(buf))
+	}
+	d.Uptime = binary.LittleEndian.Uint32(buf[0:])
+	d.ResetReason = ResetReason(buf[4])
+	d.SensorFailures = binary.LittleEndian.Uint32(buf[5:])
+	d.ChecksumErrors = binary.LittleEndian.Uint32(buf[9:])
+	d.AuthFailures = binary.LittleEndian.Uint32(buf[13:])
+	d.DroppedMessages = binary.LittleEndian.Uint32(buf[17:])
+	d.FreeHeap = binary.LittleEndian.Uint32(buf[21:])
+	d.Version = string(buf[diagnosticsFixedLen : diagnosticsFixedLen+n])
+	return nil
+}
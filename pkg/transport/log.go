@@ -0,0 +1,27 @@
+package transport
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// LogEntry is a single formatted log line streamed by the bottle. Sequence numbers allow clients to detect lines which were overwritten before they could be sent.
+type LogEntry struct {
+	Seq  uint32
+	Line string
+}
+
+func (e *LogEntry) MarshalBytes() []byte {
+	buf := make([]byte, 4, 4+len(e.Line))
+	binary.LittleEndian.PutUint32(buf, e.Seq)
+	return append(buf, e.Line...)
+}
+
+func UnmarshalLogEntry(e *LogEntry, buf []byte) error {
+	if len(buf) < 4 {
+		return fmt.Errorf("expected log entry of at least length 4, got %d", len(buf))
+	}
+	e.Seq = binary.LittleEndian.Uint32(buf)
+	e.Line = string(buf[4:])
+	return nil
+}
@@ -10,6 +10,10 @@ const (
 	HeartBeat MessageType = 1 << iota
 	WaterLevel
 	Nonce
+	Control
+	History
+	Health
+	Log
 )
 
 type Message struct {
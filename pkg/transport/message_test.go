@@ -2,7 +2,11 @@ package transport
 
 import (
 	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestMessageMarshaling(t *testing.T) {
@@ -39,3 +43,221 @@ func TestMessageUnmarshalingInvalid(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestReadingMarshaling(t *testing.T) {
+	r := &Reading{Seq: 42, Timestamp: 1700000000, Value: 12.5}
+	out := &Reading{}
+	if err := UnmarshalReading(out, r.MarshalBytes()); err != nil {
+		t.Fatal(err)
+	}
+	if *out != *r {
+		t.Errorf("Expected unmarshaled reading to be '%+v', got '%+v'", r, out)
+	}
+	if err := UnmarshalReading(out, []byte{1, 2, 3}); err == nil {
+		t.Error("Expected error unmarshaling truncated reading")
+	}
+}
+
+func TestCommandMarshaling(t *testing.T) {
+	out := &Command{}
+	if err := UnmarshalCommand(out, NewSyncCommand(1337).MarshalBytes()); err != nil {
+		t.Fatal(err)
+	}
+	since, err := out.SyncSince()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if since != 1337 {
+		t.Errorf("Expected sync sequence number to be %d, got %d", 1337, since)
+	}
+}
+
+func TestCurrentTimeMarshaling(t *testing.T) {
+	// A Sunday, with fractions of a second being a multiple of 1/256s.
+	now := time.Date(2025, time.June, 15, 13, 37, 42, int(time.Second/2), time.UTC)
+	b := MarshalCurrentTime(now)
+	if b[7] != 7 {
+		t.Errorf("Expected day of week to be %d, got %d", 7, b[7])
+	}
+	got, err := UnmarshalCurrentTime(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(now) {
+		t.Errorf("Expected unmarshaled time to be '%s', got '%s'", now, got)
+	}
+	if _, err := UnmarshalCurrentTime(make([]byte, CurrentTimeLen)); err == nil {
+		t.Error("Expected error unmarshaling unknown time")
+	}
+}
+
+func TestBroadcastMarshaling(t *testing.T) {
+	b := Broadcast{Seq: 42, Level: 7.25, Battery: 87}
+	got := Broadcast{}
+	if err := UnmarshalBroadcast(&got, b.MarshalBytes()); err != nil {
+		t.Fatal(err)
+	}
+	if got != b {
+		t.Errorf("Expected unmarshaled broadcast to be '%+v', got '%+v'", b, got)
+	}
+	if err := UnmarshalBroadcast(&got, make([]byte, BroadcastLen-1)); err == nil {
+		t.Error("Expected error unmarshaling short broadcast")
+	}
+}
+
+func TestManufacturerDataMarshaling(t *testing.T) {
+	id, err := ParseDeviceID("C0FFEE42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.String() != "C0FFEE42" {
+		t.Errorf("Expected device ID to be '%s', got '%s'", "C0FFEE42", id)
+	}
+	if _, err := ParseDeviceID("C0FFEE"); err == nil {
+		t.Error("Expected error parsing short device ID")
+	}
+
+	gotID, typ, payload, err := UnmarshalManufacturerData(MarshalManufacturerData(id, 0, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotID != id || typ != 0 || len(payload) != 0 {
+		t.Errorf("Expected bare device ID '%s', got '%s' with type %d and payload '%v'", id, gotID, typ, payload)
+	}
+
+	gotID, typ, payload, err = UnmarshalManufacturerData(MarshalManufacturerData(id, AdvertisementBroadcast, []byte{1, 2, 3}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotID != id || typ != AdvertisementBroadcast || !bytes.Equal(payload, []byte{1, 2, 3}) {
+		t.Errorf("Expected broadcast from '%s', got '%s' with type %d and payload '%v'", id, gotID, typ, payload)
+	}
+}
+
+func TestDiagnosticsMarshaling(t *testing.T) {
+	d := Diagnostics{
+		Uptime:          3600,
+		ResetReason:     ResetWatchdog,
+		Version:         "0.1",
+		SensorFailures:  1,
+		ChecksumErrors:  2,
+		AuthFailures:    3,
+		DroppedMessages: 4,
+		FreeHeap:        65536,
+	}
+	b := d.MarshalBytes()
+	got := Diagnostics{}
+	if err := UnmarshalDiagnostics(&got, b); err != nil {
+		t.Fatal(err)
+	}
+	if got != d {
+		t.Errorf("Expected unmarshaled diagnostics to be '%+v', got '%+v'", d, got)
+	}
+	if err := UnmarshalDiagnostics(&got, b[:len(b)-1]); err == nil {
+		t.Error("Expected error unmarshaling truncated diagnostics")
+	}
+}
+
+func TestLogMarshaling(t *testing.T) {
+	e := LogEntry{Seq: 7, Line: "level=INFO msg=hello"}
+	got := LogEntry{}
+	if err := UnmarshalLogEntry(&got, e.MarshalBytes()); err != nil {
+		t.Fatal(err)
+	}
+	if got != e {
+		t.Errorf("Expected unmarshaled log entry to be '%+v', got '%+v'", e, got)
+	}
+
+	cmd := Command{}
+	if err := UnmarshalCommand(&cmd, NewLogCommand(true, slog.LevelDebug).MarshalBytes()); err != nil {
+		t.Fatal(err)
+	}
+	enable, level, err := cmd.LogLevel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !enable || level != slog.LevelDebug {
+		t.Errorf("Expected log command to enable level '%s', got '%v' and '%s'", slog.LevelDebug, enable, level)
+	}
+}
+
+func TestConnectionModeCommand(t *testing.T) {
+	cmd := Command{}
+	if err := UnmarshalCommand(&cmd, NewConnectionModeCommand(ConnectionFast).MarshalBytes()); err != nil {
+		t.Fatal(err)
+	}
+	mode, err := cmd.ConnectionMode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode != ConnectionFast {
+		t.Errorf("Expected connection mode to be '%s', got '%s'", ConnectionFast, mode)
+	}
+	if _, err := (&Command{Code: CommandConnectionMode, Args: []byte{42}}).ConnectionMode(); err == nil {
+		t.Error("Expected error for unknown connection mode")
+	}
+}
+
+func TestCapabilitiesMarshaling(t *testing.T) {
+	c := Capabilities{Version: 2, MinVersion: 1, Features: FeatureAuth | FeatureDiagnostics, Formats: Formats}
+	// Trailing bytes appended by newer versions must be ignored.
+	b := append(c.MarshalBytes(), 0xff)
+	got := Capabilities{}
+	if err := UnmarshalCapabilities(&got, b); err != nil {
+		t.Fatal(err)
+	}
+	if got != c {
+		t.Errorf("Expected capabilities to be '%+v', got '%+v'", c, got)
+	}
+	if s := got.Features.String(); s != "auth|diagnostics" {
+		t.Errorf("Expected features to be '%s', got '%s'", "auth|diagnostics", s)
+	}
+}
+
+func TestCapabilitiesCompatible(t *testing.T) {
+	tests := []struct {
+		c  Capabilities
+		ok bool
+	}{
+		{Capabilities{Version: ProtocolVersion, MinVersion: MinProtocolVersion, Formats: Formats}, true},
+		{Capabilities{Version: ProtocolVersion + 1, MinVersion: ProtocolVersion, Formats: FormatReadingV1}, true},
+		{Capabilities{Version: ProtocolVersion + 2, MinVersion: ProtocolVersion + 1, Formats: Formats}, false},
+		{Capabilities{Version: MinProtocolVersion - 1, MinVersion: 0, Formats: Formats}, false},
+		{Capabilities{Version: ProtocolVersion, MinVersion: MinProtocolVersion, Formats: FormatLogV1}, false},
+	}
+	for _, tt := range tests {
+		err := tt.c.Compatible()
+		if (err == nil) != tt.ok {
+			t.Errorf("Expected compatibility of '%+v' to be '%v', got '%v'", tt.c, tt.ok, err)
+		}
+		if err != nil && !errors.Is(err, ErrIncompatible) {
+			t.Errorf("Expected error to wrap '%v', got '%v'", ErrIncompatible, err)
+		}
+	}
+
+	// Clients treat bottles lacking capabilities as speaking version 0, which must be blamed on their firmware.
+	legacy := Capabilities{}
+	if err := legacy.Compatible(); err == nil || !strings.Contains(err.Error(), "version 0") || !strings.Contains(err.Error(), "firmware") {
+		t.Errorf("Expected bottle without capabilities to require a firmware update, got '%v'", err)
+	}
+}
+
+func TestAdvertisedCapabilities(t *testing.T) {
+	c := Capabilities{Version: ProtocolVersion, MinVersion: MinProtocolVersion, Features: FeatureAuth | FeatureBroadcast, Formats: Formats}
+	id := DeviceID{0xde, 0xad, 0xbe, 0xef}
+	_, typ, payload, err := UnmarshalManufacturerData(MarshalManufacturerData(id, AdvertisementCapabilities, c.MarshalAdvertisement()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ != AdvertisementCapabilities {
+		t.Errorf("Expected advertisement type to be '%v', got '%v'", AdvertisementCapabilities, typ)
+	}
+	got := Capabilities{}
+	if err := UnmarshalAdvertisedCapabilities(&got, payload); err != nil {
+		t.Fatal(err)
+	}
+	c.Formats = 0
+	if got != c {
+		t.Errorf("Expected advertised capabilities to be '%+v', got '%+v'", c, got)
+	}
+}
@@ -0,0 +1,49 @@
+package transport
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// ReadingLen is the size of a marshaled reading in bytes.
+const ReadingLen = 12
+
+// Reading is a single fill level measurement as captured by the bottle. Sequence numbers are strictly increasing across reboots, allowing clients to detect and request gaps.
+type Reading struct {
+	Seq       uint32
+	Timestamp uint32
+	Value     float32
+}
+
+// minTimestamp is used to tell apart readings captured before the bottle's clock was set. TinyGo starts the clock at the Unix epoch on boot, see package clock, so any timestamp predating this firmware (2024-01-01T00:00:00Z) is the time since boot.
+const minTimestamp = 1704067200
+
+// Time returns the capture time of the reading. Unless HasTime reports true, it is the time since boot relative to the Unix epoch.
+func (r *Reading) Time() time.Time {
+	return time.Unix(int64(r.Timestamp), 0)
+}
+
+// HasTime reports whether the reading was captured after the bottle's clock had been set by a client. Otherwise, the timestamp is only relative to the bottle's boot.
+func (r *Reading) HasTime() bool {
+	return r.Timestamp >= minTimestamp
+}
+
+func (r *Reading) MarshalBytes() []byte {
+	b := make([]byte, ReadingLen)
+	binary.LittleEndian.PutUint32(b[0:], r.Seq)
+	binary.LittleEndian.PutUint32(b[4:], r.Timestamp)
+	binary.LittleEndian.PutUint32(b[8:], math.Float32bits(r.Value))
+	return b
+}
+
+func UnmarshalReading(r *Reading, b []byte) error {
+	if len(b) < ReadingLen {
+		return fmt.Errorf("expected reading of at least length %d, got %d", ReadingLen, len(b))
+	}
+	r.Seq = binary.LittleEndian.Uint32(b[0:])
+	r.Timestamp = binary.LittleEndian.Uint32(b[4:])
+	r.Value = math.Float32frombits(binary.LittleEndian.Uint32(b[8:]))
+	return nil
+}
@@ -0,0 +1,43 @@
+package transport
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// CurrentTimeLen is the size of a Current Time characteristic value as defined by the Current Time Service specification.
+const CurrentTimeLen = 10
+
+// Adjust reason flag signalling a manual time update.
+const adjustReasonManual = 1 << 0
+
+// MarshalCurrentTime encodes a time as a Current Time characteristic value. Times are always encoded in UTC.
+func MarshalCurrentTime(t time.Time) []byte {
+	t = t.UTC()
+	b := make([]byte, CurrentTimeLen)
+	binary.LittleEndian.PutUint16(b[0:], uint16(t.Year()))
+	b[2] = uint8(t.Month())
+	b[3] = uint8(t.Day())
+	b[4] = uint8(t.Hour())
+	b[5] = uint8(t.Minute())
+	b[6] = uint8(t.Second())
+	// Day of week, where Monday is 1 and Sunday is 7.
+	b[7] = uint8((int(t.Weekday())+6)%7 + 1)
+	b[8] = uint8(t.Nanosecond() / (int(time.Second) / 256))
+	b[9] = adjustReasonManual
+	return b
+}
+
+// UnmarshalCurrentTime decodes a Current Time characteristic value, interpreting it as UTC.
+func UnmarshalCurrentTime(b []byte) (time.Time, error) {
+	if len(b) < CurrentTimeLen {
+		return time.Time{}, fmt.Errorf("expected current time of at least length %d, got %d", CurrentTimeLen, len(b))
+	}
+	year := int(binary.LittleEndian.Uint16(b[0:]))
+	if year == 0 || b[2] == 0 || b[3] == 0 {
+		return time.Time{}, fmt.Errorf("current time is not known")
+	}
+	nsec := int(b[8]) * (int(time.Second) / 256)
+	return time.Date(year, time.Month(b[2]), int(b[3]), int(b[4]), int(b[5]), int(b[6]), nsec, time.UTC), nil
+}